@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// Chunk size bounds of the content defined chunker. Cut points depend only
+// on the bytes around them, so an insertion early in a file only changes
+// the chunks next to it and the rest are deduplicated.
+const (
+	MinChunkSize = 16 * 1024
+	AvgChunkSize = 64 * 1024
+	MaxChunkSize = 256 * 1024
+)
+
+// gear maps every byte to a pseudo random value for the rolling hash. It is
+// derived from a fixed seed, so all nodes cut the same content the same way.
+var gear = func() (table [256]uint64) {
+	for i := range table {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// The masks select the top bits of the hash, which depend on the last 64
+// bytes. Before the average size a cut needs two more zero bits, after it two
+// fewer, which narrows the spread of chunk sizes around the average.
+var (
+	maskSmall = topBits(bits.TrailingZeros(AvgChunkSize) + 2)
+	maskLarge = topBits(bits.TrailingZeros(AvgChunkSize) - 2)
+)
+
+func topBits(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Chunker splits a stream into content defined chunks using a gear based
+// rolling hash (FastCDC). It holds at most MaxChunkSize bytes in memory.
+type Chunker struct {
+	r          io.Reader
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{
+		r:   r,
+		buf: make([]byte, MaxChunkSize),
+	}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if !c.eof && c.end-c.start < MaxChunkSize {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cutPoint returns the length of the chunk at the start of data.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= MinChunkSize {
+		return n
+	}
+	n = min(n, MaxChunkSize)
+	normal := min(n, AvgChunkSize)
+
+	var fp uint64
+	i := MinChunkSize
+	for ; i < normal; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func randomData(seed byte, n int) []byte {
+	data := make([]byte, n)
+	rand.NewChaCha8([32]byte{seed}).Read(data)
+	return data
+}
+
+func chunks(t *testing.T, data []byte) [][]byte {
+	var out [][]byte
+	c := NewChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			return out
+		}
+		assert.Nil(t, err)
+		out = append(out, bytes.Clone(chunk))
+	}
+}
+
+func TestChunkerBounds(t *testing.T) {
+	data := randomData(1, 4*1024*1024)
+
+	got := chunks(t, data)
+	assert.Equal(t, data, bytes.Join(got, nil))
+	for i, chunk := range got {
+		assert.LessOrEqual(t, len(chunk), MaxChunkSize)
+		if i < len(got)-1 {
+			assert.GreaterOrEqual(t, len(chunk), MinChunkSize)
+		}
+	}
+
+	// the average is only a target, but it should be in the right ballpark
+	avg := len(data) / len(got)
+	assert.Greater(t, avg, AvgChunkSize/2)
+	assert.Less(t, avg, AvgChunkSize*2)
+}
+
+func TestChunkerIsContentDefined(t *testing.T) {
+	data := randomData(2, 2*1024*1024)
+	shifted := append(append(randomData(3, 100), data[:1000]...), data[1000:]...)
+
+	before := map[string]bool{}
+	for _, chunk := range chunks(t, data) {
+		before[bytesHash(chunk)] = true
+	}
+
+	// inserting bytes at the start only changes the first chunk
+	after := chunks(t, shifted)
+	changed := 0
+	for _, chunk := range after {
+		if !before[bytesHash(chunk)] {
+			changed++
+		}
+	}
+	assert.LessOrEqual(t, changed, 2)
+	assert.Greater(t, len(after), 10)
+}
+
+func TestChunkerSmallInput(t *testing.T) {
+	assert.Empty(t, chunks(t, nil))
+	assert.Equal(t, [][]byte{[]byte("tiny")}, chunks(t, []byte("tiny")))
+}
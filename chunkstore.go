@@ -0,0 +1,969 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// chunksDir holds the chunks of all objects below the store root. Its name
+// cannot be produced by CASPathTransformFunc.
+const chunksDir = ".chunks"
+
+// quarantineDir holds the corrupt objects and chunks moved out of the way
+// by Quarantine.
+const quarantineDir = ".quarantine"
+
+// manifestMagic starts every manifest, it tells manifests apart from
+// objects written as a single file before chunking.
+const manifestMagic = "p2p-manifest v1\n"
+
+var (
+	ErrNotManifest = errors.New("object is not a chunk manifest")
+	// ErrCorrupt is returned for an object whose content does not match
+	// its digest.
+	ErrCorrupt = errors.New("object does not match its digest")
+)
+
+// ChunkRef identifies a chunk by the hex SHA-256 of its content.
+type ChunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Manifest lists the chunks an object is made of, in order.
+type Manifest struct {
+	Size int64 `json:"size"`
+	// Digest is the hex SHA-256 of the content of the object, empty for
+	// manifests written before digests were recorded.
+	Digest string     `json:"digest"`
+	Chunks []ChunkRef `json:"chunks"`
+}
+
+// WriteManifest stores m as the object key. All chunks it refers to must
+// be in the store already.
+func (s *Store) WriteManifest(key string, m *Manifest) error {
+	w, err := s.CreateManifest(key)
+	if err != nil {
+		return err
+	}
+	for _, c := range m.Chunks {
+		if err := w.Add(c); err != nil {
+			w.Discard()
+			return err
+		}
+	}
+	if w.size != m.Size {
+		w.Discard()
+		return fmt.Errorf("manifest of '%s' has %d bytes of chunks, expected %d", key, w.size, m.Size)
+	}
+	return w.Close()
+}
+
+// ReadManifest returns the manifest of the object key, or ErrNotManifest
+// for an object stored as a single file. It holds all chunk references in
+// memory, OpenManifest reads them one at a time.
+func (s *Store) ReadManifest(key string) (*Manifest, error) {
+	r, err := s.OpenManifest(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	m := &Manifest{Size: r.Size, Digest: r.Digest, Chunks: []ChunkRef{}}
+	for {
+		c, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.Chunks = append(m.Chunks, c)
+	}
+}
+
+// The size and the digest of an object are only known once all of its
+// chunks are written. Manifests leave room for them at the start and fill
+// them in when closed, so they can be read and written one chunk at a time.
+const (
+	manifestSizePrefix   = `{"size":`
+	manifestSizeWidth    = 20
+	manifestDigestPrefix = `,"digest":"`
+	manifestDigestWidth  = 2 * sha256.Size
+)
+
+// ManifestWriter writes a manifest as the chunks of an object come in. The
+// manifest is written to a temporary file next to the object, which only
+// replaces the object once it is complete.
+type ManifestWriter struct {
+	store   *Store
+	key     string
+	path    string
+	f       *os.File
+	written int64
+	size    int64
+	count   int
+	digest  hash.Hash
+	// expect is the digest the object must have, if it is known
+	expect string
+}
+
+// CreateManifest starts the manifest of the object key, replacing the
+// object if it exists once the manifest is closed.
+func (s *Store) CreateManifest(key string) (*ManifestWriter, error) {
+	path := filepath.Join(s.Root, s.objectPath(key).FullPath())
+	f, err := createTemp(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &ManifestWriter{store: s, key: key, path: path, f: f, digest: sha256.New()}
+	header := fmt.Sprintf(`%s%s%*d%s%*s","chunks":[`,
+		manifestMagic, manifestSizePrefix, manifestSizeWidth, 0, manifestDigestPrefix, manifestDigestWidth, "")
+	if err := w.write([]byte(header)); err != nil {
+		w.Discard()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Expect makes Close fail, leaving the object as it was, unless the
+// content hashes to digest.
+func (w *ManifestWriter) Expect(digest string) {
+	w.expect = digest
+}
+
+// Put stores a chunk unless the store already has it and appends it to
+// the manifest.
+func (w *ManifestWriter) Put(data []byte) (ChunkRef, error) {
+	c := ChunkRef{Hash: bytesHash(data), Size: int64(len(data))}
+
+	// the chunk is referenced before it is written, so collecting chunks
+	// never removes it, and written without holding the lock
+	w.store.chunkLock.Lock()
+	refs, err := w.store.chunkRefs()
+	if err == nil {
+		refs[c.Hash]++
+	}
+	w.store.chunkLock.Unlock()
+	if err != nil {
+		return ChunkRef{}, err
+	}
+
+	err = w.store.putChunk(c.Hash, data)
+	if err == nil {
+		w.digest.Write(data)
+		err = w.append(c)
+	}
+	if err != nil {
+		w.store.chunkLock.Lock()
+		defer w.store.chunkLock.Unlock()
+		w.store.unrefChunks([]ChunkRef{c})
+		return ChunkRef{}, err
+	}
+	return c, nil
+}
+
+// Add appends a chunk the store already has to the manifest. The chunk is
+// read to add it to the digest of the object.
+func (w *ManifestWriter) Add(c ChunkRef) error {
+	if !validChunkHash(c.Hash) {
+		return fmt.Errorf("manifest of '%s' has an invalid chunk hash", w.key)
+	}
+
+	w.store.chunkLock.Lock()
+	defer w.store.chunkLock.Unlock()
+
+	refs, err := w.store.chunkRefs()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(w.store.chunkPath(c.Hash))
+	if err != nil {
+		return fmt.Errorf("manifest of '%s' refers to missing chunk %s", w.key, c.Hash)
+	}
+	if int64(len(data)) != c.Size {
+		return fmt.Errorf("manifest of '%s' has chunk %s of %d bytes, it is %d", w.key, c.Hash, c.Size, len(data))
+	}
+	if bytesHash(data) != c.Hash {
+		return fmt.Errorf("%w: chunk %s of '%s'", ErrCorrupt, c.Hash, w.key)
+	}
+	w.digest.Write(data)
+	if err := w.append(c); err != nil {
+		return err
+	}
+	refs[c.Hash]++
+	return nil
+}
+
+func (w *ManifestWriter) append(c ChunkRef) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if w.count > 0 {
+		b = append([]byte{','}, b...)
+	}
+	if err := w.write(b); err != nil {
+		return err
+	}
+	w.count++
+	w.size += c.Size
+	return nil
+}
+
+func (w *ManifestWriter) write(b []byte) error {
+	n, err := w.f.Write(b)
+	w.written += int64(n)
+	return err
+}
+
+// Size returns the number of bytes in the chunks added so far.
+func (w *ManifestWriter) Size() int64 {
+	return w.size
+}
+
+// Close completes the manifest: it is synced to disk, checked and renamed
+// over the object. If any of that fails the manifest is discarded.
+func (w *ManifestWriter) Close() error {
+	if err := w.close(); err != nil {
+		w.Discard()
+		return err
+	}
+	return nil
+}
+
+func (w *ManifestWriter) close() error {
+	if w.expect != "" && w.Digest() != w.expect {
+		return fmt.Errorf("%w: '%s' hashes to %s, expected %s", ErrCorrupt, w.key, w.Digest(), w.expect)
+	}
+	if err := w.write([]byte("]}\n")); err != nil {
+		return err
+	}
+	header := fmt.Sprintf("%*d%s%s", manifestSizeWidth, w.size, manifestDigestPrefix, w.Digest())
+	if _, err := w.f.WriteAt([]byte(header), int64(len(manifestMagic)+len(manifestSizePrefix))); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if err := w.check(); err != nil {
+		return fmt.Errorf("writing the manifest of '%s': %w", w.key, err)
+	}
+
+	w.store.chunkLock.Lock()
+	defer w.store.chunkLock.Unlock()
+
+	if _, err := w.store.chunkRefs(); err != nil {
+		return err
+	}
+	// the chunks of the object being replaced lose a reference
+	old, _ := manifestChunks(w.path)
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		return err
+	}
+	if err := w.store.unrefChunks(old); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(w.path))
+}
+
+// check reads back what made it to disk.
+func (w *ManifestWriter) check() error {
+	f, err := os.Open(w.f.Name())
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if info.Size() != w.written {
+		f.Close()
+		return fmt.Errorf("%d bytes on disk, %d written", info.Size(), w.written)
+	}
+	r, err := newManifestReader(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer r.Close()
+	if r.Size != w.size || r.Digest != w.Digest() {
+		return errors.New("header does not match what was written")
+	}
+	return nil
+}
+
+// Digest returns the hex SHA-256 of the chunks added so far.
+func (w *ManifestWriter) Digest() string {
+	return hex.EncodeToString(w.digest.Sum(nil))
+}
+
+// Discard removes the incomplete manifest, the object stays as it was.
+// The chunks it added that no object refers to are removed too.
+func (w *ManifestWriter) Discard() error {
+	w.f.Close()
+
+	w.store.chunkLock.Lock()
+	defer w.store.chunkLock.Unlock()
+
+	if _, err := w.store.chunkRefs(); err != nil {
+		return err
+	}
+	// a manifest cut short lists the chunks added before the cut
+	chunks, _ := manifestChunks(w.f.Name())
+	if err := os.Remove(w.f.Name()); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// closed after all
+			return nil
+		}
+		return err
+	}
+	return w.store.unrefChunks(chunks)
+}
+
+// ManifestReader reads the chunks of a manifest one at a time.
+type ManifestReader struct {
+	// Size is the size of the object.
+	Size int64
+	// Digest is the hex SHA-256 of the object, empty if it is unknown.
+	Digest string
+
+	c    io.Closer
+	dec  *json.Decoder
+	read int64
+	done bool
+}
+
+// OpenManifest opens the manifest of the object key, or returns
+// ErrNotManifest for an object stored as a single file.
+func (s *Store) OpenManifest(key string) (*ManifestReader, error) {
+	f, err := os.Open(filepath.Join(s.Root, s.objectPath(key).FullPath()))
+	if err != nil {
+		return nil, err
+	}
+	r, err := newManifestReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// OpenChunked opens the manifest of the object key like OpenManifest. An
+// object stored as a single file before chunking is chunked first, its
+// content stays the same.
+func (s *Store) OpenChunked(key string) (*ManifestReader, error) {
+	m, err := s.OpenManifest(key)
+	if !errors.Is(err, ErrNotManifest) {
+		return m, err
+	}
+	if err := s.chunkObject(key); err != nil {
+		return nil, fmt.Errorf("chunking '%s': %w", key, err)
+	}
+	return s.OpenManifest(key)
+}
+
+// chunkObject replaces an object stored as a single file with a manifest
+// of its content.
+func (s *Store) chunkObject(key string) error {
+	_, r, err := s.readStream(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, ok := r.(*chunkReader); ok {
+		// chunked meanwhile
+		return nil
+	}
+	_, err = s.writeStream(key, r, "")
+	return err
+}
+
+func newManifestReader(rc io.ReadCloser) (*ManifestReader, error) {
+	br := bufio.NewReader(rc)
+	magic := make([]byte, len(manifestMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != manifestMagic {
+		return nil, ErrNotManifest
+	}
+
+	r := &ManifestReader{c: rc, dec: json.NewDecoder(br)}
+	for _, want := range []json.Token{json.Delim('{'), "size"} {
+		if err := r.expect(want); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.dec.Decode(&r.Size); err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+
+	// manifests written before digests were recorded go on with the chunks
+	tok, err := r.dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	if tok == "digest" {
+		if err := r.dec.Decode(&r.Digest); err != nil {
+			return nil, fmt.Errorf("reading manifest: %w", err)
+		}
+		r.Digest = strings.TrimSpace(r.Digest)
+		if tok, err = r.dec.Token(); err != nil {
+			return nil, fmt.Errorf("reading manifest: %w", err)
+		}
+	}
+	if tok != "chunks" {
+		return nil, fmt.Errorf("reading manifest: unexpected %v, expected chunks", tok)
+	}
+	if err := r.expect(json.Delim('[')); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Next returns the next chunk of the object, or io.EOF after the last one.
+func (r *ManifestReader) Next() (ChunkRef, error) {
+	if r.done {
+		return ChunkRef{}, io.EOF
+	}
+
+	if !r.dec.More() {
+		for _, want := range []json.Token{json.Delim(']'), json.Delim('}')} {
+			if err := r.expect(want); err != nil {
+				return ChunkRef{}, err
+			}
+		}
+		if r.read != r.Size {
+			return ChunkRef{}, fmt.Errorf("manifest has %d bytes of chunks, expected %d", r.read, r.Size)
+		}
+		r.done = true
+		return ChunkRef{}, io.EOF
+	}
+
+	var c ChunkRef
+	if err := r.dec.Decode(&c); err != nil {
+		return ChunkRef{}, fmt.Errorf("reading manifest: %w", err)
+	}
+	// the hash is turned into a path, a damaged manifest must not escape
+	// the chunks directory
+	if !validChunkHash(c.Hash) {
+		return ChunkRef{}, fmt.Errorf("reading manifest: invalid chunk hash '%s'", c.Hash)
+	}
+	r.read += c.Size
+	return c, nil
+}
+
+func (r *ManifestReader) expect(want json.Token) error {
+	tok, err := r.dec.Token()
+	if err != nil {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+	if tok != want {
+		return fmt.Errorf("reading manifest: unexpected %v, expected %v", tok, want)
+	}
+	return nil
+}
+
+func (r *ManifestReader) Close() error {
+	return r.c.Close()
+}
+
+// PutChunk stores a chunk unless the store already has it and returns its hash.
+func (s *Store) PutChunk(data []byte) (string, error) {
+	hash := bytesHash(data)
+
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	return hash, s.putChunk(hash, data)
+}
+
+// putChunk stores a chunk under its hash. The caller holds chunkLock or a
+// reference to the chunk, so it is not removed meanwhile.
+func (s *Store) putChunk(hash string, data []byte) error {
+	path := s.chunkPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+func (s *Store) HasChunk(hash string) bool {
+	if !validChunkHash(hash) {
+		return false
+	}
+	_, err := os.Stat(s.chunkPath(hash))
+	return err == nil
+}
+
+func (s *Store) ReadChunk(hash string) ([]byte, error) {
+	if !validChunkHash(hash) {
+		return nil, fmt.Errorf("invalid chunk hash '%s'", hash)
+	}
+	return os.ReadFile(s.chunkPath(hash))
+}
+
+func (s *Store) chunkPath(hash string) string {
+	return filepath.Join(s.Root, chunksDir, hash[:2], hash[2:4], hash)
+}
+
+// validChunkHash reports whether hash is a hex SHA-256. Hashes come from
+// peers, so they are checked before being turned into paths.
+func validChunkHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// unrefChunks drops a reference to each of the given chunks and removes
+// the ones nothing refers to anymore. The caller holds chunkLock and has
+// built refs.
+func (s *Store) unrefChunks(chunks []ChunkRef) error {
+	for _, c := range chunks {
+		if !validChunkHash(c.Hash) {
+			continue
+		}
+		s.refs[c.Hash]--
+		if s.refs[c.Hash] > 0 {
+			continue
+		}
+		delete(s.refs, c.Hash)
+		if err := os.Remove(s.chunkPath(c.Hash)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SweepChunks removes the chunks no object refers to, left behind by a
+// write that was interrupted or an object that was quarantined, and
+// returns how many were removed and their size. Only chunks without a
+// reference are locked out of writes, one at a time.
+func (s *Store) SweepChunks(ctx context.Context) (int, int64, error) {
+	s.chunkLock.Lock()
+	_, err := s.chunkRefs()
+	s.chunkLock.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		count int
+		size  int64
+	)
+	err = filepath.WalkDir(filepath.Join(s.Root, chunksDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !validChunkHash(d.Name()) {
+			return nil
+		}
+
+		s.chunkLock.Lock()
+		defer s.chunkLock.Unlock()
+		if s.refs[d.Name()] > 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		count++
+		size += info.Size()
+		return nil
+	})
+	return count, size, err
+}
+
+// chunkRefs returns refs, counting the references in the manifests on
+// disk if it is not built yet. The caller holds chunkLock.
+func (s *Store) chunkRefs() (map[string]int, error) {
+	if s.refs != nil {
+		return s.refs, nil
+	}
+
+	refs := make(map[string]int)
+	err := s.walkObjects(true, func(path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		r, err := newManifestReader(f)
+		if err != nil {
+			// not a manifest, nothing to keep alive
+			f.Close()
+			return nil
+		}
+		defer r.Close()
+
+		// a manifest being written ends early, the chunks it lists so far
+		// are counted all the same
+		for {
+			c, err := r.Next()
+			if err != nil {
+				return nil
+			}
+			refs[c.Hash]++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.refs = refs
+	return refs, nil
+}
+
+// Digest returns the digest recorded for the object key, empty for an
+// object written before digests were recorded.
+func (s *Store) Digest(key string) (string, error) {
+	m, err := s.OpenManifest(key)
+	if errors.Is(err, ErrNotManifest) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer m.Close()
+	return m.Digest, nil
+}
+
+// Verify re-hashes the object key and compares it with want, or with the
+// digest recorded in its manifest if want is empty. It returns an error
+// wrapping ErrCorrupt if a chunk is missing or does not match its hash, or
+// if the object does not match the digest.
+func (s *Store) Verify(key, want string) error {
+	return s.verifyObject(filepath.Join(s.Root, s.objectPath(key).FullPath()), want, nil)
+}
+
+// verifyObject verifies the object at path, calling read with the size of
+// every piece of it read from disk.
+func (s *Store) verifyObject(path, want string, read func(n int)) error {
+	if read == nil {
+		read = func(int) {}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	m, err := newManifestReader(f)
+	if errors.Is(err, ErrNotManifest) {
+		f.Close()
+		return verifyFile(path, want, read)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	defer m.Close()
+	if want == "" {
+		want = m.Digest
+	}
+
+	digest := sha256.New()
+	for {
+		c, err := m.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		data, err := s.ReadChunk(c.Hash)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: chunk %s is missing", ErrCorrupt, c.Hash)
+		}
+		if err != nil {
+			return err
+		}
+		read(len(data))
+		if bytesHash(data) != c.Hash {
+			return fmt.Errorf("%w: chunk %s does not match its hash", ErrCorrupt, c.Hash)
+		}
+		digest.Write(data)
+	}
+	if got := hex.EncodeToString(digest.Sum(nil)); want != "" && got != want {
+		return fmt.Errorf("%w: content hashes to %s, expected %s", ErrCorrupt, got, want)
+	}
+	return nil
+}
+
+// verifyFile verifies an object stored as a single file. Without a digest
+// to compare with there is nothing to verify.
+func verifyFile(path, want string, read func(n int)) error {
+	if want == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	digest := sha256.New()
+	n, err := io.Copy(digest, f)
+	if err != nil {
+		return err
+	}
+	read(int(n))
+	if got := hex.EncodeToString(digest.Sum(nil)); got != want {
+		return fmt.Errorf("%w: content hashes to %s, expected %s", ErrCorrupt, got, want)
+	}
+	return nil
+}
+
+// Quarantine moves the corrupt object key out of the way, together with
+// its chunks that do not match their hash, so it can be written again.
+func (s *Store) Quarantine(key string) error {
+	return s.quarantineObject(filepath.Join(s.Root, s.objectPath(key).FullPath()))
+}
+
+func (s *Store) quarantineObject(path string) error {
+	dir := filepath.Join(s.Root, quarantineDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	suffix := fmt.Sprintf(".%d", time.Now().UnixNano())
+
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	if _, err := s.chunkRefs(); err != nil {
+		return err
+	}
+	// an object that is not a manifest, or an unreadable one, is moved
+	// all the same
+	chunks, _ := manifestChunks(path)
+	for _, c := range chunks {
+		data, err := s.ReadChunk(c.Hash)
+		if err != nil || bytesHash(data) == c.Hash {
+			continue
+		}
+		if err := os.Rename(s.chunkPath(c.Hash), filepath.Join(dir, c.Hash+suffix)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(path, filepath.Join(dir, filepath.Base(path)+suffix)); err != nil {
+		return err
+	}
+	s.pruneEmptyDirs(filepath.Dir(path))
+
+	// the good chunks stay for the object to be written again with, the
+	// next sweep removes them if it is not
+	for _, c := range chunks {
+		if s.refs[c.Hash]--; s.refs[c.Hash] <= 0 {
+			delete(s.refs, c.Hash)
+		}
+	}
+	return nil
+}
+
+// manifestChunks returns the chunks listed in the manifest at path.
+func manifestChunks(path string) ([]ChunkRef, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newManifestReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	defer r.Close()
+
+	var chunks []ChunkRef
+	for {
+		c, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return chunks, nil
+		}
+		if err != nil {
+			return chunks, err
+		}
+		chunks = append(chunks, c)
+	}
+}
+
+// WalkObjects calls fn with the path of every object in the store. The
+// chunks, the quarantine and objects being written are not objects.
+func (s *Store) WalkObjects(fn func(path string) error) error {
+	return s.walkObjects(false, fn)
+}
+
+// walkObjects is WalkObjects, including the temporary files of objects
+// being written if withTemp is set.
+func (s *Store) walkObjects(withTemp bool, fn func(path string) error) error {
+	return filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() && (d.Name() == chunksDir || d.Name() == quarantineDir) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() || (!withTemp && isTemp(path)) {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// chunkReader reads the chunks of an object one after the other. Seeking
+// reads the manifest again from the start, up to the chunk holding the new
+// offset.
+type chunkReader struct {
+	store *Store
+	// file is the manifest, kept open so seeking reads the same one even if
+	// the object is written again meanwhile
+	file     *os.File
+	manifest *ManifestReader
+	cur      *os.File
+	// pos is the offset the next byte of cur is at, off the one the next
+	// Read starts at
+	pos, off int64
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if r.off != r.pos {
+		if err := r.seekChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	for {
+		if r.cur == nil {
+			c, err := r.manifest.Next()
+			if err != nil {
+				return 0, err
+			}
+			f, err := os.Open(r.store.chunkPath(c.Hash))
+			if err != nil {
+				return 0, err
+			}
+			r.cur = f
+		}
+
+		n, err := r.cur.Read(b)
+		r.pos += int64(n)
+		r.off = r.pos
+		if errors.Is(err, io.EOF) {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Seek implements io.Seeker, the chunks are only looked up by the next Read.
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.manifest.Size
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// seekChunk reads the manifest from the start up to the chunk holding off
+// and opens it there.
+func (r *chunkReader) seekChunk() error {
+	if r.cur != nil {
+		r.cur.Close()
+		r.cur = nil
+	}
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	m, err := newManifestReader(io.NopCloser(r.file))
+	if err != nil {
+		return err
+	}
+	r.manifest = m
+
+	var pos int64
+	for {
+		c, err := m.Next()
+		if errors.Is(err, io.EOF) {
+			// past the end, reads return io.EOF
+			r.pos = r.off
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if pos+c.Size <= r.off {
+			pos += c.Size
+			continue
+		}
+
+		f, err := os.Open(r.store.chunkPath(c.Hash))
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(r.off-pos, io.SeekStart); err != nil {
+			f.Close()
+			return err
+		}
+		r.cur = f
+		r.pos = r.off
+		return nil
+	}
+}
+
+func (r *chunkReader) Close() error {
+	err := r.file.Close()
+	if r.cur != nil {
+		r.cur.Close()
+		r.cur = nil
+	}
+	return err
+}
+
+// bytesHash returns the hex SHA-256 of data, the hash PutChunk files it under.
+func bytesHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunksAreDeduplicated(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+
+	data := randomData(4, 1024*1024)
+	_, err := s.Write("first", bytes.NewReader(data))
+	assert.Nil(t, err)
+	_, err = s.Write("second", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	// the second copy only adds a manifest
+	used, err := s.Usage()
+	assert.Nil(t, err)
+	assert.Less(t, used, int64(len(data))+64*1024)
+
+	first, err := s.ReadManifest("first")
+	assert.Nil(t, err)
+	second, err := s.ReadManifest("second")
+	assert.Nil(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, int64(len(data)), first.Size)
+
+	// deleting one copy keeps the chunks the other still refers to
+	assert.Nil(t, s.Delete("first"))
+	_, r, err := s.Read("second")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	assert.Nil(t, s.Delete("second"))
+	for _, c := range second.Chunks {
+		assert.False(t, s.HasChunk(c.Hash))
+	}
+}
+
+func TestWriteManifestChecksChunks(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+
+	hash, err := s.PutChunk([]byte("chunk"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.WriteManifest("ok", &Manifest{Size: 5, Chunks: []ChunkRef{{Hash: hash, Size: 5}}}))
+	assert.NotNil(t, s.WriteManifest("size", &Manifest{Size: 6, Chunks: []ChunkRef{{Hash: hash, Size: 6}}}))
+	assert.NotNil(t, s.WriteManifest("missing", &Manifest{Size: 5, Chunks: []ChunkRef{{Hash: bytesHash([]byte("other")), Size: 5}}}))
+}
+
+func TestVerifyFindsCorruptChunks(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+
+	data := randomData(5, 512*1024)
+	_, err := s.Write("object", bytes.NewReader(data))
+	assert.Nil(t, err)
+	digest, err := s.Digest("object")
+	assert.Nil(t, err)
+	assert.Equal(t, bytesHash(data), digest)
+	assert.Nil(t, s.Verify("object", ""))
+	assert.ErrorIs(t, s.Verify("object", bytesHash([]byte("something else"))), ErrCorrupt)
+
+	// a bit flips in one of the chunks
+	m, err := s.ReadManifest("object")
+	assert.Nil(t, err)
+	bad := m.Chunks[1].Hash
+	chunk, err := s.ReadChunk(bad)
+	assert.Nil(t, err)
+	chunk[0] ^= 1
+	assert.Nil(t, os.WriteFile(s.chunkPath(bad), chunk, 0o644))
+	assert.ErrorIs(t, s.Verify("object", ""), ErrCorrupt)
+
+	// the corrupt chunk goes with the object, writing it again restores it
+	assert.Nil(t, s.Quarantine("object"))
+	assert.False(t, s.Has("object"))
+	assert.False(t, s.HasChunk(bad))
+	assert.True(t, s.HasChunk(m.Chunks[0].Hash))
+	_, err = s.Write("object", bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Nil(t, s.Verify("object", digest))
+}
+
+func TestManifestsWithoutDigestCanBeRead(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+
+	hash, err := s.PutChunk([]byte("chunk"))
+	assert.Nil(t, err)
+	path := s.FullPathForKey("old")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+	old := fmt.Sprintf(`%s{"size":5,"chunks":[{"hash":"%s","size":5}]}`+"\n", manifestMagic, hash)
+	assert.Nil(t, os.WriteFile(path, []byte(old), 0o644))
+
+	m, err := s.ReadManifest("old")
+	assert.Nil(t, err)
+	assert.Equal(t, "", m.Digest)
+	assert.Len(t, m.Chunks, 1)
+	assert.Nil(t, s.Verify("old", ""))
+}
+
+func TestDamagedManifestsAreRejected(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+
+	path := s.FullPathForKey("damaged")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+	for _, hash := range []string{"", "ab", "../../../../etc/passwd"} {
+		damaged := fmt.Sprintf(`%s{"size":5,"chunks":[{"hash":%q,"size":5}]}`+"\n", manifestMagic, hash)
+		assert.Nil(t, os.WriteFile(path, []byte(damaged), 0o644))
+
+		_, r, err := s.Read("damaged")
+		assert.Nil(t, err, hash)
+		_, err = io.ReadAll(r)
+		assert.ErrorContains(t, err, "invalid chunk hash", hash)
+		_, err = r.(io.Seeker).Seek(2, io.SeekStart)
+		assert.Nil(t, err, hash)
+		_, err = r.Read(make([]byte, 1))
+		assert.ErrorContains(t, err, "invalid chunk hash", hash)
+		r.(io.Closer).Close()
+	}
+}
+
+func TestObjectsCanBeSeeked(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+
+	data := randomData(5, 1024*1024)
+	_, err := s.Write("file", bytes.NewReader(data))
+	assert.Nil(t, err)
+	m, err := s.ReadManifest("file")
+	assert.Nil(t, err)
+	assert.Greater(t, len(m.Chunks), 2)
+
+	_, r, err := s.Read("file")
+	assert.Nil(t, err)
+	rs := r.(io.ReadSeekCloser)
+	defer rs.Close()
+
+	end, err := rs.Seek(0, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), end)
+
+	// the first byte of a chunk, one in the middle of it, and backwards
+	second := m.Chunks[0].Size
+	for _, off := range []int64{second, second + 100, 10, int64(len(data)) - 5} {
+		pos, err := rs.Seek(off, io.SeekStart)
+		assert.Nil(t, err)
+		assert.Equal(t, off, pos)
+		got := make([]byte, 64)
+		n, err := io.ReadFull(rs, got)
+		if off+64 > int64(len(data)) {
+			assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, data[off:off+int64(n)], got[:n])
+	}
+
+	pos, err := rs.Seek(-int64(len(data))/2, io.SeekEnd)
+	assert.Nil(t, err)
+	rest, err := io.ReadAll(rs)
+	assert.Nil(t, err)
+	assert.Equal(t, data[pos:], rest)
+
+	_, err = rs.Seek(int64(len(data))+10, io.SeekStart)
+	assert.Nil(t, err)
+	n, err := rs.Read(make([]byte, 1))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestNoChunkOutlivesItsObjects(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	ctx := context.Background()
+
+	kept := randomData(6, 512*1024)
+	_, err := s.Write("kept", bytes.NewReader(kept))
+	assert.Nil(t, err)
+	used, err := s.Usage()
+	assert.Nil(t, err)
+
+	// a write that fails takes the chunks it added with it, except the
+	// ones another object refers to
+	failing := io.MultiReader(bytes.NewReader(kept[:200*1024]), bytes.NewReader(randomData(7, 512*1024)),
+		iotest.ErrReader(errors.New("connection lost")))
+	_, err = s.Write("failed", failing)
+	assert.NotNil(t, err)
+	after, err := s.Usage()
+	assert.Nil(t, err)
+	assert.Equal(t, used, after)
+	assert.Nil(t, s.Verify("kept", bytesHash(kept)))
+
+	// an interrupted write leaves chunks nothing refers to
+	orphan, err := s.PutChunk([]byte("orphan"))
+	assert.Nil(t, err)
+	chunks, size, err := s.SweepChunks(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, chunks)
+	assert.Equal(t, int64(len("orphan")), size)
+	assert.False(t, s.HasChunk(orphan))
+	assert.Nil(t, s.Verify("kept", bytesHash(kept)))
+}
+
+func TestSweepKeepsTheChunksOfWritesInProgress(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 8 {
+			_, err := s.Write(fmt.Sprint(i), bytes.NewReader(randomData(byte(10+i), 256*1024)))
+			assert.Nil(t, err)
+		}
+	}()
+	for sweeping := true; sweeping; {
+		select {
+		case <-done:
+			sweeping = false
+		default:
+			_, _, err := s.SweepChunks(ctx)
+			assert.Nil(t, err)
+		}
+	}
+
+	for i := range 8 {
+		assert.Nil(t, s.Verify(fmt.Sprint(i), bytesHash(randomData(byte(10+i), 256*1024))))
+	}
+}
+
+func TestChunkReferencesAreCounted(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+
+	a, b := randomData(8, 512*1024), randomData(9, 512*1024)
+	_, err := s.Write("a", bytes.NewReader(a))
+	assert.Nil(t, err)
+	_, err = s.Write("copy", bytes.NewReader(a))
+	assert.Nil(t, err)
+	old, err := s.ReadManifest("copy")
+	assert.Nil(t, err)
+
+	// replacing an object drops the chunks only its old content had
+	_, err = s.Write("copy", bytes.NewReader(b))
+	assert.Nil(t, err)
+	_, err = s.Write("b", bytes.NewReader(b))
+	assert.Nil(t, err)
+	for _, c := range old.Chunks {
+		assert.True(t, s.HasChunk(c.Hash))
+	}
+	assert.Nil(t, s.Delete("a"))
+	for _, c := range old.Chunks {
+		assert.False(t, s.HasChunk(c.Hash))
+	}
+
+	// the count is rebuilt from the manifests after a restart
+	s = NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	assert.Nil(t, s.Delete("copy"))
+	assert.Nil(t, s.Verify("b", bytesHash(b)))
+	assert.Nil(t, s.Delete("b"))
+	used, err := s.Usage()
+	assert.Nil(t, err)
+	assert.Zero(t, used)
+}
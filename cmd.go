@@ -3,128 +3,258 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"time"
 
 	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+	"github.com/TinySkillet/DecentralizedP2PStorage/p2p"
 	"github.com/spf13/cobra"
 )
 
 func setupCommands() *cobra.Command {
 	var (
-		listen    string
-		dbPath    string
-		bootstrap []string
+		listen         string
+		dbPath         string
+		passphraseFile string
+		socket         string
+		ephemeral      bool
+		bootstrap      []string
+		allowAnyPeer   bool
 	)
 
 	root := &cobra.Command{Use: "p2p", Short: "Decentralized P2P storage node"}
 	root.PersistentFlags().StringVar(&dbPath, "db", "p2p.db", "sqlite database path")
+	root.PersistentFlags().StringVar(&passphraseFile, "passphrase-file", "", "file holding the passphrase protecting the keys (default $"+passphraseEnv+")")
+	root.PersistentFlags().StringVar(&socket, "socket", "", "control socket of the running node (default <db>.sock)")
+	// the commands talk to the running node through client, set once the
+	// flags are parsed
+	client := &ControlClient{}
+	root.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		client.Socket = controlSocket(dbPath, socket)
+	}
 
+	var (
+		nodeReplicas  int
+		nodePlacement string
+		httpAddr      string
+		s3Addr        string
+		webdavAddr    string
+	)
 	serveCmd := &cobra.Command{
 		Use:   "serve",
-		Short: "Run a node",
+		Short: "Run a node, controlled by the other commands through its control socket",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			strategy, err := ParsePlacement(nodePlacement)
+			if err != nil {
+				return err
+			}
 			d, err := dbpkg.Open(dbPath)
 			if err != nil {
 				return err
 			}
 			defer d.Close()
-			if err := d.Migrate(context.Background()); err != nil {
+			s, err := newNode(d, passphraseFile, listen, bootstrap, allowAnyPeer)
+			if err != nil {
 				return err
 			}
-			keyBytes, err := loadOrInitKey(d)
+			s.ReplicationFactor = nodeReplicas
+			s.Placement = strategy
+
+			l, err := ListenControl(controlSocket(dbPath, socket))
 			if err != nil {
 				return err
 			}
-			s := makeServerWithDB(listen, d, bootstrap...)
-			s.EncryptionKey = keyBytes
+			defer l.Close()
+			go func() {
+				if err := s.ServeControl(l); err != nil {
+					log.Printf("Control socket: %v\n", err)
+				}
+			}()
+
+			if httpAddr != "" {
+				stop, err := serveHTTP(httpAddr, s.HTTPHandler())
+				if err != nil {
+					return err
+				}
+				defer stop()
+			}
+			if s3Addr != "" {
+				stop, err := serveHTTP(s3Addr, s.S3Handler())
+				if err != nil {
+					return err
+				}
+				defer stop()
+			}
+			if webdavAddr != "" {
+				stop, err := serveHTTP(webdavAddr, s.WebDAVHandler())
+				if err != nil {
+					return err
+				}
+				defer stop()
+			}
 			return s.Start()
 		},
 	}
 	serveCmd.Flags().StringVar(&listen, "listen", ":3000", "listen address")
 	serveCmd.Flags().StringSliceVar(&bootstrap, "bootstrap", nil, "bootstrap nodes")
+	serveCmd.Flags().BoolVar(&allowAnyPeer, "allow-any-peer", false, "let every node connect, not only the ones added with 'peers trust'")
+	serveCmd.Flags().IntVar(&nodeReplicas, "replicas", DefaultReplicationFactor, "number of peers to replicate files to")
+	serveCmd.Flags().StringVar(&nodePlacement, "placement", "closest", "replica placement: closest, random, least-used or consistent-hash")
+	serveCmd.Flags().StringVar(&httpAddr, "http", "", "address to serve the HTTP gateway on (default: none)")
+	serveCmd.Flags().StringVar(&s3Addr, "s3", "", "address to serve the S3-compatible endpoint on (default: none)")
+	serveCmd.Flags().StringVar(&webdavAddr, "webdav", "", "address to serve the WebDAV gateway on (default: none)")
 	root.AddCommand(serveCmd)
 
+	// ephemeralFlags are the flags of the commands that can run a node of
+	// their own instead of using the running one.
+	ephemeralFlags := func(cmd *cobra.Command) {
+		cmd.Flags().BoolVar(&ephemeral, "ephemeral", false, "run a node for this command instead of using the one running on the control socket")
+		cmd.Flags().StringVar(&listen, "listen", ":3000", "listen address of the --ephemeral node")
+		cmd.Flags().StringSliceVar(&bootstrap, "bootstrap", nil, "bootstrap nodes of the --ephemeral node")
+		cmd.Flags().BoolVar(&allowAnyPeer, "allow-any-peer", false, "let every node connect to the --ephemeral node, not only the trusted ones")
+	}
+
+	var (
+		replicas  int
+		placement string
+		parallel  int
+	)
 	storeCmd := &cobra.Command{
-		Use:   "store <key> <file>",
-		Short: "Store a file locally and broadcast to peers",
-		Args:  cobra.ExactArgs(2),
+		Use:   "store <key> <file-or-directory>",
+		Short: "Store a file, or a directory tree, locally and replicate it to peers",
+		Long: "Store a file, or a directory tree, locally and replicate it to peers.\n\n" +
+			"The files of a directory are stored under <key>/<relative path>, with an index of the\n" +
+			"tree recording their modes and modification times, which get --recursive restores.",
+		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			key, path := args[0], args[1]
-			f, err := os.Open(path)
+			strategy, err := ParsePlacement(placement)
 			if err != nil {
 				return err
 			}
-			defer f.Close()
-
-			d, err := dbpkg.Open(dbPath)
+			fi, err := os.Stat(path)
 			if err != nil {
 				return err
 			}
-			defer d.Close()
-			if err := d.Migrate(context.Background()); err != nil {
-				return err
+
+			var store func(key string, r io.Reader, size int64) ([]ReplicaResult, error)
+			if ephemeral {
+				s, closeDB, err := startNode(dbPath, passphraseFile, listen, bootstrap, allowAnyPeer, "Proceeding with store anyway.")
+				if err != nil {
+					return err
+				}
+				defer closeDB()
+				n := replicas
+				if n == 0 {
+					n = s.ReplicationFactor
+				}
+				store = func(key string, r io.Reader, size int64) ([]ReplicaResult, error) {
+					return s.storeWith(key, r, n, strategy)
+				}
+			} else {
+				store = func(key string, r io.Reader, size int64) ([]ReplicaResult, error) {
+					return client.Store(key, r, size, replicas, placement)
+				}
+			}
+
+			if fi.IsDir() {
+				report, err := StoreTree(path, key, parallel, func(key string, r io.Reader, size int64) error {
+					results, err := store(key, r, size)
+					for _, res := range results {
+						if res.Err != nil {
+							fmt.Printf("%s: replica on %s: failed: %v\n", key, res.Peer, res.Err)
+						}
+					}
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				return printTreeReport("stored", report)
 			}
 
-			keyBytes, err := loadOrInitKey(d)
+			f, err := os.Open(path)
 			if err != nil {
 				return err
 			}
-			s := makeServerWithDB(listen, d, bootstrap...)
-			s.EncryptionKey = keyBytes
-			go func() { log.Fatal(s.Start()) }()
-			// Wait for connections to establish
-			time.Sleep(500 * time.Millisecond)
-			if len(bootstrap) > 0 {
-				if err := s.waitForPeers(5 * time.Second); err != nil {
-					fmt.Printf("Warning: %v. Proceeding with store anyway.\n", err)
+			defer f.Close()
+			results, err := store(key, f, fi.Size())
+			if err != nil {
+				return err
+			}
+			for _, res := range results {
+				if res.Err != nil {
+					fmt.Printf("replica on %s: failed: %v\n", res.Peer, res.Err)
+				} else {
+					fmt.Printf("replica on %s: ok\n", res.Peer)
 				}
 			}
-			return s.Store(key, f)
+			return nil
 		},
 	}
-	storeCmd.Flags().StringVar(&listen, "listen", ":3000", "listen address")
-	storeCmd.Flags().StringSliceVar(&bootstrap, "bootstrap", nil, "bootstrap nodes")
+	ephemeralFlags(storeCmd)
+	storeCmd.Flags().IntVar(&replicas, "replicas", 0, "number of peers to replicate the file to (default: the node's)")
+	storeCmd.Flags().StringVar(&placement, "placement", "", "replica placement: closest, random, least-used or consistent-hash (default: the node's)")
+	storeCmd.Flags().IntVar(&parallel, "parallel", 4, "number of files of a directory to store at a time")
 	root.AddCommand(storeCmd)
 
+	var recursive bool
 	getCmd := &cobra.Command{
 		Use:   "get <key>",
-		Short: "Fetch a file (local or from peers)",
+		Short: "Fetch a file (local or from peers), or with --recursive a stored directory tree",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			key := args[0]
 			out, _ := cmd.Flags().GetString("out")
 
-			d, err := dbpkg.Open(dbPath)
-			if err != nil {
-				return err
-			}
-			defer d.Close()
-			if err := d.Migrate(context.Background()); err != nil {
-				return err
+			var get func(key string) (io.ReadCloser, error)
+			if ephemeral {
+				s, closeDB, err := startNode(dbPath, passphraseFile, listen, bootstrap, allowAnyPeer, "Proceeding with get anyway.")
+				if err != nil {
+					return err
+				}
+				defer closeDB()
+				get = func(key string) (io.ReadCloser, error) {
+					ctx, cancel := context.WithTimeout(cmd.Context(), 30*time.Second)
+					defer cancel()
+					_, r, err := s.Get(ctx, key)
+					if err != nil {
+						return nil, err
+					}
+					if rc, ok := r.(io.ReadCloser); ok {
+						return rc, nil
+					}
+					return io.NopCloser(r), nil
+				}
+			} else {
+				get = func(key string) (io.ReadCloser, error) {
+					_, rc, err := client.Get(key)
+					return rc, err
+				}
 			}
 
-			keyBytes, err := loadOrInitKey(d)
-			if err != nil {
-				return err
-			}
-			s := makeServerWithDB(listen, d, bootstrap...)
-			s.EncryptionKey = keyBytes
-			go func() { log.Fatal(s.Start()) }()
-			// Wait for connections to establish
-			time.Sleep(500 * time.Millisecond)
-			if len(bootstrap) > 0 {
-				if err := s.waitForPeers(5 * time.Second); err != nil {
-					fmt.Printf("Warning: %v. Proceeding with get anyway.\n", err)
+			if recursive {
+				if out == "" {
+					out = path.Base(key)
+				}
+				report, err := GetTree(key, out, parallel, get)
+				if err != nil {
+					return err
 				}
+				return printTreeReport("restored", report)
 			}
-			_, r, err := s.Get(key)
+
+			r, err := get(key)
 			if err != nil {
 				return err
 			}
+			defer r.Close()
 			var w io.Writer = os.Stdout
 			if out != "" {
 				of, err := os.Create(out)
@@ -138,9 +268,10 @@ func setupCommands() *cobra.Command {
 			return err
 		},
 	}
-	getCmd.Flags().StringVar(&listen, "listen", ":3000", "listen address")
-	getCmd.Flags().StringSliceVar(&bootstrap, "bootstrap", nil, "bootstrap nodes")
-	getCmd.Flags().String("out", "", "output file path")
+	ephemeralFlags(getCmd)
+	getCmd.Flags().String("out", "", "output file path, or directory with --recursive (default: stdout, or the last element of the key)")
+	getCmd.Flags().BoolVarP(&recursive, "recursive", "r", false, "fetch the directory tree stored under key")
+	getCmd.Flags().IntVar(&parallel, "parallel", 4, "number of files of a directory to fetch at a time")
 	root.AddCommand(getCmd)
 
 	deleteCmd := &cobra.Command{
@@ -149,36 +280,53 @@ func setupCommands() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			key := args[0]
+			if !ephemeral {
+				return client.Delete(key)
+			}
 
-			d, err := dbpkg.Open(dbPath)
+			s, closeDB, err := startNode(dbPath, passphraseFile, listen, bootstrap, allowAnyPeer, "Proceeding with delete anyway.")
 			if err != nil {
 				return err
 			}
-			defer d.Close()
-			if err := d.Migrate(context.Background()); err != nil {
-				return err
-			}
+			defer closeDB()
+			return s.Delete(key)
+		},
+	}
+	ephemeralFlags(deleteCmd)
+	root.AddCommand(deleteCmd)
 
-			keyBytes, err := loadOrInitKey(d)
+	shareCmd := &cobra.Command{
+		Use:   "share <key> <recipient-pubkey>",
+		Short: "Give another node access to a stored file",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key := args[0]
+			recipient, err := ParsePublicKey(args[1])
 			if err != nil {
 				return err
 			}
-			s := makeServerWithDB(listen, d, bootstrap...)
-			s.EncryptionKey = keyBytes
-			go func() { log.Fatal(s.Start()) }()
-			// Wait for connections to establish
-			time.Sleep(500 * time.Millisecond)
-			if len(bootstrap) > 0 {
-				if err := s.waitForPeers(5 * time.Second); err != nil {
-					fmt.Printf("Warning: %v. Proceeding with delete anyway.\n", err)
+
+			if ephemeral {
+				s, closeDB, err := startNode(dbPath, passphraseFile, listen, bootstrap, allowAnyPeer, "Proceeding with share anyway.")
+				if err != nil {
+					return err
 				}
+				defer closeDB()
+				ctx, cancel := context.WithTimeout(cmd.Context(), 30*time.Second)
+				defer cancel()
+				err = s.Share(ctx, key, recipient)
+			} else {
+				err = client.Share(key, recipient)
 			}
-			return s.Delete(key)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("shared '%s' with %s\n", key, p2p.NodeID(recipient))
+			return nil
 		},
 	}
-	deleteCmd.Flags().StringVar(&listen, "listen", ":3000", "listen address")
-	deleteCmd.Flags().StringSliceVar(&bootstrap, "bootstrap", nil, "bootstrap nodes")
-	root.AddCommand(deleteCmd)
+	ephemeralFlags(shareCmd)
+	root.AddCommand(shareCmd)
 
 	filesCmd := &cobra.Command{Use: "files", Short: "File operations"}
 	filesListCmd := &cobra.Command{
@@ -206,6 +354,320 @@ func setupCommands() *cobra.Command {
 	filesCmd.AddCommand(filesListCmd)
 	root.AddCommand(filesCmd)
 
+	var scrubRate int64
+	scrubCmd := &cobra.Command{
+		Use:   "scrub",
+		Short: "Verify every object in the local store and repair corrupt ones from peers",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var report *ScrubReport
+			if ephemeral {
+				s, closeDB, err := startNode(dbPath, passphraseFile, listen, bootstrap, allowAnyPeer, "Corrupt files cannot be fetched again.")
+				if err != nil {
+					return err
+				}
+				defer closeDB()
+				if report, err = s.Scrub(cmd.Context(), scrubRate); err != nil {
+					return err
+				}
+			} else {
+				var err error
+				if report, err = client.Scrub(scrubRate); err != nil {
+					return err
+				}
+			}
+			for _, p := range report.Problems {
+				fmt.Println(p)
+			}
+			fmt.Printf("%d objects, %d bytes checked, %d problem(s)\n", report.Objects, report.Bytes, len(report.Problems))
+			if report.OrphanChunks > 0 {
+				fmt.Printf("%d orphan chunks (%d bytes) removed\n", report.OrphanChunks, report.OrphanBytes)
+			}
+			return nil
+		},
+	}
+	ephemeralFlags(scrubCmd)
+	scrubCmd.Flags().Int64Var(&scrubRate, "rate", 0, "bytes per second to read at most (0: no limit)")
+	root.AddCommand(scrubCmd)
+
+	keysCmd := &cobra.Command{Use: "keys", Short: "Encryption key operations"}
+	keysRotateCmd := &cobra.Command{
+		Use:   "rotate",
+		Short: "Create a new master key and make it the active one",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d, err := dbpkg.Open(dbPath)
+			if err != nil {
+				return err
+			}
+			defer d.Close()
+			if err := d.Migrate(context.Background()); err != nil {
+				return err
+			}
+			if err := unlockKeys(d, passphraseFile); err != nil {
+				return err
+			}
+			old, err := loadOrInitKey(d)
+			if err != nil {
+				return err
+			}
+			k, err := d.RotateKey(context.Background(), old.Algo, newEcryptionKey())
+			if err != nil {
+				return err
+			}
+			fmt.Printf("active master key is now %s (version %d), replacing %s\n", k.ID, k.Version, old.ID)
+			fmt.Println("data keys are rewrapped in the background while a node runs; the old key is deleted once nothing uses it")
+			return nil
+		},
+	}
+	keysListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the versions of the master key",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d, err := dbpkg.Open(dbPath)
+			if err != nil {
+				return err
+			}
+			defer d.Close()
+			if err := d.Migrate(context.Background()); err != nil {
+				return err
+			}
+			if err := unlockKeys(d, passphraseFile); err != nil {
+				return err
+			}
+			kk, err := d.ListMasterKeys(context.Background())
+			if err != nil {
+				return err
+			}
+			for _, k := range kk {
+				status := "retired"
+				if k.Active {
+					status = "active"
+				}
+				fmt.Printf("%s\t%d\t%s\t%s\n", k.ID, k.Version, k.Algo, status)
+			}
+			return nil
+		},
+	}
+	keysPubkeyCmd := &cobra.Command{
+		Use:   "pubkey",
+		Short: "Print the public key other nodes share files with",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d, err := dbpkg.Open(dbPath)
+			if err != nil {
+				return err
+			}
+			defer d.Close()
+			if err := d.Migrate(context.Background()); err != nil {
+				return err
+			}
+			if err := unlockKeys(d, passphraseFile); err != nil {
+				return err
+			}
+			identity, err := loadOrInitIdentity(d)
+			if err != nil {
+				return err
+			}
+			pub := identity.Public().(ed25519.PublicKey)
+			fmt.Printf("%s\t%s\n", hex.EncodeToString(pub), p2p.NodeID(pub))
+			return nil
+		},
+	}
+
+	var (
+		namespaceSecret   string
+		generateNamespace bool
+	)
+	keysNamespaceCmd := &cobra.Command{
+		Use:   "namespace",
+		Short: "Show or set the secret file identifiers are derived with",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if namespaceSecret != "" && generateNamespace {
+				return fmt.Errorf("--set and --generate cannot be used together")
+			}
+			d, err := dbpkg.Open(dbPath)
+			if err != nil {
+				return err
+			}
+			defer d.Close()
+			if err := d.Migrate(context.Background()); err != nil {
+				return err
+			}
+			if err := unlockKeys(d, passphraseFile); err != nil {
+				return err
+			}
+
+			var secret []byte
+			switch {
+			case generateNamespace:
+				secret = newEcryptionKey()
+			case namespaceSecret != "":
+				if secret, err = hex.DecodeString(namespaceSecret); err != nil || len(secret) < 16 {
+					return fmt.Errorf("invalid namespace secret, expected at least 16 hex encoded bytes")
+				}
+			default:
+				secret, err := d.GetNamespaceKey(context.Background())
+				if err != nil {
+					return err
+				}
+				if secret == nil {
+					fmt.Println("no namespace, file identifiers are the SHA-256 of their key")
+					return nil
+				}
+				fmt.Println(hex.EncodeToString(secret))
+				return nil
+			}
+
+			if err := d.SetNamespaceKey(context.Background(), secret); err != nil {
+				return err
+			}
+			fmt.Println(hex.EncodeToString(secret))
+			fmt.Println("stored files are renamed on their holders the next time the node runs; share the secret with the nodes you share files with")
+			return nil
+		},
+	}
+	keysNamespaceCmd.Flags().StringVar(&namespaceSecret, "set", "", "hex encoded secret to use")
+	keysNamespaceCmd.Flags().BoolVar(&generateNamespace, "generate", false, "generate a new random secret")
+
+	var newPassphraseFile string
+	keysChangePassphraseCmd := &cobra.Command{
+		Use:   "change-passphrase",
+		Short: "Protect the keys with a new passphrase",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d, err := dbpkg.Open(dbPath)
+			if err != nil {
+				return err
+			}
+			defer d.Close()
+			if err := d.Migrate(context.Background()); err != nil {
+				return err
+			}
+			if err := unlockKeys(d, passphraseFile); err != nil {
+				return err
+			}
+
+			var passphrase string
+			if newPassphraseFile != "" {
+				if passphrase, _, err = givenPassphrase(newPassphraseFile); err != nil {
+					return err
+				}
+			} else {
+				if passphrase, err = promptPassphrase("New passphrase: "); err != nil {
+					return err
+				}
+				again, err := promptPassphrase("Repeat new passphrase: ")
+				if err != nil {
+					return err
+				}
+				if again != passphrase {
+					return fmt.Errorf("the passphrases do not match")
+				}
+			}
+			if err := d.SetPassphrase(context.Background(), passphrase, dbpkg.DefaultPassphraseIterations); err != nil {
+				return err
+			}
+			fmt.Println("keys are now protected by the new passphrase")
+			return nil
+		},
+	}
+	keysChangePassphraseCmd.Flags().StringVar(&newPassphraseFile, "new-passphrase-file", "", "file holding the new passphrase (default: prompt)")
+
+	keysCmd.AddCommand(keysRotateCmd)
+	keysCmd.AddCommand(keysListCmd)
+	keysCmd.AddCommand(keysChangePassphraseCmd)
+	keysCmd.AddCommand(keysPubkeyCmd)
+	keysCmd.AddCommand(keysNamespaceCmd)
+	root.AddCommand(keysCmd)
+
+	peersCmd := &cobra.Command{
+		Use:   "peers",
+		Short: "Manage the nodes allowed to connect",
+		Long: "Manage the nodes allowed to connect.\n\n" +
+			"A node only lets in the nodes whose public key (see 'keys pubkey') it trusts,\n" +
+			"unless it runs with --allow-any-peer. Changes apply to the running node's next\n" +
+			"connections.",
+	}
+	peersTrustCmd := &cobra.Command{
+		Use:   "trust <pubkey>",
+		Short: "Allow a node to connect",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pub, err := ParsePublicKey(args[0])
+			if err != nil {
+				return err
+			}
+			d, err := dbpkg.Open(dbPath)
+			if err != nil {
+				return err
+			}
+			defer d.Close()
+			if err := d.Migrate(context.Background()); err != nil {
+				return err
+			}
+			if err := d.TrustPeer(context.Background(), hex.EncodeToString(pub)); err != nil {
+				return err
+			}
+			fmt.Printf("trusted %s\n", p2p.NodeID(pub))
+			return nil
+		},
+	}
+	peersUntrustCmd := &cobra.Command{
+		Use:   "untrust <pubkey>",
+		Short: "Stop allowing a node to connect",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pub, err := ParsePublicKey(args[0])
+			if err != nil {
+				return err
+			}
+			d, err := dbpkg.Open(dbPath)
+			if err != nil {
+				return err
+			}
+			defer d.Close()
+			if err := d.Migrate(context.Background()); err != nil {
+				return err
+			}
+			ok, err := d.UntrustPeer(context.Background(), hex.EncodeToString(pub))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("%s is not trusted", p2p.NodeID(pub))
+			}
+			fmt.Printf("untrusted %s\n", p2p.NodeID(pub))
+			return nil
+		},
+	}
+	peersListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the nodes allowed to connect",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d, err := dbpkg.Open(dbPath)
+			if err != nil {
+				return err
+			}
+			defer d.Close()
+			if err := d.Migrate(context.Background()); err != nil {
+				return err
+			}
+			pp, err := d.ListTrustedPeers(context.Background())
+			if err != nil {
+				return err
+			}
+			for _, p := range pp {
+				pub, err := ParsePublicKey(p.PublicKey)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s\t%s\n", p.PublicKey, p2p.NodeID(pub))
+			}
+			return nil
+		},
+	}
+	peersCmd.AddCommand(peersTrustCmd)
+	peersCmd.AddCommand(peersUntrustCmd)
+	peersCmd.AddCommand(peersListCmd)
+	root.AddCommand(peersCmd)
+
 	// demo: preserves old behavior behind a command
 	demoCmd := &cobra.Command{
 		Use:   "demo",
@@ -224,9 +686,11 @@ func setupCommands() *cobra.Command {
 
 			key := "coolpicture.jpg"
 			data := bytes.NewReader([]byte("my big data file here!"))
-			_ = s3.Store(key, data)
+			_, _ = s3.Store(key, data)
 			_ = s3.store.Delete(key)
-			_, r, err := s3.Get(key)
+			ctx, cancel := context.WithTimeout(cmd.Context(), 10*time.Second)
+			defer cancel()
+			_, r, err := s3.Get(ctx, key)
 			if err != nil {
 				return err
 			}
@@ -1,54 +1,249 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
 
 	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
 	"github.com/TinySkillet/DecentralizedP2PStorage/p2p"
 )
 
 func makeServer(listenAddr string, nodes ...string) *FileServer {
+	identity := newIdentity()
 	tcpTransportOpts := p2p.TCPTransportOpts{
 		ListenAddr:    listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
+		NodeID:        p2p.NodeID(identity.Public().(ed25519.PublicKey)),
+		HandshakeFunc: p2p.NewSecureHandshakeFunc(identity),
 		Decoder:       p2p.DefaultDecoder{},
 	}
 	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
 
 	fileServerOpts := FileServerOpts{
-		EncryptionKey:     newEcryptionKey(),
-		PathTransformFunc: CASPathTransformFunc,
-		StorageRoot:       listenAddr + "_network",
-		Transport:         tcpTransport,
-		BootstrapNodes:    nodes,
+		Identity:                identity,
+		EncryptionKey:           newEcryptionKey(),
+		PathTransformFunc:       CASPathTransformFunc,
+		LegacyPathTransformFunc: LegacyCASPathTransformFunc,
+		StorageRoot:             listenAddr + "_network",
+		Transport:               tcpTransport,
+		BootstrapNodes:          nodes,
 	}
 	s := NewFileServer(fileServerOpts)
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
 
 	return s
 }
 
-func makeServerWithDB(listenAddr string, db *dbpkg.DB, nodes ...string) *FileServer {
+func makeServerWithDB(listenAddr string, db *dbpkg.DB, nodes ...string) (*FileServer, error) {
+	identity, err := loadOrInitIdentity(db)
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := db.GetNamespaceKey(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
 	tcpTransportOpts := p2p.TCPTransportOpts{
 		ListenAddr:    listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
+		NodeID:        p2p.NodeID(identity.Public().(ed25519.PublicKey)),
+		HandshakeFunc: p2p.NewSecureHandshakeFunc(identity),
 		Decoder:       p2p.DefaultDecoder{},
 	}
 	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
 
 	fileServerOpts := FileServerOpts{
-		EncryptionKey:     newEcryptionKey(),
-		PathTransformFunc: CASPathTransformFunc,
-		StorageRoot:       listenAddr + "_network",
-		Transport:         tcpTransport,
-		BootstrapNodes:    nodes,
-		DB:                db,
+		Identity:                identity,
+		EncryptionKey:           newEcryptionKey(),
+		NamespaceKey:            namespace,
+		PathTransformFunc:       CASPathTransformFunc,
+		LegacyPathTransformFunc: LegacyCASPathTransformFunc,
+		StorageRoot:             listenAddr + "_network",
+		Transport:               tcpTransport,
+		BootstrapNodes:          nodes,
+		DB:                      db,
 	}
 	s := NewFileServer(fileServerOpts)
+	tcpTransport.AuthorizePeer = s.AuthorizePeer
 	tcpTransport.OnPeer = s.OnPeer
-	return s
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
+	return s, nil
+}
+
+// startNode runs a node for the duration of one command, for commands asked
+// not to use the node running on the control socket. It returns the node
+// once it had the time to join the network, and a func closing its
+// database. warning is printed if no peer could be reached. Only the peers
+// trusted in the database are let in, unless allowAnyPeer is set.
+func startNode(dbPath, passphraseFile, listen string, bootstrap []string, allowAnyPeer bool, warning string) (*FileServer, func(), error) {
+	d, err := dbpkg.Open(dbPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := newNode(d, passphraseFile, listen, bootstrap, allowAnyPeer)
+	if err != nil {
+		d.Close()
+		return nil, nil, err
+	}
+
+	go func() { log.Fatal(s.Start()) }()
+	// Wait for connections to establish
+	time.Sleep(500 * time.Millisecond)
+	if len(bootstrap) > 0 {
+		if err := s.waitForPeers(5 * time.Second); err != nil {
+			fmt.Printf("Warning: %v. %s\n", err, warning)
+		}
+	}
+	return s, func() { d.Close() }, nil
+}
+
+// newNode migrates and unlocks the database and makes a node using its
+// keys, letting in the peers it trusts or any peer with allowAnyPeer.
+func newNode(d *dbpkg.DB, passphraseFile, listen string, bootstrap []string, allowAnyPeer bool) (*FileServer, error) {
+	if err := d.Migrate(context.Background()); err != nil {
+		return nil, err
+	}
+	if err := unlockKeys(d, passphraseFile); err != nil {
+		return nil, err
+	}
+	encKey, err := loadOrInitKey(d)
+	if err != nil {
+		return nil, err
+	}
+	s, err := makeServerWithDB(listen, d, bootstrap...)
+	if err != nil {
+		return nil, err
+	}
+	s.EncryptionKeyID, s.EncryptionKey, s.EncryptionAlgo = encKey.ID, encKey.KeyBytes, encKey.Algo
+	s.AllowAnyPeer = allowAnyPeer
+	return s, nil
+}
+
+// serveHTTP serves h on addr in the background and returns a func
+// stopping it.
+func serveHTTP(addr string, h http.Handler) (func(), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: h}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTP server on %s: %v\n", l.Addr(), err)
+		}
+	}()
+	log.Printf("Listening on HTTP at %s\n", l.Addr())
+	return func() { srv.Close() }, nil
+}
+
+// controlSocket returns the path of the control socket of the node using
+// the database at dbPath, unless one is given.
+func controlSocket(dbPath, socket string) string {
+	if socket != "" {
+		return socket
+	}
+	return dbPath + ".sock"
+}
+
+// loadOrInitKey returns the active master key, creating it on first use.
+func loadOrInitKey(d *dbpkg.DB) (*dbpkg.Key, error) {
+	k, err := d.GetOrCreateActiveKey(context.Background(), newEcryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAlgorithm(k.Algo); err != nil {
+		return nil, fmt.Errorf("key '%s': %w", k.ID, err)
+	}
+	return k, nil
+}
+
+func loadOrInitIdentity(d *dbpkg.DB) (ed25519.PrivateKey, error) {
+	seed, err := d.GetOrCreateIdentityKey(context.Background(), func() []byte {
+		return newIdentity().Seed()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// passphraseEnv is the environment variable the key passphrase is read from.
+const passphraseEnv = "P2P_PASSPHRASE"
+
+// unlockKeys unlocks the keys of a database protected by a passphrase. The
+// passphrase is read from P2P_PASSPHRASE or passphraseFile, or prompted for.
+// A database that is not protected is left as it is, only `keys
+// change-passphrase` protects it.
+func unlockKeys(d *dbpkg.DB, passphraseFile string) error {
+	ctx := context.Background()
+	protected, err := d.Protected(ctx)
+	if err != nil || !protected {
+		return err
+	}
+	passphrase, given, err := givenPassphrase(passphraseFile)
+	if err != nil {
+		return err
+	}
+	if !given {
+		if passphrase, err = promptPassphrase("Passphrase: "); err != nil {
+			return err
+		}
+	}
+	return d.Unlock(ctx, passphrase)
+}
+
+// givenPassphrase returns the passphrase set in the environment or in
+// passphraseFile, the file taking precedence.
+func givenPassphrase(passphraseFile string) (string, bool, error) {
+	if passphraseFile != "" {
+		b, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return "", false, err
+		}
+		return strings.TrimRight(string(b), "\r\n"), true, nil
+	}
+	if p, ok := os.LookupEnv(passphraseEnv); ok {
+		return p, true, nil
+	}
+	return "", false, nil
+}
+
+// promptPassphrase reads a passphrase from stdin, without echoing it when
+// stdin is a terminal.
+func promptPassphrase(prompt string) (string, error) {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode()&os.ModeCharDevice != 0 {
+		if stty("-echo") == nil {
+			defer func() {
+				stty("echo")
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("no passphrase: set " + passphraseEnv + " or --passphrase-file")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
 }
 
-func loadOrInitKey(d *dbpkg.DB) ([]byte, error) {
-	return d.GetOrCreateDefaultKey(context.Background(), newEcryptionKey)
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
 }
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// A running node is controlled through a Unix domain socket. Every
+// connection carries one request: a gob encoded ControlMessage, followed by
+// the contents of the file for a store. The node answers with a
+// ControlMessage, followed by the contents of the file for a get. The
+// socket is only accessible to the user running the node, who can use its
+// keys anyway.
+
+// controlTimeout bounds the requests that wait on the network, like
+// commands running their own node did.
+const controlTimeout = 30 * time.Second
+
+// ListenControl listens on the control socket at path. A socket left behind
+// by a node that did not shut down cleanly is replaced, one a node still
+// answers on is not.
+func ListenControl(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a node is already running on %s", path)
+	}
+	fi, err := os.Lstat(path)
+	switch {
+	case err == nil && fi.Mode()&fs.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	case err == nil:
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	return listenUnix(path)
+}
+
+// ServeControl answers the requests on the control socket until the
+// listener is closed or the node stops.
+func (s *FileServer) ServeControl(l net.Listener) error {
+	go func() {
+		<-s.quitch
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.handleControl(conn); err != nil {
+				log.Printf("[%s] Control request: %v\n", s.Transport.Address(), err)
+			}
+		}()
+	}
+}
+
+func (s *FileServer) handleControl(conn net.Conn) error {
+	// gob reads no further than the request from a buffered reader, the
+	// contents of a stored file follow it
+	r := bufio.NewReader(conn)
+	var req ControlMessage
+	if err := gob.NewDecoder(r).Decode(&req); err != nil {
+		return err
+	}
+
+	switch v := req.Payload.(type) {
+	case ControlStore:
+		return s.controlStore(conn, r, v)
+	case ControlGet:
+		return s.controlGet(conn, r, v)
+	case ControlDelete:
+		err := s.Delete(v.Key)
+		return replyControl(conn, ControlResponse{Error: errorString(err)})
+	case ControlShare:
+		if len(v.Recipient) != ed25519.PublicKeySize {
+			return replyControl(conn, ControlResponse{Error: "invalid public key"})
+		}
+		ctx, cancel := s.controlContext(r, controlTimeout)
+		defer cancel()
+		err := s.Share(ctx, v.Key, ed25519.PublicKey(v.Recipient))
+		return replyControl(conn, ControlResponse{Error: errorString(err)})
+	case ControlScrub:
+		return s.controlScrub(conn, r, v)
+	}
+	return replyControl(conn, ControlResponse{Error: fmt.Sprintf("unknown request %T", req.Payload)})
+}
+
+// controlContext returns a context cancelled when the client hangs up, the
+// node stops or the timeout, if any, expires. It must only be used once
+// the client has sent everything.
+func (s *FileServer) controlContext(r io.Reader, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		stop := cancel
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		cancel = func() {
+			cancelTimeout()
+			stop()
+		}
+	}
+	go func() {
+		// the client sends nothing more, a read only returns once it is gone
+		r.Read(make([]byte, 1))
+		cancel()
+	}()
+	go func() {
+		select {
+		case <-s.quitch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (s *FileServer) controlStore(conn net.Conn, r io.Reader, msg ControlStore) error {
+	n, placement := s.ReplicationFactor, s.Placement
+	if msg.Replicas > 0 {
+		n = msg.Replicas
+	}
+	if msg.Placement != "" {
+		var err error
+		if placement, err = ParsePlacement(msg.Placement); err != nil {
+			return replyControl(conn, ControlStoreResponse{Error: err.Error()})
+		}
+	}
+
+	resp := ControlStoreResponse{}
+	results, err := s.storeWith(msg.Key, &exactReader{r: r, n: msg.Size}, n, placement)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	for _, res := range results {
+		resp.Replicas = append(resp.Replicas, ControlReplica{Peer: res.Peer, Error: errorString(res.Err)})
+	}
+	return replyControl(conn, resp)
+}
+
+func (s *FileServer) controlGet(conn net.Conn, r io.Reader, msg ControlGet) error {
+	ctx, cancel := s.controlContext(r, controlTimeout)
+	defer cancel()
+	size, fr, err := s.Get(ctx, msg.Key)
+	if err != nil {
+		return replyControl(conn, ControlGetResponse{Error: err.Error()})
+	}
+	if c, ok := fr.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	if err := replyControl(conn, ControlGetResponse{Size: size}); err != nil {
+		return err
+	}
+	// a short copy tells the client the file was cut short
+	_, err = io.CopyN(conn, fr, size)
+	return err
+}
+
+func (s *FileServer) controlScrub(conn net.Conn, r io.Reader, msg ControlScrub) error {
+	ctx, cancel := s.controlContext(r, 0)
+	defer cancel()
+	report, err := s.Scrub(ctx, msg.Rate)
+	if err != nil {
+		return replyControl(conn, ControlScrubResponse{Error: err.Error()})
+	}
+
+	resp := ControlScrubResponse{
+		Objects:      report.Objects,
+		Bytes:        report.Bytes,
+		OrphanChunks: report.OrphanChunks,
+		OrphanBytes:  report.OrphanBytes,
+	}
+	for _, p := range report.Problems {
+		resp.Problems = append(resp.Problems, ControlScrubProblem{
+			Key:     p.Key,
+			Missing: p.Missing,
+			Error:   errorString(p.Err),
+			Repair:  p.Repair,
+		})
+	}
+	return replyControl(conn, resp)
+}
+
+func replyControl(w io.Writer, payload any) error {
+	return gob.NewEncoder(w).Encode(&ControlMessage{Payload: payload})
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// errCutShort is returned by an exactReader ending early. Unlike
+// io.ErrUnexpectedEOF it does not end a chunk read with io.ReadFull like
+// the end of the file does.
+var errCutShort = errors.New("file cut short")
+
+// exactReader reads n bytes from r, ending early is an error.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (e *exactReader) Read(b []byte) (int, error) {
+	if e.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > e.n {
+		b = b[:e.n]
+	}
+	n, err := e.r.Read(b)
+	e.n -= int64(n)
+	if errors.Is(err, io.EOF) && e.n > 0 {
+		err = errCutShort
+	}
+	return n, err
+}
+
+// ControlClient sends requests to the node running on a control socket.
+type ControlClient struct {
+	Socket string
+}
+
+// call sends a request, followed by body if there is one, and decodes the
+// reply. The connection is returned for the caller to read what follows
+// the reply and close.
+func (c *ControlClient) call(req any, body io.Reader, size int64) (any, io.Reader, net.Conn, error) {
+	conn, err := net.Dial("unix", c.Socket)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("no node is running on %s, start one with 'serve' or pass --ephemeral: %w", c.Socket, err)
+	}
+	if err := gob.NewEncoder(conn).Encode(&ControlMessage{Payload: req}); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	var sendErr error
+	if body != nil {
+		if _, err := io.CopyN(conn, body, size); err != nil {
+			// the node may have refused the file, its reply tells why, or
+			// waits for the rest of it
+			sendErr = err
+			if uc, ok := conn.(*net.UnixConn); ok {
+				uc.CloseWrite()
+			}
+		}
+	}
+
+	r := bufio.NewReader(conn)
+	var resp ControlMessage
+	if err := gob.NewDecoder(r).Decode(&resp); err != nil {
+		conn.Close()
+		if sendErr != nil {
+			return nil, nil, nil, sendErr
+		}
+		return nil, nil, nil, fmt.Errorf("reading the reply of the node: %w", err)
+	}
+	return resp.Payload, r, conn, nil
+}
+
+// Store sends size bytes of r to the node to store as key. Zero replicas
+// and an empty placement leave the choice to the node.
+func (c *ControlClient) Store(key string, r io.Reader, size int64, replicas int, placement string) ([]ReplicaResult, error) {
+	payload, _, conn, err := c.call(ControlStore{
+		Key:       key,
+		Size:      size,
+		Replicas:  replicas,
+		Placement: placement,
+	}, r, size)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	v, ok := payload.(ControlStoreResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response %T", payload)
+	}
+	var results []ReplicaResult
+	for _, rep := range v.Replicas {
+		res := ReplicaResult{Peer: rep.Peer}
+		if rep.Error != "" {
+			res.Err = errors.New(rep.Error)
+		}
+		results = append(results, res)
+	}
+	if v.Error != "" {
+		return results, errors.New(v.Error)
+	}
+	return results, nil
+}
+
+// Get fetches a file through the node. The returned reader must be closed.
+func (c *ControlClient) Get(key string) (int64, io.ReadCloser, error) {
+	payload, r, conn, err := c.call(ControlGet{Key: key}, nil, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	v, ok := payload.(ControlGetResponse)
+	if !ok {
+		conn.Close()
+		return 0, nil, fmt.Errorf("unexpected response %T", payload)
+	}
+	if v.Error != "" {
+		conn.Close()
+		return 0, nil, errors.New(v.Error)
+	}
+	return v.Size, struct {
+		io.Reader
+		io.Closer
+	}{&exactReader{r: r, n: v.Size}, conn}, nil
+}
+
+// Delete deletes a file through the node.
+func (c *ControlClient) Delete(key string) error {
+	return c.simpleCall(ControlDelete{Key: key})
+}
+
+// Share gives the node with the given identity access to a file of the
+// node.
+func (c *ControlClient) Share(key string, recipient ed25519.PublicKey) error {
+	return c.simpleCall(ControlShare{Key: key, Recipient: recipient})
+}
+
+func (c *ControlClient) simpleCall(req any) error {
+	payload, _, conn, err := c.call(req, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	v, ok := payload.(ControlResponse)
+	if !ok {
+		return fmt.Errorf("unexpected response %T", payload)
+	}
+	if v.Error != "" {
+		return errors.New(v.Error)
+	}
+	return nil
+}
+
+// Scrub has the node scrub its store, reading at most rate bytes per
+// second.
+func (c *ControlClient) Scrub(rate int64) (*ScrubReport, error) {
+	payload, _, conn, err := c.call(ControlScrub{Rate: rate}, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	v, ok := payload.(ControlScrubResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response %T", payload)
+	}
+	if v.Error != "" {
+		return nil, errors.New(v.Error)
+	}
+	report := &ScrubReport{
+		Objects:      v.Objects,
+		Bytes:        v.Bytes,
+		OrphanChunks: v.OrphanChunks,
+		OrphanBytes:  v.OrphanBytes,
+	}
+	for _, p := range v.Problems {
+		problem := ScrubProblem{Key: p.Key, Missing: p.Missing, Repair: p.Repair}
+		if p.Error != "" {
+			problem.Err = errors.New(p.Error)
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+	return report, nil
+}
+
+func init() {
+	gob.Register(ControlStore{})
+	gob.Register(ControlStoreResponse{})
+	gob.Register(ControlGet{})
+	gob.Register(ControlGetResponse{})
+	gob.Register(ControlDelete{})
+	gob.Register(ControlShare{})
+	gob.Register(ControlScrub{})
+	gob.Register(ControlScrubResponse{})
+	gob.Register(ControlResponse{})
+}
+
+// ControlMessage is a request to the node on the control socket or its
+// reply.
+type ControlMessage struct {
+	Payload any
+}
+
+// ControlStore stores the Size bytes following the request as Key.
+type ControlStore struct {
+	Key       string
+	Size      int64
+	Replicas  int
+	Placement string
+}
+
+type ControlReplica struct {
+	Peer  string
+	Error string
+}
+
+type ControlStoreResponse struct {
+	Replicas []ControlReplica
+	Error    string
+}
+
+// ControlGet fetches a file, its Size bytes follow the response.
+type ControlGet struct {
+	Key string
+}
+
+type ControlGetResponse struct {
+	Size  int64
+	Error string
+}
+
+type ControlDelete struct {
+	Key string
+}
+
+type ControlShare struct {
+	Key       string
+	Recipient []byte
+}
+
+type ControlScrub struct {
+	Rate int64
+}
+
+type ControlScrubProblem struct {
+	Key     string
+	Missing bool
+	Error   string
+	Repair  string
+}
+
+type ControlScrubResponse struct {
+	Objects      int
+	Bytes        int64
+	OrphanChunks int
+	OrphanBytes  int64
+	Problems     []ControlScrubProblem
+	Error        string
+}
+
+// ControlResponse answers the requests that return nothing but an error.
+type ControlResponse struct {
+	Error string
+}
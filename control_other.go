@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// listenUnix listens on a new socket at path. Without a umask, its
+// permissions are those of the directory it is in.
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
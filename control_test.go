@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveControl serves the control API of s on a socket in a temporary
+// directory and returns a client of it.
+func serveControl(t *testing.T, s *FileServer) *ControlClient {
+	socket := filepath.Join(t.TempDir(), "node.sock")
+	l, err := ListenControl(socket)
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+	go s.ServeControl(l)
+	return &ControlClient{Socket: socket}
+}
+
+func TestControlAPI(t *testing.T) {
+	servers := newTestCluster(t, 2, func() FileServerOpts {
+		return FileServerOpts{
+			ReplicationFactor: 1,
+			DB:                newTestDB(t),
+		}
+	})
+	owner, holder := servers[0], servers[1]
+	client := serveControl(t, owner)
+
+	data := randomData(1, 300*1024)
+	results, err := client.Store("file.bin", bytes.NewReader(data), int64(len(data)), 0, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []ReplicaResult{{Peer: holder.Transport.ID()}}, results)
+	assert.True(t, holder.store.Has(owner.hashKey("file.bin")))
+
+	size, r, err := client.Get("file.bin")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+	assert.Equal(t, int64(len(data)), size)
+	assert.Equal(t, data, got)
+
+	report, err := client.Scrub(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Objects)
+	assert.Empty(t, report.Problems)
+
+	assert.Nil(t, client.Delete("file.bin"))
+	assert.False(t, owner.store.Has("file.bin"))
+	_, _, err = client.Get("file.bin")
+	assert.ErrorContains(t, err, ErrFileNotFound.Error())
+
+	// a file cut short is not stored
+	_, err = client.Store("short.bin", bytes.NewReader(data[:1000]), int64(len(data)), 0, "")
+	assert.ErrorContains(t, err, errCutShort.Error())
+	assert.False(t, owner.store.Has("short.bin"))
+}
+
+func TestListenControl(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "node.sock")
+
+	l, err := ListenControl(socket)
+	assert.Nil(t, err)
+	fi, err := os.Stat(socket)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	_, err = ListenControl(socket)
+	assert.ErrorContains(t, err, "already running")
+
+	// the socket of a node that did not shut down cleanly
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = ListenControl(socket)
+	assert.Nil(t, err)
+	l.Close()
+
+	notSocket := filepath.Join(dir, "p2p.db")
+	assert.Nil(t, os.WriteFile(notSocket, []byte("data"), 0o644))
+	_, err = ListenControl(notSocket)
+	assert.ErrorContains(t, err, "not a socket")
+	_, err = os.Stat(notSocket)
+	assert.Nil(t, err)
+}
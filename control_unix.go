@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix listens on a new socket at path that only the user can
+// connect to. The socket is created with mode 0600 by the umask, as
+// changing it afterwards would leave a moment in which anyone could
+// connect. The umask is the process's, so this is done before the node
+// starts creating files and directories.
+func listenUnix(path string) (net.Listener, error) {
+	umask := syscall.Umask(0o177)
+	defer syscall.Umask(umask)
+	return net.Listen("unix", path)
+}
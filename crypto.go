@@ -1,13 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/md5"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 )
 
 func newEcryptionKey() []byte {
@@ -16,70 +24,291 @@ func newEcryptionKey() []byte {
 	return keyBuf
 }
 
-// one way hash
-func hashKey(key string) string {
-	hash := md5.Sum([]byte(key))
-	return hex.EncodeToString(hash[:])
+// newIdentity generates a fresh Ed25519 node identity.
+func newIdentity() ed25519.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return priv
 }
 
-func copyDecrypt(key []byte, src io.Reader, dest io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return 0, err
+// hashKey returns the identifier the file with the given key is known by
+// on the network. With a namespace secret it is an HMAC of the key, so
+// only nodes sharing the secret can confirm a guess of a file name.
+func (s *FileServer) hashKey(key string) string {
+	return fileHash(s.NamespaceKey, key)
+}
+
+// fileHash is HMAC-SHA256 of key under secret, or SHA-256 of key without
+// a secret.
+func fileHash(secret []byte, key string) string {
+	if secret == nil {
+		hash := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(hash[:])
 	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
-	// read iv from the given io.Reader which in our case
-	//  should be the block.BlockSize() bytes we read
-	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
-		return 0, err
+// Encrypted data uses a segmented AEAD stream format:
+//
+//	header:  "p2pe" | version: 1 byte | algorithm: 1 byte | salt: 16 bytes
+//	segment: up to segmentSize bytes of ciphertext | tag: 16 bytes
+//
+// Every stream is encrypted with its own key, derived from the key and the
+// salt with HKDF-SHA256. Segment i is sealed with the nonce
+// [zero: 7 bytes][i: 4 bytes][final: 1 byte] and the header as additional
+// data. Changing the header, reordering segments or flipping a bit fails
+// authentication, and so does cutting the stream short, since its last
+// segment is then not sealed as the final one.
+const (
+	streamMagic      = "p2pe"
+	streamVersion    = 1
+	streamSaltSize   = 16
+	streamHeaderSize = 4 + 1 + 1 + streamSaltSize // magic, version, algorithm, salt
+	streamTagSize    = 16
+	segmentSize      = 64 * 1024
+)
+
+// Encryption algorithms, the name is recorded with the key in keys.algo.
+// ChaCha20-Poly1305 would need golang.org/x/crypto, the algorithm byte in
+// the header leaves room for it.
+const AlgoAES256GCM = "AES-256-GCM"
+
+var algorithmIDs = map[string]byte{
+	AlgoAES256GCM: 1,
+}
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported encryption algorithm")
+	// ErrTampered is returned when encrypted data fails authentication: it
+	// was corrupted, modified or truncated.
+	ErrTampered = errors.New("encrypted data failed authentication")
+)
+
+// checkAlgorithm reports whether data can be encrypted with algo.
+func checkAlgorithm(algo string) error {
+	if _, ok := algorithmIDs[algo]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, algo)
 	}
+	return nil
+}
 
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dest)
+func streamAEAD(id byte, key, salt []byte) (cipher.AEAD, error) {
+	switch id {
+	case algorithmIDs[AlgoAES256GCM]:
+		streamKey, err := hkdf.Key(sha256.New, key, salt, "p2p stream key", 32)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(streamKey)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, fmt.Errorf("%w: id %d", ErrUnsupportedAlgorithm, id)
+	}
 }
 
-func copyEncrypt(key []byte, src io.Reader, dest io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return 0, err
+func segmentNonce(i uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:], i)
+	if final {
+		nonce[11] = 1
 	}
+	return nonce
+}
 
-	iv := make([]byte, block.BlockSize()) // 16 bytes
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+// encryptedSize returns the size of n bytes of plaintext once encrypted.
+func encryptedSize(n int) int {
+	segments := max(1, (n+segmentSize-1)/segmentSize)
+	return streamHeaderSize + n + segments*streamTagSize
+}
+
+// copyEncrypt encrypts src to dest with a random salt and returns the
+// number of bytes written.
+func copyEncrypt(algo string, key []byte, src io.Reader, dest io.Writer) (int, error) {
+	salt := make([]byte, streamSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
 		return 0, err
 	}
+	return encryptStream(algo, key, salt, src, dest)
+}
 
-	// prepend the iv to the file
-	if _, err := dest.Write(iv); err != nil {
+func encryptStream(algo string, key, salt []byte, src io.Reader, dest io.Writer) (int, error) {
+	id, ok := algorithmIDs[algo]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, algo)
+	}
+	aead, err := streamAEAD(id, key, salt)
+	if err != nil {
 		return 0, err
 	}
 
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dest)
-}
+	header := append([]byte(streamMagic), streamVersion, id)
+	header = append(header, salt...)
+	nw, err := dest.Write(header)
+	if err != nil {
+		return nw, err
+	}
 
-func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dest io.Writer) (int, error) {
 	var (
-		buf = make([]byte, 32*1024) // buffer size used by the standard library (io.go) copyBuffer func
-		nw  = blockSize
+		br     = bufio.NewReaderSize(src, segmentSize)
+		plain  = make([]byte, segmentSize)
+		sealed = make([]byte, 0, segmentSize+streamTagSize)
 	)
-	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			stream.XORKeyStream(buf, buf[:n])
-			c, err := dest.Write(buf[:n])
-			if err != nil {
-				return 0, err
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(br, plain)
+		final := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !final {
+			return nw, err
+		}
+		if !final {
+			// a full segment is the final one if nothing follows it
+			if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+				final = true
+			} else if err != nil {
+				return nw, err
 			}
-			nw += c
 		}
+		if !final && i == math.MaxUint32 {
+			return nw, errors.New("stream too long to encrypt")
+		}
+
+		sealed = aead.Seal(sealed[:0], segmentNonce(i, final), plain[:n], header)
+		c, err := dest.Write(sealed)
+		nw += c
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
+			return nw, err
+		}
+		if final {
+			return nw, nil
+		}
+	}
+}
+
+// copyDecrypt decrypts src to dest and returns the number of plaintext
+// bytes written. Any modification of src fails with ErrTampered, after
+// which the plaintext written so far must be discarded.
+func copyDecrypt(key []byte, src io.Reader, dest io.Writer) (int, error) {
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return 0, fmt.Errorf("%w: reading header: %v", ErrTampered, err)
+	}
+	if string(header[:len(streamMagic)]) != streamMagic {
+		return 0, fmt.Errorf("%w: not an encrypted stream", ErrTampered)
+	}
+	if version := header[len(streamMagic)]; version != streamVersion {
+		return 0, fmt.Errorf("unsupported encryption format version %d", version)
+	}
+	aead, err := streamAEAD(header[len(streamMagic)+1], key, header[len(streamMagic)+2:])
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		br  = bufio.NewReaderSize(src, segmentSize+streamTagSize)
+		buf = make([]byte, segmentSize+streamTagSize)
+		nw  int
+	)
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(br, buf)
+		final := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !final {
+			return nw, err
+		}
+		if !final {
+			if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+				final = true
+			} else if err != nil {
+				return nw, err
 			}
-			return 0, err
 		}
+
+		plain, err := aead.Open(buf[:0], segmentNonce(i, final), buf[:n], header)
+		if err != nil {
+			return nw, fmt.Errorf("%w: segment %d", ErrTampered, i)
+		}
+		c, err := dest.Write(plain)
+		nw += c
+		if err != nil {
+			return nw, err
+		}
+		if final {
+			return nw, nil
+		}
+	}
+}
+
+// maxEncryptedChunkSize is the size of the largest chunk once encrypted,
+// MaxChunkSize is a multiple of segmentSize.
+const maxEncryptedChunkSize = streamHeaderSize + MaxChunkSize + MaxChunkSize/segmentSize*streamTagSize
+
+// encryptChunk encrypts a chunk for replication. The salt is derived from
+// the key and the content, so the same chunk always encrypts to the same
+// bytes and replicas deduplicate on peers like plaintext chunks do locally.
+// Only equal chunks under the same key can be told apart.
+func encryptChunk(algo string, key, plaintext []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("chunk salt"))
+	mac.Write(plaintext)
+	salt := mac.Sum(nil)[:streamSaltSize]
+
+	out := bytes.NewBuffer(make([]byte, 0, encryptedSize(len(plaintext))))
+	if _, err := encryptStream(algo, key, salt, bytes.NewReader(plaintext), out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func decryptChunk(key, ciphertext []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(ciphertext)))
+	if _, err := copyDecrypt(key, bytes.NewReader(ciphertext), out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// legacyDecrypter decrypts a replica stored before replicas used
+// authenticated encryption: [iv: 16 bytes][AES-CTR ciphertext] over the
+// whole file, received in chunks. Nothing detects modified data, the
+// plaintext must be checked against the file's digest.
+type legacyDecrypter struct {
+	key    []byte
+	iv     []byte
+	stream cipher.Stream
+}
+
+func newLegacyDecrypter(key []byte) *legacyDecrypter {
+	return &legacyDecrypter{key: key}
+}
+
+// decrypt decrypts the next chunk of the replica.
+func (d *legacyDecrypter) decrypt(chunk []byte) ([]byte, error) {
+	if d.stream == nil {
+		n := min(aes.BlockSize-len(d.iv), len(chunk))
+		d.iv, chunk = append(d.iv, chunk[:n]...), chunk[n:]
+		if len(d.iv) < aes.BlockSize {
+			return nil, nil
+		}
+		block, err := aes.NewCipher(d.key)
+		if err != nil {
+			return nil, err
+		}
+		d.stream = cipher.NewCTR(block, d.iv)
+	}
+	out := make([]byte, len(chunk))
+	d.stream.XORKeyStream(out, chunk)
+	return out, nil
+}
+
+// close reports a replica that ended before its IV.
+func (d *legacyDecrypter) close() error {
+	if d.stream == nil {
+		return errors.New("replica is shorter than its IV")
 	}
-	return nw, nil
+	return nil
 }
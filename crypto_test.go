@@ -2,7 +2,11 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"slices"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestCopyEncyptDecrypt(t *testing.T) {
@@ -12,7 +16,7 @@ func TestCopyEncyptDecrypt(t *testing.T) {
 	dest := new(bytes.Buffer)
 
 	key := newEcryptionKey()
-	_, err := copyEncrypt(key, src, dest)
+	_, err := copyEncrypt(AlgoAES256GCM, key, src, dest)
 	if err != nil {
 		t.Error(err)
 	}
@@ -23,7 +27,7 @@ func TestCopyEncyptDecrypt(t *testing.T) {
 		t.Error(err)
 	}
 
-	if nw != 16+len(payload) {
+	if nw != len(payload) {
 		t.Fail()
 	}
 
@@ -31,3 +35,81 @@ func TestCopyEncyptDecrypt(t *testing.T) {
 		t.Errorf("Decryption failed!!")
 	}
 }
+
+func encrypt(t *testing.T, key, plaintext []byte) []byte {
+	out := new(bytes.Buffer)
+	n, err := copyEncrypt(AlgoAES256GCM, key, bytes.NewReader(plaintext), out)
+	assert.Nil(t, err)
+	assert.Equal(t, encryptedSize(len(plaintext)), n)
+	return out.Bytes()
+}
+
+func decrypt(key, ciphertext []byte) ([]byte, error) {
+	out := new(bytes.Buffer)
+	_, err := copyDecrypt(key, bytes.NewReader(ciphertext), out)
+	return out.Bytes(), err
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := newEcryptionKey()
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3 * segmentSize} {
+		plaintext := randomData(byte(size), size)
+		got, err := decrypt(key, encrypt(t, key, plaintext))
+		assert.Nil(t, err, size)
+		assert.Equal(t, len(plaintext), len(got), size)
+		assert.True(t, bytes.Equal(plaintext, got), size)
+	}
+}
+
+func TestStreamDetectsTampering(t *testing.T) {
+	key := newEcryptionKey()
+	ciphertext := encrypt(t, key, randomData(6, 3*segmentSize))
+	segment := segmentSize + streamTagSize
+
+	tampered := map[string][]byte{
+		"truncated at a segment boundary": ciphertext[:streamHeaderSize+2*segment],
+		"truncated in a segment":          ciphertext[:len(ciphertext)-100],
+		"header only":                     ciphertext[:streamHeaderSize],
+		"segments reordered": slices.Concat(ciphertext[:streamHeaderSize],
+			ciphertext[streamHeaderSize+segment:streamHeaderSize+2*segment],
+			ciphertext[streamHeaderSize:streamHeaderSize+segment],
+			ciphertext[streamHeaderSize+2*segment:]),
+		"extra data": append(bytes.Clone(ciphertext), 0),
+	}
+	for _, i := range []int{0, 5, 10, streamHeaderSize, streamHeaderSize + segment + 7, len(ciphertext) - 1} {
+		flipped := bytes.Clone(ciphertext)
+		flipped[i] ^= 1
+		tampered[fmt.Sprintf("bit flipped at %d", i)] = flipped
+	}
+
+	for name, c := range tampered {
+		_, err := decrypt(key, c)
+		assert.NotNil(t, err, name)
+	}
+
+	_, err := decrypt(newEcryptionKey(), ciphertext)
+	assert.ErrorIs(t, err, ErrTampered)
+}
+
+func TestEncryptChunkIsDeterministic(t *testing.T) {
+	key := newEcryptionKey()
+	chunk := randomData(7, 100_000)
+
+	a, err := encryptChunk(AlgoAES256GCM, key, chunk)
+	assert.Nil(t, err)
+	b, err := encryptChunk(AlgoAES256GCM, key, chunk)
+	assert.Nil(t, err)
+	assert.Equal(t, a, b)
+	assert.LessOrEqual(t, len(a), maxEncryptedChunkSize)
+
+	other, err := encryptChunk(AlgoAES256GCM, newEcryptionKey(), chunk)
+	assert.Nil(t, err)
+	assert.NotEqual(t, a, other)
+
+	got, err := decryptChunk(key, a)
+	assert.Nil(t, err)
+	assert.Equal(t, chunk, got)
+
+	_, err = encryptChunk("AES-CTR-256", key, chunk)
+	assert.ErrorIs(t, err, ErrUnsupportedAlgorithm)
+}
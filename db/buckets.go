@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrBucketExists is returned by CreateBucket for a name in use.
+	ErrBucketExists = errors.New("db: bucket already exists")
+	// ErrNoSuchUpload is returned for an upload that was never created, or
+	// was completed or aborted.
+	ErrNoSuchUpload = errors.New("db: no such upload")
+)
+
+type Bucket struct {
+	Name      string
+	CreatedAt time.Time
+}
+
+// Upload is a multipart upload in progress.
+type Upload struct {
+	ID        string
+	Bucket    string
+	Key       string
+	CreatedAt time.Time
+}
+
+// UploadPart is a part of a multipart upload. ETag is the hex SHA-256 of
+// its content.
+type UploadPart struct {
+	UploadID   string
+	PartNumber int
+	ETag       string
+	Size       int64
+}
+
+// CreateBucket records a new bucket.
+func (d *DB) CreateBucket(ctx context.Context, name string) error {
+	res, err := d.sql.ExecContext(ctx, `
+		INSERT OR IGNORE INTO buckets(name) VALUES(?)
+	`, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrBucketExists
+	}
+	return nil
+}
+
+// GetBucket returns a bucket by name, sql.ErrNoRows if there is none.
+func (d *DB) GetBucket(ctx context.Context, name string) (*Bucket, error) {
+	var b Bucket
+	if err := d.sql.QueryRowContext(ctx, `
+		SELECT name,created_at FROM buckets WHERE name=?
+	`, name).Scan(&b.Name, &b.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (d *DB) ListBuckets(ctx context.Context) ([]Bucket, error) {
+	rows, err := d.sql.QueryContext(ctx, `
+		SELECT name,created_at FROM buckets ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Bucket
+	for rows.Next() {
+		var b Bucket
+		if err := rows.Scan(&b.Name, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+func (d *DB) DeleteBucket(ctx context.Context, name string) error {
+	_, err := d.sql.ExecContext(ctx, `
+		DELETE FROM buckets WHERE name=?
+	`, name)
+	return err
+}
+
+// CreateUpload records a multipart upload.
+func (d *DB) CreateUpload(ctx context.Context, u Upload) error {
+	_, err := d.sql.ExecContext(ctx, `
+		INSERT INTO uploads(id,bucket,object_key) VALUES(?,?,?)
+	`, u.ID, u.Bucket, u.Key)
+	return err
+}
+
+// GetUpload returns an upload in progress, ErrNoSuchUpload if there is
+// none.
+func (d *DB) GetUpload(ctx context.Context, id string) (*Upload, error) {
+	var u Upload
+	err := d.sql.QueryRowContext(ctx, `
+		SELECT id,bucket,object_key,created_at FROM uploads WHERE id=?
+	`, id).Scan(&u.ID, &u.Bucket, &u.Key, &u.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoSuchUpload
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// DeleteUpload forgets an upload and its parts.
+func (d *DB) DeleteUpload(ctx context.Context, id string) error {
+	tx, err := d.sql.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM upload_parts WHERE upload_id=?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM uploads WHERE id=?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PutUploadPart records a part of an upload, replacing the part with the
+// same number.
+func (d *DB) PutUploadPart(ctx context.Context, p UploadPart) error {
+	_, err := d.sql.ExecContext(ctx, `
+		INSERT OR REPLACE INTO upload_parts(upload_id,part_number,etag,size)
+		VALUES(?,?,?,?)
+	`, p.UploadID, p.PartNumber, p.ETag, p.Size)
+	return err
+}
+
+// ListUploadParts returns the parts of an upload in order.
+func (d *DB) ListUploadParts(ctx context.Context, uploadID string) ([]UploadPart, error) {
+	rows, err := d.sql.QueryContext(ctx, `
+		SELECT upload_id,part_number,etag,size FROM upload_parts
+		WHERE upload_id=? ORDER BY part_number
+	`, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []UploadPart
+	for rows.Next() {
+		var p UploadPart
+		if err := rows.Scan(&p.UploadID, &p.PartNumber, &p.ETag, &p.Size); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
@@ -3,22 +3,31 @@ package db
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"sync"
 
 	_ "modernc.org/sqlite"
 )
 
 type DB struct {
 	sql *sql.DB
+
+	// kek is derived from the passphrase and seals the keys stored in
+	// the keys table, nil while they are locked or not protected
+	keyMu sync.RWMutex
+	kek   []byte
 }
 
 func Open(path string) (*DB, error) {
 	// e.g., path = "p2p.db"
-	d, err := sql.Open("sqlite", path)
+	// every connection of the pool waits for a busy database instead of
+	// failing, and transactions take the write lock when they begin, so
+	// that two of them cannot deadlock upgrading theirs
+	d, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(3000)&_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
-	// busy timeout reasonable for single-process writes
-	if _, err := d.Exec(`PRAGMA busy_timeout=3000;`); err != nil {
+	if err := d.Ping(); err != nil {
 		_ = d.Close()
 		return nil, err
 	}
@@ -49,12 +58,25 @@ func (d *DB) Migrate(ctx context.Context) error {
 			key_id TEXT NOT NULL,
 			PRIMARY KEY (file_id, key_id)
 		);`,
+		// data keys other nodes shared with us, kept apart from the keys of
+		// our own files so that a share never replaces one of them
+		`CREATE TABLE IF NOT EXISTS shared_keys (
+			file_id TEXT NOT NULL,
+			peer_id TEXT NOT NULL,
+			key_id TEXT NOT NULL,
+			PRIMARY KEY (file_id, peer_id)
+		);`,
 		`CREATE TABLE IF NOT EXISTS peers (
 			id TEXT PRIMARY KEY,
 			address TEXT NOT NULL UNIQUE,
 			status TEXT NOT NULL,
 			last_seen TIMESTAMP
 		);`,
+		// nodes allowed to connect, by the hex of their Ed25519 public key
+		`CREATE TABLE IF NOT EXISTS trusted_peers (
+			public_key TEXT PRIMARY KEY,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);`,
 		`CREATE TABLE IF NOT EXISTS shares (
 			id TEXT PRIMARY KEY,
 			file_id TEXT NOT NULL,
@@ -62,6 +84,41 @@ func (d *DB) Migrate(ctx context.Context) error {
 			direction TEXT NOT NULL,
 			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 		);`,
+		`CREATE TABLE IF NOT EXISTS passphrase (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			kdf TEXT NOT NULL,
+			salt BLOB NOT NULL,
+			iterations INTEGER NOT NULL,
+			verifier BLOB NOT NULL
+		);`,
+		// buckets of the S3 endpoint, and its multipart uploads in progress
+		`CREATE TABLE IF NOT EXISTS buckets (
+			name TEXT PRIMARY KEY,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS uploads (
+			id TEXT PRIMARY KEY,
+			bucket TEXT NOT NULL,
+			object_key TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS upload_parts (
+			upload_id TEXT NOT NULL,
+			part_number INTEGER NOT NULL,
+			etag TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			PRIMARY KEY (upload_id, part_number)
+		);`,
+		// directories created over WebDAV, which hold no file yet
+		`CREATE TABLE IF NOT EXISTS directories (
+			name TEXT PRIMARY KEY,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);`,
+		// the default key was recorded as AES-CTR before replicas used
+		// authenticated encryption, the key itself is used as it is; the
+		// AES-CTR replicas made with it are still read until they are
+		// re-encrypted with a data key
+		`UPDATE keys SET algo='AES-256-GCM' WHERE id='default' AND algo='AES-CTR-256';`,
 	}
 	tx, err := d.sql.BeginTx(ctx, nil)
 	if err != nil {
@@ -73,7 +130,47 @@ func (d *DB) Migrate(ctx context.Context) error {
 			return err
 		}
 	}
+
+	// wrapped_by is the key that encrypts key_bytes, empty for keys stored
+	// as they are
+	if err := addColumn(ctx, tx, "keys", "wrapped_by", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// master keys are numbered from 1 as they are rotated, one of them is
+	// active; the default key created before rotation existed is version 1
+	if err := addColumn(ctx, tx, "keys", "version", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn(ctx, tx, "keys", "active", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// digest is the SHA-256 of the content of a file, empty for files
+	// stored before it was recorded
+	if err := addColumn(ctx, tx, "files", "digest", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE keys SET version=1, active=1
+		WHERE id='default' AND version=0 AND NOT EXISTS (SELECT 1 FROM keys WHERE version>0)
+	`); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
+// addColumn adds a column to a table created before the column existed.
+func addColumn(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	var n int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?
+	`, table, column).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
+
 func (d *DB) SQL() *sql.DB { return d.sql }
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Directory is a directory created explicitly. Directories are otherwise
+// the prefixes of file names up to a slash, and exist as long as a file
+// does under them.
+type Directory struct {
+	Name      string
+	CreatedAt time.Time
+}
+
+// CreateDirectory records a directory; recording it again is not an error.
+func (d *DB) CreateDirectory(ctx context.Context, name string) error {
+	_, err := d.sql.ExecContext(ctx, `
+		INSERT OR IGNORE INTO directories(name) VALUES(?)
+	`, name)
+	return err
+}
+
+// GetDirectory returns a directory by name, sql.ErrNoRows if it was not
+// recorded.
+func (d *DB) GetDirectory(ctx context.Context, name string) (*Directory, error) {
+	var dir Directory
+	if err := d.sql.QueryRowContext(ctx, `
+		SELECT name,created_at FROM directories WHERE name=?
+	`, name).Scan(&dir.Name, &dir.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &dir, nil
+}
+
+// ListDirectoriesByPrefix returns the directories whose name starts with
+// prefix, in name order.
+func (d *DB) ListDirectoriesByPrefix(ctx context.Context, prefix string) ([]Directory, error) {
+	rows, err := d.sql.QueryContext(ctx, `
+		SELECT name,created_at FROM directories
+		WHERE substr(name,1,length(?))=?
+		ORDER BY name
+	`, prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Directory
+	for rows.Next() {
+		var dir Directory
+		if err := rows.Scan(&dir.Name, &dir.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, dir)
+	}
+	return out, rows.Err()
+}
+
+// DeleteDirectory forgets a directory and the directories under it.
+func (d *DB) DeleteDirectory(ctx context.Context, name string) error {
+	_, err := d.sql.ExecContext(ctx, `
+		DELETE FROM directories WHERE name=? OR substr(name,1,length(?))=?
+	`, name, name+"/", name+"/")
+	return err
+}
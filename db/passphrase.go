@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// SealedByPassphrase is the wrapped_by of keys sealed under the passphrase.
+const SealedByPassphrase = "passphrase"
+
+// DefaultPassphraseIterations is the PBKDF2-HMAC-SHA256 iteration count
+// new passphrases are derived with.
+const DefaultPassphraseIterations = 600_000
+
+const passphraseKDF = "PBKDF2-SHA256"
+
+var (
+	// ErrLocked is returned when reading or storing a key of a protected
+	// database before Unlock.
+	ErrLocked = errors.New("db: keys are protected by a passphrase and locked")
+	// ErrWrongPassphrase is returned by Unlock for a passphrase that does
+	// not derive the key the keys are sealed with.
+	ErrWrongPassphrase = errors.New("db: wrong passphrase")
+)
+
+// verifierPlaintext is sealed with the passphrase key to tell a wrong
+// passphrase from a damaged key.
+var verifierPlaintext = []byte("p2p passphrase check")
+
+// Protected reports whether the keys are sealed under a passphrase.
+func (d *DB) Protected(ctx context.Context) (bool, error) {
+	return protected(ctx, d.sql)
+}
+
+// rowQuerier is a database or a transaction.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func protected(ctx context.Context, q rowQuerier) (bool, error) {
+	var n int
+	if err := q.QueryRowContext(ctx, `SELECT COUNT(*) FROM passphrase`).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Unlock derives the key the keys are sealed with from the passphrase, so
+// they can be read.
+func (d *DB) Unlock(ctx context.Context, passphrase string) error {
+	var (
+		kdf        string
+		salt       []byte
+		iterations int
+		verifier   []byte
+	)
+	err := d.sql.QueryRowContext(ctx, `
+		SELECT kdf,salt,iterations,verifier FROM passphrase
+	`).Scan(&kdf, &salt, &iterations, &verifier)
+	if err != nil {
+		return err
+	}
+	if kdf != passphraseKDF {
+		return fmt.Errorf("db: unsupported passphrase KDF '%s'", kdf)
+	}
+
+	kek, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return err
+	}
+	if _, err := open(kek, verifier, SealedByPassphrase); err != nil {
+		return ErrWrongPassphrase
+	}
+
+	d.keyMu.Lock()
+	d.kek = kek
+	d.keyMu.Unlock()
+	return nil
+}
+
+// SetPassphrase seals the master keys and the node identity under a new
+// passphrase. If the keys are protected already they must be unlocked.
+func (d *DB) SetPassphrase(ctx context.Context, passphrase string, iterations int) error {
+	if passphrase == "" {
+		return errors.New("db: the passphrase must not be empty")
+	}
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	kek, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return err
+	}
+	verifier, err := seal(kek, verifierPlaintext, SealedByPassphrase)
+	if err != nil {
+		return err
+	}
+
+	d.keyMu.Lock()
+	defer d.keyMu.Unlock()
+
+	tx, err := d.sql.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the keys sealed under the old passphrase and the ones stored as they
+	// are, data keys stay wrapped by their master key
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id,key_bytes,wrapped_by FROM keys WHERE wrapped_by IN ('', ?)
+	`, SealedByPassphrase)
+	if err != nil {
+		return err
+	}
+	type sealedKey struct {
+		id       string
+		keyBytes []byte
+	}
+	var keys []sealedKey
+	for rows.Next() {
+		var (
+			k         sealedKey
+			wrappedBy string
+		)
+		if err := rows.Scan(&k.id, &k.keyBytes, &wrappedBy); err != nil {
+			rows.Close()
+			return err
+		}
+		if wrappedBy == SealedByPassphrase {
+			if d.kek == nil {
+				rows.Close()
+				return ErrLocked
+			}
+			if k.keyBytes, err = open(d.kek, k.keyBytes, k.id); err != nil {
+				rows.Close()
+				return fmt.Errorf("db: key %s: %w", k.id, err)
+			}
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		sealed, err := seal(kek, k.keyBytes, k.id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE keys SET key_bytes=?, wrapped_by=? WHERE id=?
+		`, sealed, SealedByPassphrase, k.id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO passphrase(id,kdf,salt,iterations,verifier)
+		VALUES(1,?,?,?,?)
+		ON CONFLICT(id) DO UPDATE SET
+			kdf=excluded.kdf,
+			salt=excluded.salt,
+			iterations=excluded.iterations,
+			verifier=excluded.verifier
+	`, passphraseKDF, salt, iterations, verifier); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.kek = kek
+	return nil
+}
+
+// sealKey returns the bytes to store for a key that is not wrapped by
+// another key: sealed under the passphrase if there is one. The keys of a
+// protected database that is locked cannot be sealed, ErrLocked.
+func (d *DB) sealKey(ctx context.Context, q rowQuerier, k Key) ([]byte, string, error) {
+	if k.WrappedBy != "" {
+		return k.KeyBytes, k.WrappedBy, nil
+	}
+	d.keyMu.RLock()
+	kek := d.kek
+	d.keyMu.RUnlock()
+	if kek == nil {
+		protected, err := protected(ctx, q)
+		if err != nil {
+			return nil, "", err
+		}
+		if protected {
+			return nil, "", ErrLocked
+		}
+		return k.KeyBytes, "", nil
+	}
+	sealed, err := seal(kek, k.KeyBytes, k.ID)
+	return sealed, SealedByPassphrase, err
+}
+
+// unsealKey opens a key read from the keys table that is sealed under the
+// passphrase.
+func (d *DB) unsealKey(k *Key) error {
+	if k.WrappedBy != SealedByPassphrase {
+		return nil
+	}
+	d.keyMu.RLock()
+	kek := d.kek
+	d.keyMu.RUnlock()
+	if kek == nil {
+		return ErrLocked
+	}
+	keyBytes, err := open(kek, k.KeyBytes, k.ID)
+	if err != nil {
+		return fmt.Errorf("db: key %s: %w", k.ID, err)
+	}
+	k.KeyBytes, k.WrappedBy = keyBytes, ""
+	return nil
+}
+
+// A sealed key is [nonce: 12 bytes][AES-256-GCM ciphertext], with the key
+// id as additional data so a sealed key cannot be swapped for another.
+func seal(kek, plaintext []byte, id string) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plaintext, []byte(id)), nil
+}
+
+func open(kek, sealed []byte, id string) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed key too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(id))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestDB(t *testing.T, path string) *DB {
+	d, err := Open(path)
+	assert.Nil(t, err)
+	assert.Nil(t, d.Migrate(context.Background()))
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestPassphraseSealsKeys(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "p2p.db")
+	d := openTestDB(t, path)
+
+	master, err := d.GetOrCreateActiveKey(ctx, func() []byte { return []byte(rand.Text()) })
+	assert.Nil(t, err)
+	assert.Nil(t, d.SetPassphrase(ctx, "correct horse", 1000))
+
+	// keys created after the passphrase is set are sealed too
+	identity, err := d.GetOrCreateIdentityKey(ctx, func() []byte { return []byte(rand.Text()) })
+	assert.Nil(t, err)
+
+	rows, err := d.SQL().QueryContext(ctx, `SELECT key_bytes, wrapped_by FROM keys`)
+	assert.Nil(t, err)
+	for rows.Next() {
+		var (
+			stored    []byte
+			wrappedBy string
+		)
+		assert.Nil(t, rows.Scan(&stored, &wrappedBy))
+		assert.Equal(t, SealedByPassphrase, wrappedBy)
+		assert.False(t, bytes.Contains(stored, master.KeyBytes))
+		assert.False(t, bytes.Contains(stored, identity))
+	}
+	assert.Nil(t, rows.Close())
+
+	locked := openTestDB(t, path)
+	_, err = locked.GetActiveKey(ctx)
+	assert.ErrorIs(t, err, ErrLocked)
+	// nor are keys stored in the clear until it is unlocked
+	_, err = locked.RotateKey(ctx, "AES-256-GCM", []byte(rand.Text()))
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.ErrorIs(t, locked.PutKey(ctx, Key{ID: "spare", KeyBytes: []byte(rand.Text())}), ErrLocked)
+	assert.ErrorIs(t, locked.Unlock(ctx, "wrong"), ErrWrongPassphrase)
+	assert.Nil(t, locked.Unlock(ctx, "correct horse"))
+	got, err := locked.GetActiveKey(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, master.KeyBytes, got.KeyBytes)
+
+	assert.Nil(t, locked.SetPassphrase(ctx, "battery staple", 1000))
+	changed := openTestDB(t, path)
+	assert.ErrorIs(t, changed.Unlock(ctx, "correct horse"), ErrWrongPassphrase)
+	assert.Nil(t, changed.Unlock(ctx, "battery staple"))
+	got, err = changed.GetActiveKey(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, master.KeyBytes, got.KeyBytes)
+	seed, err := changed.GetOrCreateIdentityKey(ctx, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, identity, seed)
+}
@@ -2,21 +2,35 @@ package db
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"time"
 )
 
 type Key struct {
-	ID        string
-	Label     string
-	Algo      string
-	KeyBytes  []byte
+	ID       string
+	Label    string
+	Algo     string
+	KeyBytes []byte
+	// WrappedBy is the id of the key KeyBytes are encrypted with, empty
+	// when they are stored as they are.
+	WrappedBy string
+	// Version numbers the master keys in the order they were created, it
+	// is 0 for every other key.
+	Version int
+	// Active is set on the master key new data keys are wrapped with.
+	Active    bool
 	CreatedAt time.Time
 }
 
 type File struct {
-	ID        string
-	Name      string
-	Hash      string
+	ID   string
+	Name string
+	Hash string
+	// Digest is the hex SHA-256 of the content, empty for files stored
+	// before digests were recorded.
+	Digest    string
 	Size      int64
 	LocalPath string
 	CreatedAt time.Time
@@ -37,15 +51,57 @@ type Share struct {
 	CreatedAt time.Time
 }
 
+// Share directions.
+const (
+	// ShareOutbound is a replica of one of our files held by the peer.
+	ShareOutbound = "outbound"
+	// ShareInbound is a replica we hold for the peer.
+	ShareInbound = "inbound"
+	// ShareGranted is one of our files we gave the peer access to.
+	ShareGranted = "granted"
+	// ShareReceived is a file of the peer it gave us access to.
+	ShareReceived = "received"
+)
+
+// UpsertPeer records a peer by its node id. A node that moved to an address
+// previously used by another node takes the address over.
 func (d *DB) UpsertPeer(ctx context.Context, p Peer) error {
-	_, err := d.sql.ExecContext(ctx, `
+	tx, err := d.sql.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM peers WHERE address=? AND id<>?
+	`, p.Address, p.ID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
 		INSERT INTO peers(id,address,status,last_seen)
 		VALUES(?,?,?,?)
-		ON CONFLICT(address) DO UPDATE SET
+		ON CONFLICT(id) DO UPDATE SET
+			address=excluded.address,
 			status=excluded.status,
 			last_seen=excluded.last_seen
-	`, p.ID, p.Address, p.Status, p.LastSeen)
-	return err
+	`, p.ID, p.Address, p.Status, p.LastSeen); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetPeer returns a peer by node id.
+func (d *DB) GetPeer(ctx context.Context, id string) (*Peer, error) {
+	row := d.sql.QueryRowContext(ctx, `
+		SELECT id,address,status,last_seen FROM peers WHERE id=?
+	`, id)
+	var p Peer
+	if err := row.Scan(&p.ID, &p.Address, &p.Status, &p.LastSeen); err != nil {
+		return nil, err
+	}
+	return &p, nil
 }
 
 func (d *DB) InsertFileWithKey(ctx context.Context, f File, keyID string) error {
@@ -56,9 +112,13 @@ func (d *DB) InsertFileWithKey(ctx context.Context, f File, keyID string) error
 	defer tx.Rollback()
 
 	if _, err := tx.ExecContext(ctx, `
-		INSERT INTO files(id,name,hash,size,local_path)
-		VALUES(?,?,?,?,?)
-	`, f.ID, f.Name, f.Hash, f.Size, f.LocalPath); err != nil {
+		INSERT INTO files(id,name,hash,digest,size,local_path)
+		VALUES(?,?,?,?,?,?)
+		ON CONFLICT(id) DO UPDATE SET
+			digest=excluded.digest,
+			size=excluded.size,
+			local_path=excluded.local_path
+	`, f.ID, f.Name, f.Hash, f.Digest, f.Size, f.LocalPath); err != nil {
 		return err
 	}
 
@@ -72,66 +132,528 @@ func (d *DB) InsertFileWithKey(ctx context.Context, f File, keyID string) error
 	return tx.Commit()
 }
 
-func (d *DB) ListFiles(ctx context.Context) ([]File, error) {
-	rows, err := d.sql.QueryContext(ctx, `
-		SELECT id,name,hash,size,local_path,created_at FROM files ORDER BY created_at DESC
-	`)
+const fileColumns = `id,name,hash,digest,size,local_path,created_at`
+
+func scanFile(row scanner) (*File, error) {
+	var f File
+	if err := row.Scan(&f.ID, &f.Name, &f.Hash, &f.Digest, &f.Size, &f.LocalPath, &f.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (d *DB) queryFiles(ctx context.Context, query string, args ...any) ([]File, error) {
+	rows, err := d.sql.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var out []File
 	for rows.Next() {
-		var f File
-		if err := rows.Scan(&f.ID, &f.Name, &f.Hash, &f.Size, &f.LocalPath, &f.CreatedAt); err != nil {
+		f, err := scanFile(rows)
+		if err != nil {
 			return nil, err
 		}
-		out = append(out, f)
+		out = append(out, *f)
 	}
 	return out, rows.Err()
 }
 
-// GetKey returns a key by id.
-func (d *DB) GetKey(ctx context.Context, id string) (*Key, error) {
-	row := d.sql.QueryRowContext(ctx, `
-		SELECT id,label,algo,key_bytes,created_at FROM keys WHERE id=?
+func (d *DB) ListFiles(ctx context.Context) ([]File, error) {
+	return d.queryFiles(ctx, `
+		SELECT `+fileColumns+` FROM files ORDER BY created_at DESC
+	`)
+}
+
+// ListFilesByPrefix returns the files whose name starts with prefix and
+// sorts after after, in name order, at most limit of them if limit is
+// positive.
+func (d *DB) ListFilesByPrefix(ctx context.Context, prefix, after string, limit int) ([]File, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	return d.queryFiles(ctx, `
+		SELECT `+fileColumns+` FROM files
+		WHERE substr(name,1,length(?))=? AND name>?
+		ORDER BY name LIMIT ?
+	`, prefix, prefix, after, limit)
+}
+
+// DeleteFile forgets a file.
+func (d *DB) DeleteFile(ctx context.Context, id string) error {
+	_, err := d.sql.ExecContext(ctx, `
+		DELETE FROM files WHERE id=?
 	`, id)
+	return err
+}
+
+// GetFile returns a file by id.
+func (d *DB) GetFile(ctx context.Context, id string) (*File, error) {
+	return scanFile(d.sql.QueryRowContext(ctx, `
+		SELECT `+fileColumns+` FROM files WHERE id=?
+	`, id))
+}
+
+// RenameFile moves a file and everything recorded about it from oldID to
+// newID, after the way file identifiers are derived changed.
+func (d *DB) RenameFile(ctx context.Context, oldID, newID, localPath string) error {
+	tx, err := d.sql.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE files SET id=?, hash=?, local_path=? WHERE id=?
+	`, newID, newID, localPath, oldID); err != nil {
+		return err
+	}
+	if err := renameFileRefs(ctx, tx, oldID, newID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RenameFileRefs moves the data keys and shares recorded for a file we do
+// not own, a replica we hold or a file shared with us, to newID.
+func (d *DB) RenameFileRefs(ctx context.Context, oldID, newID string) error {
+	tx, err := d.sql.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := renameFileRefs(ctx, tx, oldID, newID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func renameFileRefs(ctx context.Context, tx *sql.Tx, oldID, newID string) error {
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE OR REPLACE file_keys SET file_id=? WHERE file_id=?
+	`, newID, oldID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE OR REPLACE shared_keys SET file_id=? WHERE file_id=?
+	`, newID, oldID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		UPDATE OR REPLACE shares SET file_id=?1, id=?1 || '/' || peer_id || '/' || direction
+		WHERE file_id=?2
+	`, newID, oldID)
+	return err
+}
+
+const keyColumns = `id,label,algo,key_bytes,wrapped_by,version,active,created_at`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanKey reads a key, unsealing it if it is sealed under the passphrase.
+func (d *DB) scanKey(row scanner) (*Key, error) {
 	var k Key
-	if err := row.Scan(&k.ID, &k.Label, &k.Algo, &k.KeyBytes, &k.CreatedAt); err != nil {
+	if err := row.Scan(&k.ID, &k.Label, &k.Algo, &k.KeyBytes, &k.WrappedBy, &k.Version, &k.Active, &k.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := d.unsealKey(&k); err != nil {
 		return nil, err
 	}
 	return &k, nil
 }
 
-// PutKey inserts or replaces a key.
+func (d *DB) queryKeys(ctx context.Context, query string, args ...any) ([]Key, error) {
+	rows, err := d.sql.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Key
+	for rows.Next() {
+		k, err := d.scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *k)
+	}
+	return out, rows.Err()
+}
+
+// GetKey returns a key by id.
+func (d *DB) GetKey(ctx context.Context, id string) (*Key, error) {
+	return d.scanKey(d.sql.QueryRowContext(ctx, `
+		SELECT `+keyColumns+` FROM keys WHERE id=?
+	`, id))
+}
+
+// PutKey inserts or replaces a key. A key that is not wrapped by another
+// one is sealed under the passphrase, if there is one.
 func (d *DB) PutKey(ctx context.Context, k Key) error {
-	_, err := d.sql.ExecContext(ctx, `
-		INSERT INTO keys(id,label,algo,key_bytes,created_at)
-		VALUES(?,?,?,?,CURRENT_TIMESTAMP)
+	keyBytes, wrappedBy, err := d.sealKey(ctx, d.sql, k)
+	if err != nil {
+		return err
+	}
+	_, err = d.sql.ExecContext(ctx, `
+		INSERT INTO keys(id,label,algo,key_bytes,wrapped_by,version,active,created_at)
+		VALUES(?,?,?,?,?,?,?,CURRENT_TIMESTAMP)
 		ON CONFLICT(id) DO UPDATE SET
 			label=excluded.label,
 			algo=excluded.algo,
-			key_bytes=excluded.key_bytes
-	`, k.ID, k.Label, k.Algo, k.KeyBytes)
+			key_bytes=excluded.key_bytes,
+			wrapped_by=excluded.wrapped_by,
+			version=excluded.version,
+			active=excluded.active
+	`, k.ID, k.Label, k.Algo, keyBytes, wrappedBy, k.Version, k.Active)
+	return err
+}
+
+// GetFileKey returns the key one of our files is encrypted with: its
+// wrapped data key, or for files stored before they had their own data key,
+// the master key they were encrypted with directly. The key linked first
+// wins. It returns sql.ErrNoRows for files without either.
+func (d *DB) GetFileKey(ctx context.Context, fileID string) (*Key, error) {
+	return d.scanKey(d.sql.QueryRowContext(ctx, `
+		SELECT k.id,k.label,k.algo,k.key_bytes,k.wrapped_by,k.version,k.active,k.created_at
+		FROM file_keys fk JOIN keys k ON k.id=fk.key_id
+		WHERE fk.file_id=? AND (k.version>0 OR k.wrapped_by NOT IN ('', ?))
+		ORDER BY k.version=0 DESC, fk.rowid LIMIT 1
+	`, fileID, SealedByPassphrase))
+}
+
+// GetSharedKey returns the wrapped data key of a file shared with us, the
+// one shared first if several nodes shared a file with this id. It returns
+// sql.ErrNoRows if no node did.
+func (d *DB) GetSharedKey(ctx context.Context, fileID string) (*Key, error) {
+	return d.scanKey(d.sql.QueryRowContext(ctx, `
+		SELECT k.id,k.label,k.algo,k.key_bytes,k.wrapped_by,k.version,k.active,k.created_at
+		FROM shared_keys sk JOIN keys k ON k.id=sk.key_id
+		WHERE sk.file_id=?
+		ORDER BY sk.rowid LIMIT 1
+	`, fileID))
+}
+
+// PutSharedKey stores the wrapped data key of a file a peer shared with us,
+// replacing the one the same peer shared before.
+func (d *DB) PutSharedKey(ctx context.Context, fileID, peerID string, k Key) error {
+	tx, err := d.sql.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var old string
+	err = tx.QueryRowContext(ctx, `
+		SELECT key_id FROM shared_keys WHERE file_id=? AND peer_id=?
+	`, fileID, peerID).Scan(&old)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO keys(id,label,algo,key_bytes,wrapped_by,created_at)
+		VALUES(?,?,?,?,?,CURRENT_TIMESTAMP)
+	`, k.ID, k.Label, k.Algo, k.KeyBytes, k.WrappedBy); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO shared_keys(file_id,peer_id,key_id)
+		VALUES(?,?,?)
+		ON CONFLICT(file_id,peer_id) DO UPDATE SET key_id=excluded.key_id
+	`, fileID, peerID, k.ID); err != nil {
+		return err
+	}
+	if old != "" {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM keys WHERE id=?`, old); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PutFileKey stores the wrapped data key of a file and links it to the file.
+func (d *DB) PutFileKey(ctx context.Context, fileID string, k Key) error {
+	tx, err := d.sql.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO keys(id,label,algo,key_bytes,wrapped_by,created_at)
+		VALUES(?,?,?,?,?,CURRENT_TIMESTAMP)
+	`, k.ID, k.Label, k.Algo, k.KeyBytes, k.WrappedBy); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT OR IGNORE INTO file_keys(file_id,key_id)
+		VALUES(?,?)
+	`, fileID, k.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnlinkFileKey removes the link between a file and a key.
+func (d *DB) UnlinkFileKey(ctx context.Context, fileID, keyID string) error {
+	_, err := d.sql.ExecContext(ctx, `
+		DELETE FROM file_keys WHERE file_id=? AND key_id=?
+	`, fileID, keyID)
 	return err
 }
 
-// GetOrCreateDefaultKey returns bytes for key id "default"; creates it if missing.
-func (d *DB) GetOrCreateDefaultKey(ctx context.Context, gen func() []byte) ([]byte, error) {
-	const id = "default"
-	k, err := d.GetKey(ctx, id)
+// GetActiveKey returns the master key new data keys are wrapped with.
+func (d *DB) GetActiveKey(ctx context.Context) (*Key, error) {
+	return d.scanKey(d.sql.QueryRowContext(ctx, `
+		SELECT `+keyColumns+` FROM keys WHERE active=1
+	`))
+}
+
+// GetOrCreateActiveKey returns the active master key; creates it with id
+// "default" if there is none.
+func (d *DB) GetOrCreateActiveKey(ctx context.Context, gen func() []byte) (*Key, error) {
+	existing, err := d.GetActiveKey(ctx)
 	if err == nil {
-		return k.KeyBytes, nil
+		return existing, nil
 	}
-	// If not found, create.
-	keyBytes := gen()
-	if err := d.PutKey(ctx, Key{
-		ID:       id,
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	k := Key{
+		ID:       "default",
 		Label:    "default",
-		Algo:     "AES-CTR-256",
+		Algo:     "AES-256-GCM",
+		KeyBytes: gen(),
+		Version:  1,
+		Active:   true,
+	}
+	if err := d.PutKey(ctx, k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// RotateKey adds a master key as the next version and makes it the active
+// one. The previous master keys are kept until nothing refers to them.
+func (d *DB) RotateKey(ctx context.Context, algo string, keyBytes []byte) (*Key, error) {
+	tx, err := d.sql.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(version),0) FROM keys
+	`).Scan(&version); err != nil {
+		return nil, err
+	}
+	k := Key{
+		ID:       fmt.Sprintf("master-%d", version+1),
+		Label:    fmt.Sprintf("master key v%d", version+1),
+		Algo:     algo,
 		KeyBytes: keyBytes,
-	}); err != nil {
+		Version:  version + 1,
+		Active:   true,
+	}
+	sealed, wrappedBy, err := d.sealKey(ctx, tx, k)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE keys SET active=0 WHERE active=1
+	`); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO keys(id,label,algo,key_bytes,wrapped_by,version,active,created_at)
+		VALUES(?,?,?,?,?,?,?,CURRENT_TIMESTAMP)
+	`, k.ID, k.Label, k.Algo, sealed, wrappedBy, k.Version, k.Active); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
-	return keyBytes, nil
+	return &k, nil
+}
+
+// ListMasterKeys returns every version of the master key, oldest first.
+func (d *DB) ListMasterKeys(ctx context.Context) ([]Key, error) {
+	return d.queryKeys(ctx, `
+		SELECT `+keyColumns+` FROM keys WHERE version>0 ORDER BY version
+	`)
+}
+
+// ListStaleDataKeys returns the data keys wrapped by a master key other
+// than the active one.
+func (d *DB) ListStaleDataKeys(ctx context.Context) ([]Key, error) {
+	return d.queryKeys(ctx, `
+		SELECT `+keyColumns+` FROM keys
+		WHERE version=0 AND wrapped_by IN (SELECT id FROM keys WHERE version>0 AND active=0)
+	`)
+}
+
+// RewrapKey replaces the wrapped bytes of a key and the key wrapping them.
+func (d *DB) RewrapKey(ctx context.Context, id string, keyBytes []byte, wrappedBy string) error {
+	_, err := d.sql.ExecContext(ctx, `
+		UPDATE keys SET key_bytes=?, wrapped_by=? WHERE id=?
+	`, keyBytes, wrappedBy, id)
+	return err
+}
+
+// ListFilesUsingKey returns the files linked to a key in file_keys.
+func (d *DB) ListFilesUsingKey(ctx context.Context, keyID string) ([]File, error) {
+	return d.queryFiles(ctx, `
+		SELECT `+fileColumns+` FROM files
+		WHERE id IN (SELECT file_id FROM file_keys WHERE key_id=?) ORDER BY created_at
+	`, keyID)
+}
+
+// DeleteRetiredKeys deletes the master keys that are no longer active and
+// that no file and no data key refers to, and returns their ids.
+func (d *DB) DeleteRetiredKeys(ctx context.Context) ([]string, error) {
+	tx, err := d.sql.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id FROM keys
+		WHERE version>0 AND active=0
+			AND id NOT IN (SELECT key_id FROM file_keys)
+			AND id NOT IN (SELECT wrapped_by FROM keys)
+	`)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM keys WHERE id=?`, id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+// GetOrCreateIdentityKey returns the node's Ed25519 private key (key id
+// "identity"); creates it if missing.
+func (d *DB) GetOrCreateIdentityKey(ctx context.Context, gen func() []byte) ([]byte, error) {
+	existing, err := d.GetKey(ctx, "identity")
+	if err == nil {
+		return existing.KeyBytes, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	// If not found, create.
+	k := Key{
+		ID:       "identity",
+		Label:    "node identity",
+		Algo:     "Ed25519",
+		KeyBytes: gen(),
+	}
+	if err := d.PutKey(ctx, k); err != nil {
+		return nil, err
+	}
+	return k.KeyBytes, nil
+}
+
+// GetNamespaceKey returns the secret file identifiers are derived with
+// (key id "namespace"), nil if the node has none.
+func (d *DB) GetNamespaceKey(ctx context.Context) ([]byte, error) {
+	k, err := d.GetKey(ctx, "namespace")
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k.KeyBytes, nil
+}
+
+// SetNamespaceKey replaces the secret file identifiers are derived with.
+func (d *DB) SetNamespaceKey(ctx context.Context, secret []byte) error {
+	return d.PutKey(ctx, Key{
+		ID:       "namespace",
+		Label:    "file namespace",
+		Algo:     "HMAC-SHA256",
+		KeyBytes: secret,
+	})
+}
+
+// AddShare records that a peer holds a replica of a file, or that we hold
+// one for it. Recording the same share twice is a no-op.
+func (d *DB) AddShare(ctx context.Context, sh Share) error {
+	if sh.ID == "" {
+		sh.ID = sh.FileID + "/" + sh.PeerID + "/" + sh.Direction
+	}
+	_, err := d.sql.ExecContext(ctx, `
+		INSERT OR IGNORE INTO shares(id,file_id,peer_id,direction)
+		VALUES(?,?,?,?)
+	`, sh.ID, sh.FileID, sh.PeerID, sh.Direction)
+	return err
+}
+
+// ListShares returns the shares of a file in the given direction.
+func (d *DB) ListShares(ctx context.Context, fileID, direction string) ([]Share, error) {
+	return d.queryShares(ctx, `
+		SELECT id,file_id,peer_id,direction,created_at FROM shares
+		WHERE file_id=? AND direction=? ORDER BY created_at
+	`, fileID, direction)
+}
+
+// ListSharesByDirection returns the shares of all files in the given
+// direction.
+func (d *DB) ListSharesByDirection(ctx context.Context, direction string) ([]Share, error) {
+	return d.queryShares(ctx, `
+		SELECT id,file_id,peer_id,direction,created_at FROM shares
+		WHERE direction=? ORDER BY created_at
+	`, direction)
+}
+
+func (d *DB) queryShares(ctx context.Context, query string, args ...any) ([]Share, error) {
+	rows, err := d.sql.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Share
+	for rows.Next() {
+		var sh Share
+		if err := rows.Scan(&sh.ID, &sh.FileID, &sh.PeerID, &sh.Direction, &sh.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, sh)
+	}
+	return out, rows.Err()
+}
+
+func (d *DB) DeleteShare(ctx context.Context, fileID, peerID, direction string) error {
+	_, err := d.sql.ExecContext(ctx, `
+		DELETE FROM shares WHERE file_id=? AND peer_id=? AND direction=?
+	`, fileID, peerID, direction)
+	return err
+}
+
+// DeleteShares forgets every share of a file.
+func (d *DB) DeleteShares(ctx context.Context, fileID string) error {
+	_, err := d.sql.ExecContext(ctx, `
+		DELETE FROM shares WHERE file_id=?
+	`, fileID)
+	return err
 }
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// TrustedPeer is a node allowed to connect. PublicKey is the hex of its
+// Ed25519 public key.
+type TrustedPeer struct {
+	PublicKey string
+	CreatedAt time.Time
+}
+
+// TrustPeer allows the node with publicKey to connect.
+func (d *DB) TrustPeer(ctx context.Context, publicKey string) error {
+	_, err := d.sql.ExecContext(ctx, `
+		INSERT OR IGNORE INTO trusted_peers(public_key) VALUES(?)
+	`, publicKey)
+	return err
+}
+
+// UntrustPeer stops allowing the node with publicKey to connect. It
+// reports whether the node was trusted.
+func (d *DB) UntrustPeer(ctx context.Context, publicKey string) (bool, error) {
+	res, err := d.sql.ExecContext(ctx, `
+		DELETE FROM trusted_peers WHERE public_key=?
+	`, publicKey)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// IsTrustedPeer reports whether the node with publicKey is allowed to
+// connect.
+func (d *DB) IsTrustedPeer(ctx context.Context, publicKey string) (bool, error) {
+	var n int
+	if err := d.sql.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM trusted_peers WHERE public_key=?
+	`, publicKey).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (d *DB) ListTrustedPeers(ctx context.Context) ([]TrustedPeer, error) {
+	rows, err := d.sql.QueryContext(ctx, `
+		SELECT public_key,created_at FROM trusted_peers ORDER BY created_at, public_key
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []TrustedPeer
+	for rows.Next() {
+		var p TrustedPeer
+		if err := rows.Scan(&p.PublicKey, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
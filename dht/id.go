@@ -0,0 +1,95 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+)
+
+// IDLength is the length of node ids and keys in bytes. Node ids are the
+// sha256 of the node identity (see p2p.NodeID), keys are hashed into the
+// same space with HashKey.
+const IDLength = sha256.Size
+
+// ID is a point in the 256 bit XOR metric space shared by nodes and keys.
+type ID [IDLength]byte
+
+func ParseID(s string) (ID, error) {
+	var id ID
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != IDLength {
+		return id, fmt.Errorf("dht: id must be %d bytes, got %d", IDLength, len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// HashKey maps an arbitrary key onto the id space.
+func HashKey(key string) ID {
+	return sha256.Sum256([]byte(key))
+}
+
+func RandomID() ID {
+	var id ID
+	rand.Read(id[:])
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Xor returns the distance between two ids.
+func (id ID) Xor(other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to target than b.
+func closer(target, a, b ID) bool {
+	da, db := target.Xor(a), target.Xor(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// commonPrefixLen returns the number of leading bits a and b share, which is
+// also the index of the bucket b belongs to in a's routing table.
+func commonPrefixLen(a, b ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return IDLength * 8
+}
+
+// randomIDInBucket returns a random id that shares exactly prefix leading
+// bits with self, used to refresh the bucket with that index.
+func randomIDInBucket(self ID, prefix int) ID {
+	id := RandomID()
+	for i := 0; i < prefix; i++ {
+		setBit(&id, i, bit(self, i))
+	}
+	setBit(&id, prefix, !bit(self, prefix))
+	return id
+}
+
+func bit(id ID, i int) bool {
+	return id[i/8]&(0x80>>(i%8)) != 0
+}
+
+func setBit(id *ID, i int, v bool) {
+	if v {
+		id[i/8] |= 0x80 >> (i % 8)
+	} else {
+		id[i/8] &^= 0x80 >> (i % 8)
+	}
+}
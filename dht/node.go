@@ -0,0 +1,357 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultK is the bucket size and the number of nodes a key is stored on.
+	DefaultK = 20
+	// DefaultAlpha is the number of requests a lookup keeps in flight.
+	DefaultAlpha = 3
+	// DefaultRefreshInterval is how long a bucket may go without activity
+	// before Refresh looks up a random id in its range.
+	DefaultRefreshInterval = time.Hour
+)
+
+var (
+	ErrNoNodes  = errors.New("dht: no known nodes")
+	ErrNotFound = errors.New("dht: value not found")
+)
+
+// Network carries the four Kademlia RPCs to other nodes. Implementations
+// deliver them to the Handle* methods of the remote Node, passing our own
+// contact along so the remote can update its routing table.
+type Network interface {
+	Ping(ctx context.Context, to Contact) error
+	FindNode(ctx context.Context, to Contact, target ID) ([]Contact, error)
+	// FindValue returns the value if the remote holds it, closer contacts otherwise.
+	FindValue(ctx context.Context, to Contact, key ID) ([]byte, []Contact, error)
+	Store(ctx context.Context, to Contact, key ID, value []byte) error
+}
+
+// ValueStore holds the values this node is responsible for.
+type ValueStore interface {
+	Get(key ID) ([]byte, bool)
+	Put(key ID, value []byte)
+	Delete(key ID)
+}
+
+type NodeOpts struct {
+	Self    Contact
+	Network Network
+	// Values defaults to an in-memory store.
+	Values ValueStore
+	K      int
+	Alpha  int
+}
+
+// Node is a single participant of the DHT.
+type Node struct {
+	NodeOpts
+	table *RoutingTable
+}
+
+func NewNode(opts NodeOpts) *Node {
+	if opts.K == 0 {
+		opts.K = DefaultK
+	}
+	if opts.Alpha == 0 {
+		opts.Alpha = DefaultAlpha
+	}
+	if opts.Values == nil {
+		opts.Values = NewMemoryStore()
+	}
+	return &Node{
+		NodeOpts: opts,
+		table:    NewRoutingTable(opts.Self.ID, opts.K),
+	}
+}
+
+func (n *Node) Table() *RoutingTable {
+	return n.table
+}
+
+// Observe records that we heard from c. When c's bucket is full the least
+// recently seen contact is pinged and only evicted if it does not answer.
+func (n *Node) Observe(c Contact) {
+	oldest, ok := n.table.Update(c)
+	if ok {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := n.Network.Ping(ctx, oldest); err != nil {
+			n.table.Replace(oldest, c)
+			return
+		}
+		n.table.Update(oldest)
+	}()
+}
+
+func (n *Node) HandlePing(from Contact) {
+	n.Observe(from)
+}
+
+func (n *Node) HandleFindNode(from Contact, target ID) []Contact {
+	n.Observe(from)
+	return n.closestExcept(target, from.ID)
+}
+
+func (n *Node) HandleFindValue(from Contact, key ID) ([]byte, []Contact) {
+	n.Observe(from)
+	if value, ok := n.Values.Get(key); ok {
+		return value, nil
+	}
+	return nil, n.closestExcept(key, from.ID)
+}
+
+func (n *Node) HandleStore(from Contact, key ID, value []byte) {
+	n.Observe(from)
+	n.Values.Put(key, value)
+}
+
+func (n *Node) closestExcept(target, except ID) []Contact {
+	contacts := n.table.Closest(target, n.K+1)
+	out := contacts[:0]
+	for _, c := range contacts {
+		if c.ID != except {
+			out = append(out, c)
+		}
+	}
+	if len(out) > n.K {
+		out = out[:n.K]
+	}
+	return out
+}
+
+// Bootstrap adds the seed contacts and looks up our own id, which fills the
+// routing table with the nodes around us and announces us to them. The
+// buckets further away than our closest neighbour are refreshed as well, so
+// we know nodes in every part of the key space.
+func (n *Node) Bootstrap(ctx context.Context, seeds ...Contact) error {
+	for _, c := range seeds {
+		n.table.Update(c)
+	}
+	if n.table.Len() == 0 {
+		return ErrNoNodes
+	}
+	closest, err := n.Lookup(ctx, n.Self.ID)
+	if err != nil || len(closest) == 0 {
+		return err
+	}
+	for i := range commonPrefixLen(n.Self.ID, closest[0].ID) {
+		if _, err := n.Lookup(ctx, randomIDInBucket(n.Self.ID, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refresh looks up a random id in every bucket that has been quiet for
+// longer than interval, so the buckets stay populated with live nodes.
+func (n *Node) Refresh(ctx context.Context, interval time.Duration) {
+	for _, i := range n.table.staleBuckets(interval) {
+		if ctx.Err() != nil {
+			return
+		}
+		n.Lookup(ctx, randomIDInBucket(n.Self.ID, i))
+	}
+}
+
+// Lookup returns the k nodes closest to target, not including ourselves.
+func (n *Node) Lookup(ctx context.Context, target ID) ([]Contact, error) {
+	res, err := n.iterate(ctx, target, false)
+	return res.closest, err
+}
+
+// FindValue looks up the value stored under key. It returns the value and
+// the contact holding it, or ErrNotFound together with the k closest nodes.
+func (n *Node) FindValue(ctx context.Context, key ID) ([]byte, Contact, []Contact, error) {
+	if value, ok := n.Values.Get(key); ok {
+		return value, n.Self, nil, nil
+	}
+	res, err := n.iterate(ctx, key, true)
+	if err != nil {
+		return nil, Contact{}, res.closest, err
+	}
+	if res.value == nil {
+		return nil, Contact{}, res.closest, ErrNotFound
+	}
+	return res.value, res.holder, res.closest, nil
+}
+
+// Put stores value on the k nodes closest to key and returns the ones that
+// accepted it.
+func (n *Node) Put(ctx context.Context, key ID, value []byte) ([]Contact, error) {
+	closest, err := n.Lookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		stored []Contact
+	)
+	for _, c := range closest {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			if err := n.Network.Store(ctx, c, key, value); err != nil {
+				return
+			}
+			mu.Lock()
+			stored = append(stored, c)
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	if len(stored) == 0 && len(closest) > 0 {
+		return nil, errors.New("dht: no node accepted the value")
+	}
+	return stored, nil
+}
+
+type lookupResult struct {
+	closest []Contact
+	value   []byte
+	holder  Contact
+}
+
+type queryResult struct {
+	from     Contact
+	contacts []Contact
+	value    []byte
+	err      error
+}
+
+// iterate runs the iterative Kademlia lookup: keep alpha requests in flight
+// to the closest contacts we have not asked yet, merge what they return, and
+// stop once the k closest contacts we know of have all answered.
+func (n *Node) iterate(ctx context.Context, target ID, findValue bool) (lookupResult, error) {
+	shortlist := n.table.Closest(target, n.K)
+	if len(shortlist) == 0 {
+		return lookupResult{}, ErrNoNodes
+	}
+
+	seen := map[ID]bool{n.Self.ID: true}
+	for _, c := range shortlist {
+		seen[c.ID] = true
+	}
+	queried := map[ID]bool{}
+	failed := map[ID]bool{}
+	results := make(chan queryResult)
+	inFlight := 0
+
+	for {
+		// the k closest contacts that did not fail
+		var candidates []Contact
+		for _, c := range shortlist {
+			if !failed[c.ID] {
+				candidates = append(candidates, c)
+			}
+			if len(candidates) == n.K {
+				break
+			}
+		}
+
+		for _, c := range candidates {
+			if inFlight >= n.Alpha {
+				break
+			}
+			if queried[c.ID] {
+				continue
+			}
+			queried[c.ID] = true
+			inFlight++
+			go func(c Contact) {
+				res := queryResult{from: c}
+				if findValue {
+					res.value, res.contacts, res.err = n.Network.FindValue(ctx, c, target)
+				} else {
+					res.contacts, res.err = n.Network.FindNode(ctx, c, target)
+				}
+				results <- res
+			}(c)
+		}
+
+		if inFlight == 0 {
+			return lookupResult{closest: candidates}, nil
+		}
+
+		var res queryResult
+		select {
+		case res = <-results:
+			inFlight--
+		case <-ctx.Done():
+			// drain in the background so the senders do not leak
+			go func(pending int) {
+				for range pending {
+					<-results
+				}
+			}(inFlight)
+			return lookupResult{closest: candidates}, ctx.Err()
+		}
+
+		if res.err != nil {
+			failed[res.from.ID] = true
+			n.table.Remove(res.from.ID)
+			continue
+		}
+		n.Observe(res.from)
+
+		if res.value != nil {
+			go func(pending int) {
+				for range pending {
+					<-results
+				}
+			}(inFlight)
+			return lookupResult{closest: candidates, value: res.value, holder: res.from}, nil
+		}
+
+		for _, c := range res.contacts {
+			if !seen[c.ID] {
+				seen[c.ID] = true
+				shortlist = append(shortlist, c)
+			}
+		}
+		sortByDistance(target, shortlist)
+	}
+}
+
+// MemoryStore is a ValueStore backed by a map.
+type MemoryStore struct {
+	mu     sync.Mutex
+	values map[ID][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: make(map[ID][]byte)}
+}
+
+func (m *MemoryStore) Get(key ID) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[key]
+	return v, ok
+}
+
+func (m *MemoryStore) Put(key ID, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = value
+}
+
+func (m *MemoryStore) Delete(key ID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, key)
+}
@@ -0,0 +1,223 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cluster wires nodes together in memory, every RPC is a direct method call.
+type cluster struct {
+	mu    sync.Mutex
+	nodes map[ID]*Node
+	down  map[ID]bool
+	// rpcs counts the requests made by lookups, not the pings that check
+	// whether the oldest contact of a full bucket is still alive
+	rpcs atomic.Int64
+}
+
+type memNetwork struct {
+	c    *cluster
+	self Contact
+}
+
+func (m memNetwork) node(to Contact) (*Node, error) {
+	m.c.mu.Lock()
+	defer m.c.mu.Unlock()
+	n, ok := m.c.nodes[to.ID]
+	if !ok || m.c.down[to.ID] {
+		return nil, errors.New("unreachable")
+	}
+	return n, nil
+}
+
+func (m memNetwork) Ping(ctx context.Context, to Contact) error {
+	n, err := m.node(to)
+	if err != nil {
+		return err
+	}
+	n.HandlePing(m.self)
+	return nil
+}
+
+func (m memNetwork) FindNode(ctx context.Context, to Contact, target ID) ([]Contact, error) {
+	m.c.rpcs.Add(1)
+	n, err := m.node(to)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleFindNode(m.self, target), nil
+}
+
+func (m memNetwork) FindValue(ctx context.Context, to Contact, key ID) ([]byte, []Contact, error) {
+	m.c.rpcs.Add(1)
+	n, err := m.node(to)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, contacts := n.HandleFindValue(m.self, key)
+	return value, contacts, nil
+}
+
+func (m memNetwork) Store(ctx context.Context, to Contact, key ID, value []byte) error {
+	m.c.rpcs.Add(1)
+	n, err := m.node(to)
+	if err != nil {
+		return err
+	}
+	n.HandleStore(m.self, key, value)
+	return nil
+}
+
+func newCluster(t *testing.T, size, k int) (*cluster, []*Node) {
+	c := &cluster{
+		nodes: make(map[ID]*Node),
+		down:  make(map[ID]bool),
+	}
+	var nodes []*Node
+	for i := range size {
+		self := Contact{ID: RandomID(), Addr: fmt.Sprintf("node-%d", i)}
+		n := NewNode(NodeOpts{
+			Self:    self,
+			Network: memNetwork{c: c, self: self},
+			K:       k,
+		})
+		c.mu.Lock()
+		c.nodes[self.ID] = n
+		c.mu.Unlock()
+		nodes = append(nodes, n)
+	}
+
+	// everybody joins through the first node
+	for _, n := range nodes[1:] {
+		assert.Nil(t, n.Bootstrap(context.Background(), nodes[0].Self))
+	}
+	return c, nodes
+}
+
+// closestByBruteForce returns the ids of the k nodes closest to target.
+func closestByBruteForce(nodes []*Node, target ID, k int) []ID {
+	var all []Contact
+	for _, n := range nodes {
+		all = append(all, n.Self)
+	}
+	sortByDistance(target, all)
+	var ids []ID
+	for _, c := range all[:k] {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func contactIDs(contacts []Contact) []ID {
+	var ids []ID
+	for _, c := range contacts {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func TestLookupFindsClosestNodes(t *testing.T) {
+	const k = 8
+	c, nodes := newCluster(t, 64, k)
+
+	for i := range 10 {
+		target := HashKey(fmt.Sprintf("file-%d", i))
+		from := nodes[i*5]
+
+		c.rpcs.Store(0)
+		closest, err := from.Lookup(context.Background(), target)
+		assert.Nil(t, err)
+
+		// the querying node is never part of its own result
+		expected := closestByBruteForce(nodes, target, k+1)
+		expected = deleteID(expected, from.Self.ID)[:k]
+		assert.Equal(t, expected, contactIDs(closest))
+
+		// a lookup should touch a small part of the network, not all of it
+		assert.Less(t, c.rpcs.Load(), int64(len(nodes)))
+	}
+}
+
+func TestPutAndFindValue(t *testing.T) {
+	const k = 5
+	c, nodes := newCluster(t, 48, k)
+
+	key := HashKey("coolpicture.jpg")
+	stored, err := nodes[3].Put(context.Background(), key, []byte("holder"))
+	assert.Nil(t, err)
+	assert.Len(t, stored, k)
+
+	// only the k closest nodes hold the value
+	holders := 0
+	for _, n := range nodes {
+		if _, ok := n.Values.Get(key); ok {
+			holders++
+		}
+	}
+	assert.Equal(t, k, holders)
+
+	// take one of the holders down, the value is still found from anywhere
+	c.mu.Lock()
+	c.down[stored[0].ID] = true
+	c.mu.Unlock()
+
+	for _, n := range nodes {
+		if c.down[n.Self.ID] {
+			continue
+		}
+		value, _, _, err := n.FindValue(context.Background(), key)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("holder"), value)
+	}
+
+	_, _, _, err = nodes[0].FindValue(context.Background(), HashKey("missing"))
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestBucketEvictsOnlyDeadContacts(t *testing.T) {
+	c, nodes := newCluster(t, 2, 1)
+	self := nodes[0]
+
+	// find a contact for the bucket the second node lives in
+	bucketOf := commonPrefixLen(self.Self.ID, nodes[1].Self.ID)
+	newcomer := Contact{ID: randomIDInBucket(self.Self.ID, bucketOf), Addr: "newcomer"}
+
+	// the existing contact answers pings, so it stays
+	self.Observe(newcomer)
+	waitForTable(t, self, func(ids []ID) bool { return len(ids) == 1 && ids[0] == nodes[1].Self.ID })
+
+	// once it is down, the newcomer takes its place
+	c.mu.Lock()
+	c.down[nodes[1].Self.ID] = true
+	c.mu.Unlock()
+	self.Observe(newcomer)
+	waitForTable(t, self, func(ids []ID) bool { return len(ids) == 1 && ids[0] == newcomer.ID })
+}
+
+func waitForTable(t *testing.T, n *Node, cond func([]ID) bool) {
+	t.Helper()
+	for range 1000 {
+		if cond(contactIDs(n.table.Closest(n.Self.ID, 100))) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("routing table never reached the expected state")
+}
+
+func deleteID(ids []ID, id ID) []ID {
+	out := ids[:0]
+	for _, x := range ids {
+		if x != id {
+			out = append(out, x)
+		}
+	}
+	return out
+}
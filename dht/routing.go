@@ -0,0 +1,145 @@
+package dht
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Contact is everything needed to reach a node.
+type Contact struct {
+	ID   ID
+	Addr string
+}
+
+// RoutingTable keeps up to k contacts per bucket, bucket i holding the
+// contacts that share exactly i leading bits with our own id. Within a
+// bucket contacts are ordered least recently seen first.
+type RoutingTable struct {
+	self ID
+	k    int
+
+	mu      sync.Mutex
+	buckets [IDLength * 8]bucket
+}
+
+type bucket struct {
+	contacts    []Contact
+	lastChanged time.Time
+}
+
+func NewRoutingTable(self ID, k int) *RoutingTable {
+	return &RoutingTable{
+		self: self,
+		k:    k,
+	}
+}
+
+// Update records that we heard from c. It reports false together with the
+// least recently seen contact of the bucket when the bucket is full; the
+// caller should ping that contact and call Replace if it does not answer.
+func (rt *RoutingTable) Update(c Contact) (Contact, bool) {
+	if c.ID == rt.self {
+		return Contact{}, true
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := &rt.buckets[commonPrefixLen(rt.self, c.ID)]
+	b.lastChanged = time.Now()
+
+	if i := b.index(c.ID); i >= 0 {
+		// move to the tail, the address may have changed too
+		b.contacts = append(slices.Delete(b.contacts, i, i+1), c)
+		return Contact{}, true
+	}
+
+	if len(b.contacts) < rt.k {
+		b.contacts = append(b.contacts, c)
+		return Contact{}, true
+	}
+
+	return b.contacts[0], false
+}
+
+// Replace evicts old in favour of c, if old is still in the table.
+func (rt *RoutingTable) Replace(old, c Contact) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := &rt.buckets[commonPrefixLen(rt.self, old.ID)]
+	if i := b.index(old.ID); i >= 0 {
+		b.contacts = append(slices.Delete(b.contacts, i, i+1), c)
+	}
+}
+
+func (rt *RoutingTable) Remove(id ID) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := &rt.buckets[commonPrefixLen(rt.self, id)]
+	if i := b.index(id); i >= 0 {
+		b.contacts = slices.Delete(b.contacts, i, i+1)
+	}
+}
+
+// Closest returns up to n known contacts ordered by distance to target.
+func (rt *RoutingTable) Closest(target ID, n int) []Contact {
+	rt.mu.Lock()
+	var all []Contact
+	for i := range rt.buckets {
+		all = append(all, rt.buckets[i].contacts...)
+	}
+	rt.mu.Unlock()
+
+	sortByDistance(target, all)
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func (rt *RoutingTable) Len() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	n := 0
+	for i := range rt.buckets {
+		n += len(rt.buckets[i].contacts)
+	}
+	return n
+}
+
+// staleBuckets returns the indexes of non empty buckets that have not
+// changed for longer than age.
+func (rt *RoutingTable) staleBuckets(age time.Duration) []int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var stale []int
+	for i := range rt.buckets {
+		b := &rt.buckets[i]
+		if len(b.contacts) > 0 && time.Since(b.lastChanged) > age {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+func (b *bucket) index(id ID) int {
+	return slices.IndexFunc(b.contacts, func(c Contact) bool { return c.ID == id })
+}
+
+func sortByDistance(target ID, contacts []Contact) {
+	slices.SortFunc(contacts, func(a, b Contact) int {
+		switch {
+		case a.ID == b.ID:
+			return 0
+		case closer(target, a.ID, b.ID):
+			return -1
+		default:
+			return 1
+		}
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/TinySkillet/DecentralizedP2PStorage/dht"
+	"github.com/TinySkillet/DecentralizedP2PStorage/p2p"
+)
+
+const (
+	// dhtRequestTimeout bounds a single DHT RPC, including dialing the contact.
+	dhtRequestTimeout = 5 * time.Second
+	// dhtRefreshCheck is how often we look for stale buckets to refresh.
+	dhtRefreshCheck = 10 * time.Minute
+)
+
+// fileID is the position of a file in the DHT key space. The replicas of a
+// file live on the nodes closest to it.
+func fileID(hashedKey string) dht.ID {
+	return dht.HashKey(hashedKey)
+}
+
+// peerContact returns the DHT contact of a connected peer. Peers without a
+// node id in the DHT key space (e.g. from an unauthenticated transport)
+// take no part in the DHT.
+func peerContact(p p2p.Peer) (dht.Contact, bool) {
+	id, err := dht.ParseID(p.ID())
+	if err != nil {
+		return dht.Contact{}, false
+	}
+	return dht.Contact{ID: id, Addr: p.ListenAddr()}, true
+}
+
+// dhtNetwork carries the DHT RPCs as messages over our peer connections,
+// dialing contacts we are not connected to yet.
+type dhtNetwork struct {
+	s *FileServer
+}
+
+func (n dhtNetwork) Ping(ctx context.Context, to dht.Contact) error {
+	_, err := n.call(ctx, to, MessageDHTPing{})
+	return err
+}
+
+func (n dhtNetwork) FindNode(ctx context.Context, to dht.Contact, target dht.ID) ([]dht.Contact, error) {
+	resp, err := n.call(ctx, to, MessageDHTFindNode{Target: target})
+	return resp.Contacts, err
+}
+
+func (n dhtNetwork) FindValue(ctx context.Context, to dht.Contact, key dht.ID) ([]byte, []dht.Contact, error) {
+	resp, err := n.call(ctx, to, MessageDHTFindValue{Key: key})
+	return resp.Value, resp.Contacts, err
+}
+
+func (n dhtNetwork) Store(ctx context.Context, to dht.Contact, key dht.ID, value []byte) error {
+	_, err := n.call(ctx, to, MessageDHTStore{Key: key, Value: value})
+	return err
+}
+
+func (n dhtNetwork) call(ctx context.Context, to dht.Contact, payload any) (MessageDHTResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, dhtRequestTimeout)
+	defer cancel()
+
+	peerID, err := n.s.connect(ctx, to)
+	if err != nil {
+		return MessageDHTResponse{}, err
+	}
+
+	id, responses, done := n.s.newRequest(1)
+	defer done()
+
+	if err := n.s.send(peerID, &Message{ID: id, Payload: payload}); err != nil {
+		return MessageDHTResponse{}, err
+	}
+
+	select {
+	case resp := <-responses:
+		v, ok := resp.Payload.(MessageDHTResponse)
+		if !ok {
+			return MessageDHTResponse{}, fmt.Errorf("unexpected response %T from %s", resp.Payload, resp.From)
+		}
+		return v, nil
+	case <-ctx.Done():
+		return MessageDHTResponse{}, ctx.Err()
+	}
+}
+
+// connect returns the peer id of the given contact, dialing it first if we
+// are not connected to it yet.
+func (s *FileServer) connect(ctx context.Context, c dht.Contact) (string, error) {
+	id := c.ID.String()
+	if _, ok := s.peer(id); ok {
+		return id, nil
+	}
+	if c.Addr == "" {
+		return "", fmt.Errorf("no address known for node %s", id)
+	}
+
+	if err := s.Transport.Dial(c.Addr); err != nil {
+		return "", err
+	}
+
+	// the handshake runs in the background, wait for the peer to show up
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if _, ok := s.peer(id); ok {
+			return id, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return "", fmt.Errorf("connecting to %s at %s: %w", id, c.Addr, ctx.Err())
+		}
+	}
+}
+
+// connectAll connects to the given contacts in parallel and returns the peer
+// ids of the ones we reached, in the order of contacts.
+func (s *FileServer) connectAll(ctx context.Context, contacts []dht.Contact) []string {
+	ids := make([]string, len(contacts))
+
+	var wg sync.WaitGroup
+	for i, c := range contacts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := s.connect(ctx, c)
+			if err != nil {
+				log.Printf("[%s] %v\n", s.Transport.Address(), err)
+				return
+			}
+			ids[i] = id
+		}()
+	}
+	wg.Wait()
+
+	connected := ids[:0]
+	for _, id := range ids {
+		if id != "" {
+			connected = append(connected, id)
+		}
+	}
+	return connected
+}
+
+// closestPeers looks up the nodes closest to a file and connects to them.
+// It returns no peers, and no error, when we do not know any other node.
+func (s *FileServer) closestPeers(ctx context.Context, hashedKey string) ([]string, error) {
+	closest, err := s.dht.Lookup(ctx, fileID(hashedKey))
+	if errors.Is(err, dht.ErrNoNodes) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.connectAll(ctx, closest), nil
+}
+
+// maintainDHT announces us to the network once the bootstrap connections are
+// up and then keeps the routing table fresh until the server stops.
+func (s *FileServer) maintainDHT() {
+	if len(s.BootstrapNodes) != 0 {
+		if err := s.waitForPeers(5 * time.Second); err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := s.dht.Bootstrap(ctx); err != nil {
+				log.Printf("[%s] DHT bootstrap: %v\n", s.Transport.Address(), err)
+			}
+			cancel()
+		}
+	}
+
+	ticker := time.NewTicker(dhtRefreshCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			s.dht.Refresh(ctx, dht.DefaultRefreshInterval)
+			cancel()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// handleMessageDHT answers a DHT request from a peer.
+func (s *FileServer) handleMessageDHT(from string, id uint64, payload any) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not found in peer list", from)
+	}
+	contact, ok := peerContact(peer)
+	if !ok {
+		return fmt.Errorf("peer %s has no DHT node id", from)
+	}
+
+	var resp MessageDHTResponse
+	switch v := payload.(type) {
+	case MessageDHTPing:
+		s.dht.HandlePing(contact)
+	case MessageDHTFindNode:
+		resp.Contacts = s.dht.HandleFindNode(contact, v.Target)
+	case MessageDHTFindValue:
+		resp.Value, resp.Contacts = s.dht.HandleFindValue(contact, v.Key)
+	case MessageDHTStore:
+		s.dht.HandleStore(contact, v.Key, v.Value)
+	}
+
+	return s.send(from, &Message{ID: id, Payload: resp})
+}
+
+func init() {
+	gob.Register(MessageDHTPing{})
+	gob.Register(MessageDHTFindNode{})
+	gob.Register(MessageDHTFindValue{})
+	gob.Register(MessageDHTStore{})
+	gob.Register(MessageDHTResponse{})
+}
+
+type MessageDHTPing struct{}
+
+type MessageDHTFindNode struct {
+	Target dht.ID
+}
+
+type MessageDHTFindValue struct {
+	Key dht.ID
+}
+
+type MessageDHTStore struct {
+	Key   dht.ID
+	Value []byte
+}
+
+// MessageDHTResponse answers any of the DHT requests. Contacts are the
+// closest nodes the remote knows of, Value is set when a FindValue hit.
+type MessageDHTResponse struct {
+	Contacts []dht.Contact
+	Value    []byte
+}
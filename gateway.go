@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// The HTTP gateway gives services access to the files of a node:
+//
+//	PUT    /files/{key}  stores the request body as key
+//	GET    /files/{key}  fetches a file, locally or from the network
+//	HEAD   /files/{key}  the size and digest of a file
+//	DELETE /files/{key}  deletes a file locally and from its peers
+//	GET    /files        lists the files of the node
+//
+// Keys may contain slashes. The ETag of a file is its hex SHA-256 digest,
+// which X-Content-Sha256 carries as well.
+
+// HTTPHandler returns the handler of the HTTP gateway.
+func (s *FileServer) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /files", s.handleHTTPList)
+	mux.HandleFunc("PUT /files/{key...}", s.handleHTTPPut)
+	mux.HandleFunc("GET /files/{key...}", s.handleHTTPGet)
+	mux.HandleFunc("HEAD /files/{key...}", s.handleHTTPHead)
+	mux.HandleFunc("DELETE /files/{key...}", s.handleHTTPDelete)
+	return mux
+}
+
+// HTTPFile describes a file in the responses of the gateway.
+type HTTPFile struct {
+	Key    string `json:"key"`
+	ID     string `json:"id"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest,omitempty"`
+	// Replicas are the outcome of storing the file on its peers.
+	Replicas []HTTPReplica `json:"replicas,omitempty"`
+}
+
+type HTTPReplica struct {
+	Peer  string `json:"peer"`
+	Error string `json:"error,omitempty"`
+}
+
+func (s *FileServer) handleHTTPList(w http.ResponseWriter, r *http.Request) {
+	if s.DB == nil {
+		http.Error(w, "node has no database", http.StatusNotImplemented)
+		return
+	}
+	files, err := s.DB.ListFiles(r.Context())
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	list := make([]HTTPFile, len(files))
+	for i, f := range files {
+		list[i] = HTTPFile{Key: f.Name, ID: f.ID, Size: f.Size, Digest: f.Digest}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *FileServer) handleHTTPPut(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	existed := s.store.Has(key)
+	results, err := s.Store(key, requestBody{r.Body})
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	size, digest, err := s.localStat(key)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	f := HTTPFile{Key: key, ID: s.hashKey(key), Size: size, Digest: digest}
+	for _, res := range results {
+		f.Replicas = append(f.Replicas, HTTPReplica{Peer: res.Peer, Error: errorString(res.Err)})
+	}
+	status := http.StatusCreated
+	if existed {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, f)
+}
+
+func (s *FileServer) handleHTTPGet(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	_, fr, err := s.Get(r.Context(), key)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if c, ok := fr.(io.Closer); ok {
+		defer c.Close()
+	}
+	if digest, err := s.store.Digest(key); err == nil {
+		setDigest(w, digest)
+	}
+
+	// objects in the store can seek, which Range requests need
+	if rs, ok := fr.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(key), time.Time{}, rs)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, fr)
+}
+
+// handleHTTPHead answers with the size and the digest of a file. A file
+// that is only on the network is not fetched if the database knows them.
+func (s *FileServer) handleHTTPHead(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	size, digest, err := s.localStat(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		size, digest, err = s.networkStat(r.Context(), key)
+	}
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	setDigest(w, digest)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FileServer) handleHTTPDelete(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !s.store.Has(key) && !s.knownFile(r.Context(), key) {
+		http.Error(w, fmt.Sprintf("file '%s' not found", key), http.StatusNotFound)
+		return
+	}
+	if err := s.Delete(key); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// localStat returns the size and digest of the local copy of a file.
+func (s *FileServer) localStat(key string) (int64, string, error) {
+	if !s.store.Has(key) {
+		return 0, "", fs.ErrNotExist
+	}
+	size, r, err := s.store.Read(key)
+	if err != nil {
+		return 0, "", err
+	}
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+	digest, err := s.store.Digest(key)
+	return size, digest, err
+}
+
+// networkStat returns the size and digest of a file the node has no copy
+// of. Peers only know the size of their encrypted replica, the database
+// knows the size of our own files; files shared with us are fetched.
+func (s *FileServer) networkStat(ctx context.Context, key string) (int64, string, error) {
+	if s.DB != nil {
+		f, err := s.DB.GetFile(ctx, s.hashKey(key))
+		if err == nil {
+			if _, _, err := s.locateFile(ctx, f.Hash); err != nil {
+				return 0, "", err
+			}
+			return f.Size, f.Digest, nil
+		}
+	}
+
+	size, r, err := s.Get(ctx, key)
+	if err != nil {
+		return 0, "", err
+	}
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+	digest, err := s.store.Digest(key)
+	return size, digest, err
+}
+
+// knownFile tells if key is one of our files, stored on the network.
+func (s *FileServer) knownFile(ctx context.Context, key string) bool {
+	if s.DB == nil {
+		return false
+	}
+	_, err := s.DB.GetFile(ctx, s.hashKey(key))
+	return err == nil
+}
+
+func setDigest(w http.ResponseWriter, digest string) {
+	if digest == "" {
+		return
+	}
+	w.Header().Set("ETag", `"`+digest+`"`)
+	w.Header().Set("X-Content-Sha256", digest)
+}
+
+// httpError answers with the status code err calls for.
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrFileNotFound), errors.Is(err, fs.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, errCutShort):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrTampered), errors.Is(err, ErrCorrupt):
+		// a peer sent us a bad replica
+		status = http.StatusBadGateway
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Writing HTTP response: %v\n", err)
+	}
+}
+
+// requestBody keeps a request body cut short from ending like a complete
+// one: reading chunks, io.ErrUnexpectedEOF is the end of the file.
+type requestBody struct {
+	io.Reader
+}
+
+func (b requestBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = errCutShort
+	}
+	return n, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func httpDo(t *testing.T, method, url string, body io.Reader, header ...string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, body)
+	assert.Nil(t, err)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return resp, b
+}
+
+func TestHTTPGateway(t *testing.T) {
+	servers := newTestCluster(t, 2, func() FileServerOpts {
+		return FileServerOpts{
+			ReplicationFactor: 1,
+			DB:                newTestDB(t),
+		}
+	})
+	owner, holder := servers[0], servers[1]
+	srv := httptest.NewServer(owner.HTTPHandler())
+	defer srv.Close()
+	url := srv.URL + "/files/reports/2024.bin"
+	data := randomData(2, 300*1024)
+	digest := bytesHash(data)
+
+	resp, body := httpDo(t, http.MethodPut, url, bytes.NewReader(data))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var f HTTPFile
+	assert.Nil(t, json.Unmarshal(body, &f))
+	assert.Equal(t, HTTPFile{
+		Key:      "reports/2024.bin",
+		ID:       owner.hashKey("reports/2024.bin"),
+		Size:     int64(len(data)),
+		Digest:   digest,
+		Replicas: []HTTPReplica{{Peer: holder.Transport.ID()}},
+	}, f)
+	resp, _ = httpDo(t, http.MethodPut, url, bytes.NewReader(data))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = httpDo(t, http.MethodGet, url, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"`+digest+`"`, resp.Header.Get("ETag"))
+	assert.Equal(t, data, body)
+
+	resp, body = httpDo(t, http.MethodGet, url, nil, "Range", "bytes=100000-199999")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 100000-199999/"+strconv.Itoa(len(data)), resp.Header.Get("Content-Range"))
+	assert.Equal(t, data[100000:200000], body)
+
+	resp, body = httpDo(t, http.MethodGet, srv.URL+"/files", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var list []HTTPFile
+	assert.Nil(t, json.Unmarshal(body, &list))
+	assert.Equal(t, []HTTPFile{{Key: "reports/2024.bin", ID: f.ID, Size: f.Size, Digest: digest}}, list)
+
+	// without a local copy, the size is known without fetching the file
+	assert.Nil(t, owner.store.Delete("reports/2024.bin"))
+	resp, body = httpDo(t, http.MethodHead, url, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(data)), resp.Header.Get("Content-Length"))
+	assert.Equal(t, digest, resp.Header.Get("X-Content-Sha256"))
+	assert.Empty(t, body)
+	assert.False(t, owner.store.Has("reports/2024.bin"))
+
+	resp, body = httpDo(t, http.MethodGet, url, nil, "Range", "bytes=-10")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, data[len(data)-10:], body)
+
+	resp, _ = httpDo(t, http.MethodDelete, url, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	waitFor(t, func() bool { return !holder.store.Has(owner.hashKey("reports/2024.bin")) })
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		resp, _ = httpDo(t, method, url, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, method)
+	}
+	resp, _ = httpDo(t, http.MethodDelete, srv.URL+"/files/never-stored", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// a body cut short is not stored
+	_, err := owner.Store("cut.bin", requestBody{io.MultiReader(
+		bytes.NewReader(data[:1000]),
+		iotest.ErrReader(io.ErrUnexpectedEOF),
+	)})
+	assert.ErrorIs(t, err, errCutShort)
+	assert.False(t, owner.store.Has("cut.bin"))
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+)
+
+// DefaultKeyID is the id of the master key in the keys table.
+const DefaultKeyID = "default"
+
+// DefaultRekeyInterval is how often data keys wrapped by a retired master
+// key are moved to the active one.
+const DefaultRekeyInterval = time.Minute
+
+// dataKey is the key the replicas of a file are encrypted with.
+type dataKey struct {
+	ID   string
+	Algo string
+	Key  []byte
+	// WrappedBy is the master key the data key is wrapped with, empty when
+	// the key is a master key used directly.
+	WrappedBy string
+	// Legacy is set for files stored before they had data keys, whose
+	// replicas may predate authenticated encryption.
+	Legacy bool
+}
+
+// masterDataKey is used for files without a data key of their own: files
+// stored before data keys existed, and every file of a node without a
+// database to keep data keys in.
+func (s *FileServer) masterDataKey() dataKey {
+	return dataKey{ID: s.EncryptionKeyID, Algo: s.EncryptionAlgo, Key: s.EncryptionKey}
+}
+
+// activeKey returns the master key new data keys are wrapped with. The
+// master key may have been rotated since the node started, so the keys
+// table decides.
+func (s *FileServer) activeKey(ctx context.Context) (dataKey, error) {
+	if s.DB == nil {
+		return s.masterDataKey(), nil
+	}
+	k, err := s.DB.GetActiveKey(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.masterDataKey(), nil
+	}
+	if err != nil {
+		return dataKey{}, err
+	}
+	return dataKey{ID: k.ID, Algo: k.Algo, Key: k.KeyBytes}, nil
+}
+
+// masterKey returns the master key with the given id, the active one or a
+// retired one that still has data keys wrapped by it.
+func (s *FileServer) masterKey(ctx context.Context, id string) ([]byte, error) {
+	if id == s.EncryptionKeyID {
+		return s.EncryptionKey, nil
+	}
+	if s.DB == nil {
+		return nil, fmt.Errorf("unknown master key '%s'", id)
+	}
+	k, err := s.DB.GetKey(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("unknown master key '%s'", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k.KeyBytes, nil
+}
+
+// fileKey returns the data key of the file with the given (hashed) key:
+// our own, or the one another node shared with us.
+func (s *FileServer) fileKey(ctx context.Context, hashedKey string) (dataKey, error) {
+	if s.DB == nil {
+		return s.masterDataKey(), nil
+	}
+
+	dk, err := s.ownFileKey(ctx, hashedKey)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return dk, err
+	}
+	k, err := s.DB.GetSharedKey(ctx, hashedKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.masterDataKey(), nil
+	}
+	if err != nil {
+		return dataKey{}, err
+	}
+	return s.unwrapDataKey(ctx, k)
+}
+
+// ownFileKey returns the data key of one of our files, sql.ErrNoRows if
+// the file has none linked.
+func (s *FileServer) ownFileKey(ctx context.Context, hashedKey string) (dataKey, error) {
+	k, err := s.DB.GetFileKey(ctx, hashedKey)
+	if err != nil {
+		return dataKey{}, err
+	}
+	if k.Version > 0 {
+		// stored before files had data keys, with the master key of the time
+		key, err := s.masterKey(ctx, k.ID)
+		if err != nil {
+			return dataKey{}, err
+		}
+		return dataKey{ID: k.ID, Algo: k.Algo, Key: key, Legacy: true}, nil
+	}
+	return s.unwrapDataKey(ctx, k)
+}
+
+// unwrapDataKey unwraps a data key with the master key it is wrapped by.
+func (s *FileServer) unwrapDataKey(ctx context.Context, k *dbpkg.Key) (dataKey, error) {
+	kek, err := s.masterKey(ctx, k.WrappedBy)
+	if err != nil {
+		return dataKey{}, fmt.Errorf("data key %s: %w", k.ID, err)
+	}
+	dek, err := unwrapKey(kek, k.KeyBytes)
+	if err != nil {
+		return dataKey{}, fmt.Errorf("unwrapping data key %s: %w", k.ID, err)
+	}
+	return dataKey{ID: k.ID, Algo: k.Algo, Key: dek, WrappedBy: k.WrappedBy}, nil
+}
+
+// fileKeyForStore returns the data key to store a file with. A file keeps
+// its data key when it is stored again, so the chunks the versions share
+// deduplicate on peers. Other files, including files shared with us, get a
+// new random data key, which is kept wrapped by the active master key.
+func (s *FileServer) fileKeyForStore(ctx context.Context, key string) (dataKey, error) {
+	if s.DB == nil {
+		return s.masterDataKey(), nil
+	}
+
+	dk, err := s.ownFileKey(ctx, s.hashKey(key))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return dataKey{}, err
+	}
+	if dk.WrappedBy != "" {
+		return dk, nil
+	}
+	return s.newFileKey(ctx, key)
+}
+
+// newFileKey creates a data key for a file and links the file to it.
+func (s *FileServer) newFileKey(ctx context.Context, key string) (dataKey, error) {
+	dk, wrapped, err := s.wrapDataKey(ctx, key, s.EncryptionAlgo, newEcryptionKey())
+	if err != nil {
+		return dataKey{}, err
+	}
+	if err := s.DB.PutFileKey(ctx, s.hashKey(key), wrapped); err != nil {
+		return dataKey{}, err
+	}
+	return dk, nil
+}
+
+// wrapDataKey wraps dek with the active master key, for the keys table.
+func (s *FileServer) wrapDataKey(ctx context.Context, label, algo string, dek []byte) (dataKey, dbpkg.Key, error) {
+	kek, err := s.activeKey(ctx)
+	if err != nil {
+		return dataKey{}, dbpkg.Key{}, err
+	}
+
+	dk := dataKey{ID: newKeyID(), Algo: algo, Key: dek, WrappedBy: kek.ID}
+	wrapped, err := wrapKey(kek.Algo, kek.Key, dk.Key)
+	if err != nil {
+		return dataKey{}, dbpkg.Key{}, err
+	}
+	return dk, dbpkg.Key{
+		ID:        dk.ID,
+		Label:     label,
+		Algo:      dk.Algo,
+		KeyBytes:  wrapped,
+		WrappedBy: kek.ID,
+	}, nil
+}
+
+// rekeyLoop moves everything off retired master keys after the master key
+// is rotated. It runs every RekeyInterval.
+func (s *FileServer) rekeyLoop() {
+	if s.DB == nil {
+		return
+	}
+
+	ticker := time.NewTicker(s.RekeyInterval)
+	defer ticker.Stop()
+	for {
+		s.rekey()
+		select {
+		case <-ticker.C:
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// rekey rewraps the data keys wrapped by retired master keys with the
+// active one, re-encrypts the replicas of files stored with a master key
+// directly, and deletes the retired master keys nothing refers
+// to anymore.
+func (s *FileServer) rekey() {
+	ctx := context.Background()
+	active, err := s.activeKey(ctx)
+	if err != nil {
+		log.Printf("[%s] Rekey: %v\n", s.Transport.Address(), err)
+		return
+	}
+
+	stale, err := s.DB.ListStaleDataKeys(ctx)
+	if err != nil {
+		log.Printf("[%s] Rekey: listing data keys: %v\n", s.Transport.Address(), err)
+		return
+	}
+	for _, k := range stale {
+		if err := s.rewrapKey(ctx, k, active); err != nil {
+			log.Printf("[%s] Rekey of data key %s: %v\n", s.Transport.Address(), k.ID, err)
+		}
+	}
+
+	masters, err := s.DB.ListMasterKeys(ctx)
+	if err != nil {
+		log.Printf("[%s] Rekey: listing master keys: %v\n", s.Transport.Address(), err)
+		return
+	}
+	// files stored before data keys existed are encrypted with a master
+	// key directly, the oldest of them without authentication; they get
+	// a data key of their own even if the master key is the active one
+	for _, m := range masters {
+		files, err := s.DB.ListFilesUsingKey(ctx, m.ID)
+		if err != nil {
+			log.Printf("[%s] Rekey: listing files: %v\n", s.Transport.Address(), err)
+			return
+		}
+		for _, f := range files {
+			fctx, cancel := context.WithTimeout(ctx, repairFileTimeout)
+			if err := s.reencryptFile(fctx, f, m.ID); err != nil {
+				log.Printf("[%s] Rekey of '%s': %v\n", s.Transport.Address(), f.Name, err)
+			}
+			cancel()
+		}
+	}
+
+	deleted, err := s.DB.DeleteRetiredKeys(ctx)
+	if err != nil {
+		log.Printf("[%s] Rekey: deleting retired keys: %v\n", s.Transport.Address(), err)
+		return
+	}
+	for _, id := range deleted {
+		log.Printf("[%s] Deleted retired master key %s\n", s.Transport.Address(), id)
+	}
+}
+
+// rewrapKey wraps a data key with the active master key instead of the
+// retired one it is wrapped with. Only the keys table changes.
+func (s *FileServer) rewrapKey(ctx context.Context, k dbpkg.Key, active dataKey) error {
+	kek, err := s.masterKey(ctx, k.WrappedBy)
+	if err != nil {
+		return err
+	}
+	dek, err := unwrapKey(kek, k.KeyBytes)
+	if err != nil {
+		return err
+	}
+	wrapped, err := wrapKey(active.Algo, active.Key, dek)
+	if err != nil {
+		return err
+	}
+	return s.DB.RewrapKey(ctx, k.ID, wrapped, active.ID)
+}
+
+// reencryptFile gives a file that was encrypted with the master key
+// masterID directly a data key of its own, and sends the peers holding
+// its replicas new ones encrypted with it. Peers that do not take the new
+// replica are forgotten, so repair places a new one.
+func (s *FileServer) reencryptFile(ctx context.Context, f dbpkg.File, masterID string) error {
+	if !s.store.Has(f.Name) {
+		// fetching the file keeps a local copy of it
+		_, r, err := s.Get(ctx, f.Name)
+		if err != nil {
+			return err
+		}
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+	}
+
+	dk, err := s.newFileKey(ctx, f.Name)
+	if err != nil {
+		return err
+	}
+	shares, err := s.DB.ListShares(ctx, f.Hash, dbpkg.ShareOutbound)
+	if err != nil {
+		return err
+	}
+	for _, sh := range shares {
+		peer, err := s.connectPeer(ctx, sh.PeerID)
+		if err == nil {
+			err = s.storeOn(peer, f.Name, dk)
+		}
+		if err != nil {
+			log.Printf("[%s] Rekey of '%s' on %s: %v\n", s.Transport.Address(), f.Name, sh.PeerID, err)
+			if errors.Is(err, ErrNotManifest) {
+				// the local copy is at fault, not the peer: keep the
+				// shares and the old key so the next rekey tries again
+				return err
+			}
+			if err := s.DB.DeleteShare(ctx, f.Hash, sh.PeerID, dbpkg.ShareOutbound); err != nil {
+				return err
+			}
+			s.scheduleRepair()
+		}
+	}
+	return s.DB.UnlinkFileKey(ctx, f.Hash, masterID)
+}
+
+func newKeyID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// wrapKey encrypts a data key with a key encryption key.
+func wrapKey(algo string, kek, dek []byte) ([]byte, error) {
+	wrapped := new(bytes.Buffer)
+	if _, err := copyEncrypt(algo, kek, bytes.NewReader(dek), wrapped); err != nil {
+		return nil, err
+	}
+	return wrapped.Bytes(), nil
+}
+
+func unwrapKey(kek, wrapped []byte) ([]byte, error) {
+	dek := new(bytes.Buffer)
+	if _, err := copyDecrypt(kek, bytes.NewReader(wrapped), dek); err != nil {
+		return nil, err
+	}
+	return dek.Bytes(), nil
+}
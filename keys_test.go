@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilesGetTheirOwnDataKey(t *testing.T) {
+	servers := newTestCluster(t, 2, func() FileServerOpts {
+		return FileServerOpts{ReplicationFactor: 1}
+	})
+	owner := servers[0]
+	owner.DB = newTestDB(t)
+	ctx := context.Background()
+
+	data := []byte("the minutes of the meeting")
+	_, err := owner.Store("a.txt", bytes.NewReader(data))
+	assert.Nil(t, err)
+	_, err = owner.Store("b.txt", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	a, err := owner.DB.GetFileKey(ctx, owner.hashKey("a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultKeyID, a.WrappedBy)
+	b, err := owner.DB.GetFileKey(ctx, owner.hashKey("b.txt"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, a.ID, b.ID)
+
+	dk, err := owner.fileKey(ctx, owner.hashKey("a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, a.ID, dk.ID)
+	assert.Len(t, dk.Key, 32)
+	assert.NotEqual(t, owner.EncryptionKey, dk.Key)
+	assert.False(t, bytes.Contains(a.KeyBytes, dk.Key))
+
+	// storing a file again keeps its data key
+	_, err = owner.Store("a.txt", bytes.NewReader([]byte("the amended minutes")))
+	assert.Nil(t, err)
+	again, err := owner.DB.GetFileKey(ctx, owner.hashKey("a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, a.ID, again.ID)
+
+	assert.Nil(t, owner.store.Delete("b.txt"))
+	_, r, err := owner.Get(ctx, "b.txt")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestUnwrapKeyNeedsTheMasterKey(t *testing.T) {
+	kek, dek := newEcryptionKey(), newEcryptionKey()
+	wrapped, err := wrapKey(AlgoAES256GCM, kek, dek)
+	assert.Nil(t, err)
+
+	got, err := unwrapKey(kek, wrapped)
+	assert.Nil(t, err)
+	assert.Equal(t, dek, got)
+
+	_, err = unwrapKey(newEcryptionKey(), wrapped)
+	assert.ErrorIs(t, err, ErrTampered)
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	servers := newTestCluster(t, 2, func() FileServerOpts {
+		return FileServerOpts{ReplicationFactor: 1}
+	})
+	owner, peer := servers[0], servers[1]
+	ctx := context.Background()
+
+	// a file stored before files had data keys is encrypted with the
+	// master key itself, and kept locally as a single file
+	legacy := []byte("stored a long time ago")
+	writeSingleFileObject(t, owner.store, "legacy.txt", legacy)
+
+	d := newTestDB(t)
+	_, err := d.GetOrCreateActiveKey(ctx, func() []byte { return owner.EncryptionKey })
+	assert.Nil(t, err)
+	assert.Nil(t, d.InsertFileWithKey(ctx, dbpkg.File{
+		ID:   owner.hashKey("legacy.txt"),
+		Name: "legacy.txt",
+		Hash: owner.hashKey("legacy.txt"),
+		Size: int64(len(legacy)),
+	}, DefaultKeyID))
+	assert.Nil(t, d.AddShare(ctx, dbpkg.Share{
+		FileID:    owner.hashKey("legacy.txt"),
+		PeerID:    peer.Transport.ID(),
+		Direction: dbpkg.ShareOutbound,
+	}))
+	owner.DB = d
+
+	data := []byte("stored with a data key")
+	_, err = owner.Store("new.txt", bytes.NewReader(data))
+	assert.Nil(t, err)
+	before, err := d.GetFileKey(ctx, owner.hashKey("new.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultKeyID, before.WrappedBy)
+
+	rotated, err := d.RotateKey(ctx, AlgoAES256GCM, newEcryptionKey())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, rotated.Version)
+	owner.rekey()
+
+	// the data key stays the same, only its wrapping changes
+	after, err := d.GetFileKey(ctx, owner.hashKey("new.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, before.ID, after.ID)
+	assert.Equal(t, rotated.ID, after.WrappedBy)
+	assert.NotEqual(t, before.KeyBytes, after.KeyBytes)
+
+	// the legacy file got a data key of its own
+	k, err := d.GetFileKey(ctx, owner.hashKey("legacy.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, rotated.ID, k.WrappedBy)
+
+	// the peer took the new replica
+	shares, err := d.ListShares(ctx, owner.hashKey("legacy.txt"), dbpkg.ShareOutbound)
+	assert.Nil(t, err)
+	assert.Len(t, shares, 1)
+
+	// nothing refers to the old master key anymore
+	masters, err := d.ListMasterKeys(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, masters, 1)
+	assert.Equal(t, rotated.ID, masters[0].ID)
+
+	for name, want := range map[string][]byte{"legacy.txt": legacy, "new.txt": data} {
+		assert.Nil(t, owner.store.Delete(name))
+		_, r, err := owner.Get(ctx, name)
+		assert.Nil(t, err, name)
+		got, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got, name)
+	}
+}
+
+func TestRekeyMovesLegacyFilesToDataKeys(t *testing.T) {
+	servers := newTestCluster(t, 2, func() FileServerOpts {
+		return FileServerOpts{ReplicationFactor: 1}
+	})
+	owner := servers[0]
+	ctx := context.Background()
+
+	legacy := []byte("stored before data keys")
+	_, err := owner.Store("legacy.txt", bytes.NewReader(legacy))
+	assert.Nil(t, err)
+
+	d := newTestDB(t)
+	_, err = d.GetOrCreateActiveKey(ctx, func() []byte { return owner.EncryptionKey })
+	assert.Nil(t, err)
+	assert.Nil(t, d.InsertFileWithKey(ctx, dbpkg.File{
+		ID:   owner.hashKey("legacy.txt"),
+		Name: "legacy.txt",
+		Hash: owner.hashKey("legacy.txt"),
+		Size: int64(len(legacy)),
+	}, DefaultKeyID))
+	owner.DB = d
+
+	dk, err := owner.fileKey(ctx, owner.hashKey("legacy.txt"))
+	assert.Nil(t, err)
+	assert.True(t, dk.Legacy)
+
+	// the master key is still the active one
+	owner.rekey()
+	dk, err = owner.fileKey(ctx, owner.hashKey("legacy.txt"))
+	assert.Nil(t, err)
+	assert.False(t, dk.Legacy)
+	assert.Equal(t, DefaultKeyID, dk.WrappedBy)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+)
+
+// Files stored before file identifiers were derived with hashKey are known
+// by the MD5 of their name. The repair pass renames them: the files table
+// first, then the replicas on the peers holding them and the data keys of
+// the nodes we shared them with. A peer that cannot be told loses its
+// share, the next repair places a new replica under the new id.
+
+// migrateFile renames f to the identifier hashKey derives for it now and
+// returns it renamed.
+func (s *FileServer) migrateFile(ctx context.Context, f dbpkg.File) (dbpkg.File, error) {
+	newID := s.hashKey(f.Name)
+	if err := s.DB.RenameFile(ctx, f.ID, newID, s.store.FullPathForKey(f.Name)); err != nil {
+		return f, err
+	}
+	oldID := f.ID
+	f.ID, f.Hash = newID, newID
+	fmt.Printf("[%s] Renamed '%s' from %s to %s\n", s.Transport.Address(), f.Name, oldID, newID)
+
+	for _, direction := range []string{dbpkg.ShareOutbound, dbpkg.ShareGranted} {
+		shares, err := s.DB.ListShares(ctx, newID, direction)
+		if err != nil {
+			return f, err
+		}
+		for _, sh := range shares {
+			err := s.renameOn(ctx, sh.PeerID, oldID, newID)
+			if err == nil {
+				continue
+			}
+			log.Printf("[%s] Renaming '%s' on %s: %v\n", s.Transport.Address(), f.Name, sh.PeerID, err)
+			if direction == dbpkg.ShareOutbound {
+				if err := s.DB.DeleteShare(ctx, newID, sh.PeerID, direction); err != nil {
+					return f, err
+				}
+				s.scheduleRepair()
+			}
+		}
+	}
+	return f, nil
+}
+
+// renameOn tells a peer that a file it holds a replica or the data key of
+// is known as newID from now on.
+func (s *FileServer) renameOn(ctx context.Context, peer, oldID, newID string) error {
+	ctx, cancel := context.WithTimeout(ctx, dhtRequestTimeout)
+	defer cancel()
+
+	to, err := s.connectPeer(ctx, peer)
+	if err != nil {
+		return err
+	}
+
+	id, responses, done := s.newRequest(1)
+	defer done()
+	msg := Message{
+		ID:      id,
+		Payload: MessageRenameFile{Key: oldID, NewKey: newID},
+	}
+	if err := s.send(to, &msg); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-responses:
+		v, ok := resp.Payload.(MessageStoreFileResponse)
+		if !ok {
+			return fmt.Errorf("unexpected response %T", resp.Payload)
+		}
+		if v.Error != "" {
+			return errors.New(v.Error)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleMessageRenameFile renames the replica or data key we hold of
+// another node's file and reports the outcome to it.
+func (s *FileServer) handleMessageRenameFile(from string, id uint64, msg MessageRenameFile) error {
+	resp := MessageStoreFileResponse{Key: msg.NewKey}
+	err := s.renameFile(from, msg)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if sendErr := s.send(from, &Message{ID: id, Payload: resp}); sendErr != nil && err == nil {
+		return sendErr
+	}
+	return err
+}
+
+func (s *FileServer) renameFile(owner string, msg MessageRenameFile) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dhtRequestTimeout)
+	defer cancel()
+
+	if s.DB != nil {
+		var peers []string
+		for _, direction := range []string{dbpkg.ShareInbound, dbpkg.ShareReceived} {
+			shares, err := s.DB.ListShares(ctx, msg.Key, direction)
+			if err != nil {
+				return err
+			}
+			for _, sh := range shares {
+				peers = append(peers, sh.PeerID)
+			}
+		}
+		if !slices.Contains(peers, owner) {
+			return fmt.Errorf("we hold nothing of '%s' for %s", msg.Key, owner)
+		}
+		if err := s.DB.RenameFileRefs(ctx, msg.Key, msg.NewKey); err != nil {
+			return err
+		}
+	}
+
+	if !s.store.Has(msg.Key) {
+		// only the data key of a file shared with us
+		return nil
+	}
+	if err := s.store.Rename(msg.Key, msg.NewKey); err != nil {
+		return err
+	}
+
+	self := []byte(s.Transport.ID())
+	s.dht.Values.Delete(fileID(msg.Key))
+	s.dht.Values.Put(fileID(msg.NewKey), self)
+	// the nodes closest to the new id are not the ones the replica was
+	// placed on, point lookups arriving there at us
+	if _, err := s.dht.Put(ctx, fileID(msg.NewKey), self); err != nil {
+		log.Printf("[%s] Announcing replica %s: %v\n", s.Transport.Address(), msg.NewKey, err)
+	}
+	return nil
+}
+
+func init() {
+	gob.Register(MessageRenameFile{})
+}
+
+// MessageRenameFile tells the holder of a replica or a shared data key that
+// the file is known as NewKey from now on. It is answered with a
+// MessageStoreFileResponse.
+type MessageRenameFile struct {
+	Key    string
+	NewKey string
+}
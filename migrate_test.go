@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepairRenamesMD5FileIDs(t *testing.T) {
+	servers := newTestCluster(t, 3, func() FileServerOpts {
+		return FileServerOpts{
+			ReplicationFactor: 1,
+			DB:                newTestDB(t),
+			NamespaceKey:      []byte("the team's namespace"),
+		}
+	})
+	owner, name := servers[0], "old.txt"
+	ctx := context.Background()
+
+	data := []byte("stored when ids were MD5 hashes")
+	results, err := owner.Store(name, bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	var holder *FileServer
+	for _, s := range servers {
+		if s.Transport.ID() == results[0].Peer {
+			holder = s
+		}
+	}
+
+	// put everything back where it was before the ids changed
+	newID := owner.hashKey(name)
+	sum := md5.Sum([]byte(name))
+	oldID := hex.EncodeToString(sum[:])
+	assert.Nil(t, owner.DB.RenameFile(ctx, newID, oldID, owner.store.FullPathForKey(name)))
+	assert.Nil(t, holder.DB.RenameFileRefs(ctx, newID, oldID))
+	assert.Nil(t, holder.store.Rename(newID, oldID))
+
+	owner.repair()
+
+	files, err := owner.DB.ListFiles(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, newID, files[0].ID)
+	assert.Equal(t, []string{holder.Transport.ID()}, outboundShares(t, owner, name))
+	assert.True(t, holder.store.Has(newID))
+	assert.False(t, holder.store.Has(oldID))
+
+	assert.Nil(t, owner.store.Delete(name))
+	_, r, err := owner.Get(ctx, name)
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+}
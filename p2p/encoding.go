@@ -1,37 +1,102 @@
 package p2p
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+)
+
+// Every frame on the wire has the layout
+//
+//	[type: 1 byte][length: 4 bytes, big endian][payload: length bytes]
+//
+// The payload of a stream frame starts with the 4 byte stream id.
+const frameHeaderSize = 5
+
+// DefaultMaxFrameSize is the largest payload the DefaultDecoder accepts when
+// no MaxFrameSize is configured.
+const DefaultMaxFrameSize = 4 << 20 // 4 MiB
+
+var (
+	ErrFrameTooLarge    = errors.New("p2p: frame exceeds maximum frame size")
+	ErrUnknownFrameType = errors.New("p2p: unknown frame type")
 )
 
 type Decoder interface {
 	Decode(io.Reader, *RPC) error
 }
 
-type DefaultDecoder struct{}
+type DefaultDecoder struct {
+	// MaxFrameSize caps the payload length of a single frame.
+	// Zero means DefaultMaxFrameSize.
+	MaxFrameSize uint32
+}
 
 func (decoder DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
-
-	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
 		return err
 	}
 
-	// in case of a stream, we do not decode
-	stream := peekBuf[0] == IncomingStream
-	if stream {
-		msg.Stream = true
-		return nil
+	frameType := header[0]
+	length := binary.BigEndian.Uint32(header[1:])
+
+	var malformed bool
+	switch frameType {
+	case IncomingMessage, PeerHello:
+	case StreamData:
+		malformed = length < streamIDSize
+	case StreamOpen, StreamClose:
+		malformed = length != streamIDSize
+	case StreamWindow:
+		malformed = length != streamIDSize+4
+	default:
+		return fmt.Errorf("%w: 0x%x", ErrUnknownFrameType, frameType)
+	}
+	if malformed {
+		return fmt.Errorf("p2p: malformed stream frame 0x%x: unexpected length %d", frameType, length)
 	}
 
-	buf := make([]byte, 2028)
+	if length > decoder.maxFrameSize() {
+		return fmt.Errorf("%w: %d > %d bytes", ErrFrameTooLarge, length, decoder.maxFrameSize())
+	}
 
-	n, err := r.Read(buf)
-	if err != nil {
-		return err
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("p2p: truncated frame: %w", err)
 	}
 
-	msg.Payload = buf[:n]
+	msg.Type = frameType
+	msg.Payload = payload
 
 	return nil
 }
+
+func (decoder DefaultDecoder) maxFrameSize() uint32 {
+	if decoder.MaxFrameSize == 0 {
+		return DefaultMaxFrameSize
+	}
+	return decoder.MaxFrameSize
+}
+
+// WriteFrame writes a single frame of the given type to w. The header and the
+// payload are written with one Write call so concurrent writers on the same
+// connection cannot interleave inside a frame.
+func WriteFrame(w io.Writer, frameType byte, payload []byte) error {
+	if uint64(len(payload)) > math.MaxUint32 {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, frameHeaderSize+len(payload))
+	buf[0] = frameType
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,59 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeLargeSplitFrames(t *testing.T) {
+	first := bytes.Repeat([]byte("a"), 64*1024)
+	second := []byte("next frame")
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteFrame(buf, IncomingMessage, first))
+	assert.Nil(t, WriteFrame(buf, StreamClose, []byte{0, 0, 0, 1}))
+	assert.Nil(t, WriteFrame(buf, IncomingMessage, second))
+
+	// deliver the bytes one at a time, like a badly fragmented tcp stream
+	r := iotest.OneByteReader(buf)
+	decoder := DefaultDecoder{}
+
+	var msg RPC
+	assert.Nil(t, decoder.Decode(r, &msg))
+	assert.Equal(t, first, msg.Payload)
+
+	msg = RPC{}
+	assert.Nil(t, decoder.Decode(r, &msg))
+	assert.Equal(t, byte(StreamClose), msg.Type)
+
+	msg = RPC{}
+	assert.Nil(t, decoder.Decode(r, &msg))
+	assert.Equal(t, second, msg.Payload)
+}
+
+func TestDecodeRejectsMalformedFrames(t *testing.T) {
+	decoder := DefaultDecoder{MaxFrameSize: 16}
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteFrame(buf, IncomingMessage, make([]byte, 17)))
+	err := decoder.Decode(buf, &RPC{})
+	assert.True(t, errors.Is(err, ErrFrameTooLarge))
+
+	buf.Reset()
+	assert.Nil(t, WriteFrame(buf, 0x7f, []byte("x")))
+	err = decoder.Decode(buf, &RPC{})
+	assert.True(t, errors.Is(err, ErrUnknownFrameType))
+
+	buf.Reset()
+	assert.Nil(t, WriteFrame(buf, StreamOpen, []byte{1}))
+	assert.NotNil(t, decoder.Decode(buf, &RPC{}))
+
+	buf.Reset()
+	assert.Nil(t, WriteFrame(buf, IncomingMessage, []byte("truncated")))
+	buf.Truncate(buf.Len() - 3)
+	assert.NotNil(t, decoder.Decode(buf, &RPC{}))
+}
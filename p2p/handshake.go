@@ -1,7 +1,275 @@
 package p2p
 
-type HandshakeFunc func(any) error
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
 
-func NOPHandshakeFunc(any) error {
-	return nil
+// Handshake is the outcome of a successful handshake.
+type Handshake struct {
+	// Conn replaces the raw connection for all further traffic,
+	// e.g. with an encrypted session.
+	Conn net.Conn
+	// PublicKey is the authenticated identity of the remote node.
+	// It is nil when the handshake does not authenticate.
+	PublicKey ed25519.PublicKey
+}
+
+// HandshakeFunc runs on every new connection before the peer is handed to OnPeer.
+type HandshakeFunc func(conn net.Conn, outbound bool) (*Handshake, error)
+
+func NOPHandshakeFunc(conn net.Conn, outbound bool) (*Handshake, error) {
+	return &Handshake{Conn: conn}, nil
+}
+
+const (
+	handshakeVersion = 1
+	handshakeTimeout = 10 * time.Second
+	helloSize        = 1 + ed25519.PublicKeySize + 32
+
+	// maxRecordSize is the largest plaintext sealed into a single record.
+	maxRecordSize = 64 * 1024
+)
+
+var (
+	ErrHandshakeFailed = errors.New("p2p: handshake failed")
+	ErrRecordAuth      = errors.New("p2p: message authentication failed")
+	// ErrUntrustedPeer is returned by an AuthorizePeer hook refusing a
+	// peer it does not know.
+	ErrUntrustedPeer = errors.New("p2p: peer is not trusted")
+)
+
+// NewSecureHandshakeFunc returns a handshake that authenticates both sides
+// with their Ed25519 identities and encrypts the connection.
+//
+// Both sides send their identity and an ephemeral X25519 key, then sign the
+// transcript of both hellos. The X25519 shared secret is expanded with HKDF
+// into one AES-256-GCM key per direction.
+func NewSecureHandshakeFunc(identity ed25519.PrivateKey) HandshakeFunc {
+	return func(conn net.Conn, outbound bool) (*Handshake, error) {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		defer conn.SetDeadline(time.Time{})
+
+		hs, err := secureHandshake(conn, identity, outbound)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrHandshakeFailed, err)
+		}
+		return hs, nil
+	}
+}
+
+func secureHandshake(conn net.Conn, identity ed25519.PrivateKey, outbound bool) (*Handshake, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := make([]byte, 0, helloSize)
+	hello = append(hello, handshakeVersion)
+	hello = append(hello, identity.Public().(ed25519.PublicKey)...)
+	hello = append(hello, ephemeral.PublicKey().Bytes()...)
+
+	remoteHello, err := exchange(conn, hello, helloSize)
+	if err != nil {
+		return nil, err
+	}
+	if remoteHello[0] != handshakeVersion {
+		return nil, fmt.Errorf("unsupported handshake version %d", remoteHello[0])
+	}
+
+	remoteIdentity := ed25519.PublicKey(bytes.Clone(remoteHello[1 : 1+ed25519.PublicKeySize]))
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(remoteHello[1+ed25519.PublicKeySize:])
+	if err != nil {
+		return nil, err
+	}
+
+	// the transcript is always ordered dialer first, so both sides agree on it
+	transcript := sha256.New()
+	transcript.Write([]byte("p2p handshake v1"))
+	if outbound {
+		transcript.Write(hello)
+		transcript.Write(remoteHello)
+	} else {
+		transcript.Write(remoteHello)
+		transcript.Write(hello)
+	}
+	th := transcript.Sum(nil)
+
+	localRole, remoteRole := byte('R'), byte('I')
+	if outbound {
+		localRole, remoteRole = 'I', 'R'
+	}
+
+	sig := ed25519.Sign(identity, append([]byte{localRole}, th...))
+	remoteSig, err := exchange(conn, sig, ed25519.SignatureSize)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(remoteIdentity, append([]byte{remoteRole}, th...), remoteSig) {
+		return nil, errors.New("invalid signature from remote")
+	}
+
+	shared, err := ephemeral.ECDH(remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	dialerKey, err := hkdf.Key(sha256.New, shared, th, "p2p dialer to acceptor", 32)
+	if err != nil {
+		return nil, err
+	}
+	acceptorKey, err := hkdf.Key(sha256.New, shared, th, "p2p acceptor to dialer", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	sendKey, recvKey := acceptorKey, dialerKey
+	if outbound {
+		sendKey, recvKey = dialerKey, acceptorKey
+	}
+
+	sc, err := newSecureConn(conn, sendKey, recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Handshake{
+		Conn:      sc,
+		PublicKey: remoteIdentity,
+	}, nil
+}
+
+// exchange sends out while reading size bytes from the remote, which does
+// the same, so neither side depends on the connection buffering its write.
+func exchange(conn net.Conn, out []byte, size int) ([]byte, error) {
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(out)
+		writeErr <- err
+	}()
+
+	in := make([]byte, size)
+	if _, err := io.ReadFull(conn, in); err != nil {
+		return nil, err
+	}
+	if err := <-writeErr; err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// secureConn seals everything written to the connection into AES-GCM records
+//
+//	[length: 4 bytes, big endian][ciphertext + tag: length bytes]
+//
+// using a per-direction counter as nonce, so records cannot be
+// modified, replayed or reordered without Read failing.
+type secureConn struct {
+	net.Conn
+
+	writeLock sync.Mutex
+	send      cipher.AEAD
+	sendSeq   uint64
+
+	readLock sync.Mutex
+	recv     cipher.AEAD
+	recvSeq  uint64
+	readBuf  []byte
+}
+
+func newSecureConn(conn net.Conn, sendKey, recvKey []byte) (*secureConn, error) {
+	send, err := newGCM(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newGCM(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &secureConn{
+		Conn: conn,
+		send: send,
+		recv: recv,
+	}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *secureConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	written := 0
+	for written < len(b) {
+		n := min(len(b)-written, maxRecordSize)
+
+		record := make([]byte, 4, 4+n+c.send.Overhead())
+		record = c.send.Seal(record, seqNonce(c.sendSeq, c.send.NonceSize()), b[written:written+n], nil)
+		binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+		c.sendSeq++
+
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (c *secureConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if len(c.readBuf) == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+			return 0, err
+		}
+
+		length := binary.BigEndian.Uint32(header[:])
+		if length > uint32(maxRecordSize+c.recv.Overhead()) {
+			return 0, fmt.Errorf("p2p: record of %d bytes exceeds maximum record size", length)
+		}
+
+		record := make([]byte, length)
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			return 0, err
+		}
+
+		plaintext, err := c.recv.Open(record[:0], seqNonce(c.recvSeq, c.recv.NonceSize()), record, nil)
+		if err != nil {
+			return 0, ErrRecordAuth
+		}
+		c.recvSeq++
+		c.readBuf = plaintext
+	}
+
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func seqNonce(seq uint64, size int) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], seq)
+	return nonce
 }
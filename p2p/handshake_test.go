@@ -0,0 +1,79 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecureHandshake(t *testing.T) {
+	_, dialerKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, acceptorKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	type result struct {
+		hs  *Handshake
+		err error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		hs, err := NewSecureHandshakeFunc(acceptorKey)(b, false)
+		accepted <- result{hs, err}
+	}()
+
+	dialed, err := NewSecureHandshakeFunc(dialerKey)(a, true)
+	assert.Nil(t, err)
+	res := <-accepted
+	assert.Nil(t, res.err)
+
+	// both sides learn the identity of the other one
+	assert.Equal(t, acceptorKey.Public(), dialed.PublicKey)
+	assert.Equal(t, dialerKey.Public(), res.hs.PublicKey)
+
+	go dialed.Conn.Write([]byte("secret message"))
+	buf := make([]byte, 64)
+	n, err := res.hs.Conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret message", string(buf[:n]))
+}
+
+func TestSecureConnRejectsTampering(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	rec := &recorder{}
+	sender, err := newSecureConn(rec, key, key)
+	assert.Nil(t, err)
+	receiver, err := newSecureConn(b, key, key)
+	assert.Nil(t, err)
+
+	_, err = sender.Write([]byte("transfer 10 coins"))
+	assert.Nil(t, err)
+
+	// a man in the middle flips a bit of the ciphertext
+	rec.data[len(rec.data)-1] ^= 0x1
+	go a.Write(rec.data)
+
+	_, err = receiver.Read(make([]byte, 64))
+	assert.ErrorIs(t, err, ErrRecordAuth)
+}
+
+type recorder struct {
+	net.Conn
+	data []byte
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.data = append(r.data, b...)
+	return len(b), nil
+}
@@ -0,0 +1,125 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// NodeID returns the stable id of the node owning the given identity.
+func NodeID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:])
+}
+
+func randomNodeID() string {
+	buf := make([]byte, sha256.Size)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// exchangeHello tells the remote who we are and where we can be dialed, and
+// learns the same about the remote. It runs right after the handshake, so on
+// a secure connection the hello is authenticated and the node id has to
+// match the identity the remote proved.
+//
+// The dialer also picks a random connection id, which lets both ends agree
+// on which of several connections between the same two nodes to keep.
+func (t *TCPTransport) exchangeHello(peer *TCPPeer) error {
+	var connID uint64
+	if peer.outbound {
+		var buf [8]byte
+		rand.Read(buf[:])
+		connID = binary.BigEndian.Uint64(buf[:])
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- peer.writeFrame(PeerHello, encodeHello(t.NodeID, t.ListenAddr, connID))
+	}()
+
+	var rpc RPC
+	if err := t.Decoder.Decode(peer.Conn, &rpc); err != nil {
+		return err
+	}
+	if err := <-writeErr; err != nil {
+		return err
+	}
+	if rpc.Type != PeerHello {
+		return fmt.Errorf("p2p: expected hello frame, got 0x%x", rpc.Type)
+	}
+
+	id, listenAddr, remoteConnID, err := decodeHello(rpc.Payload)
+	if err != nil {
+		return err
+	}
+	if !peer.outbound {
+		connID = remoteConnID
+	}
+
+	if peer.publicKey != nil && id != NodeID(peer.publicKey) {
+		return errors.New("p2p: node id does not match the remote identity")
+	}
+	if id == "" {
+		id = peer.RemoteAddr().String()
+	}
+
+	peer.id = id
+	peer.listenAddr = advertisedAddr(listenAddr, peer.RemoteAddr())
+	peer.connID = connID
+	return nil
+}
+
+// advertisedAddr fills in the host of an advertised listen address like
+// ":3000" with the address we see the remote connecting from.
+func advertisedAddr(listenAddr string, remote net.Addr) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return listenAddr
+	}
+	remoteHost, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return listenAddr
+	}
+	return net.JoinHostPort(remoteHost, port)
+}
+
+// A hello is [id length: 2][id][listen addr length: 2][listen addr][conn id: 8].
+func encodeHello(id, listenAddr string, connID uint64) []byte {
+	buf := make([]byte, 0, 12+len(id)+len(listenAddr))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(id)))
+	buf = append(buf, id...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(listenAddr)))
+	buf = append(buf, listenAddr...)
+	buf = binary.BigEndian.AppendUint64(buf, connID)
+	return buf
+}
+
+func decodeHello(b []byte) (string, string, uint64, error) {
+	errMalformed := errors.New("p2p: malformed hello frame")
+
+	fields := make([]string, 2)
+	for i := range fields {
+		if len(b) < 2 {
+			return "", "", 0, errMalformed
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		if len(b) < n {
+			return "", "", 0, errMalformed
+		}
+		fields[i], b = string(b[:n]), b[n:]
+	}
+	if len(b) != 8 {
+		return "", "", 0, errMalformed
+	}
+	return fields[0], fields[1], binary.BigEndian.Uint64(b), nil
+}
@@ -1,8 +1,16 @@
 package p2p
 
+// Frame types. IncomingMessage frames carry control messages that are handed
+// to the consumer of the transport, PeerHello is only sent once when a
+// connection is set up, all other frames belong to the stream multiplexer of
+// the connection they arrive on.
 const (
 	IncomingMessage = 0x1
-	IncomingStream  = 0x2
+	PeerHello       = 0x2
+	StreamOpen      = 0x3
+	StreamData      = 0x4
+	StreamClose     = 0x5
+	StreamWindow    = 0x6
 )
 
 // Message holds any arbitrary data that is
@@ -10,5 +18,6 @@ const (
 type RPC struct {
 	From    string
 	Payload []byte
-	Stream  bool
+	// Type is the type of the frame the RPC was decoded from.
+	Type byte
 }
@@ -0,0 +1,347 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	streamIDSize = 4
+
+	// DefaultStreamWindow is the number of bytes a peer may send on a stream
+	// before it has to wait for the receiver to read them.
+	DefaultStreamWindow = 256 * 1024
+
+	// maxStreamDataSize bounds a single data frame so large transfers are cut
+	// into pieces that other streams and messages can be interleaved with.
+	maxStreamDataSize = 32 * 1024
+
+	// acceptBacklog is the number of streams the remote may have opened that
+	// were not accepted yet, further ones are closed right away. With the
+	// window it bounds what a peer can make us buffer.
+	acceptBacklog = 64
+)
+
+var (
+	ErrStreamClosed  = errors.New("p2p: stream closed")
+	ErrSessionClosed = errors.New("p2p: connection closed")
+)
+
+// frameWriter writes a single frame to the underlying connection.
+type frameWriter func(frameType byte, payload []byte) error
+
+// session multiplexes logical streams over a single connection. Frames are
+// read by the transport read loop and handed to handleFrame, so a stream that
+// is not being read never blocks the connection: the sender runs out of
+// window instead.
+type session struct {
+	writeFrame frameWriter
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	// pending are the streams the remote opened that were not accepted yet
+	pending  map[uint32]struct{}
+	nextID   uint32
+	closeErr error
+}
+
+func newSession(writeFrame frameWriter, outbound bool) *session {
+	// the dialing side uses odd stream ids, the accepting side even ones,
+	// so both ends can open streams without coordinating.
+	nextID := uint32(2)
+	if outbound {
+		nextID = 1
+	}
+	return &session{
+		writeFrame: writeFrame,
+		streams:    make(map[uint32]*Stream),
+		pending:    make(map[uint32]struct{}),
+		nextID:     nextID,
+	}
+}
+
+func (s *session) open() (*Stream, error) {
+	s.mu.Lock()
+	if s.closeErr != nil {
+		s.mu.Unlock()
+		return nil, s.closeErr
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(id, s)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(StreamOpen, streamHeader(id)); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *session) stream(id uint32) (*Stream, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.streams[id]
+	return st, ok
+}
+
+// accept returns a stream the remote opened, which frees its place in the
+// backlog.
+func (s *session) accept(id uint32) (*Stream, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.streams[id]
+	delete(s.pending, id)
+	return st, ok
+}
+
+func (s *session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	delete(s.pending, id)
+	s.mu.Unlock()
+}
+
+// handleFrame applies a stream frame read from the connection. An error
+// means the remote violated the protocol and the connection should be dropped.
+func (s *session) handleFrame(frameType byte, payload []byte) error {
+	id := binary.BigEndian.Uint32(payload[:streamIDSize])
+	body := payload[streamIDSize:]
+
+	if frameType == StreamOpen {
+		s.mu.Lock()
+		if _, exists := s.streams[id]; exists {
+			s.mu.Unlock()
+			return fmt.Errorf("p2p: remote opened stream %d twice", id)
+		}
+		if len(s.pending) >= acceptBacklog {
+			s.mu.Unlock()
+			// the remote sees the stream closed, its writes fail
+			return s.writeFrame(StreamClose, streamHeader(id))
+		}
+		s.streams[id] = newStream(id, s)
+		s.pending[id] = struct{}{}
+		s.mu.Unlock()
+		return nil
+	}
+
+	st, ok := s.stream(id)
+	if !ok {
+		// frames for streams we already tore down are expected and dropped
+		return nil
+	}
+
+	switch frameType {
+	case StreamData:
+		return st.receive(body)
+	case StreamWindow:
+		st.grow(binary.BigEndian.Uint32(body))
+	case StreamClose:
+		st.remoteClose()
+	}
+	return nil
+}
+
+// close fails every open stream, it is called once the connection is gone.
+// Streams end with io.EOF only when the remote closes them, so a connection
+// that merely ended fails them with ErrSessionClosed.
+func (s *session) close(err error) {
+	if err == nil || errors.Is(err, io.EOF) {
+		err = ErrSessionClosed
+	}
+
+	s.mu.Lock()
+	s.closeErr = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.pending = make(map[uint32]struct{})
+	s.mu.Unlock()
+
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+// Stream is a logical, bidirectional byte stream multiplexed over a peer
+// connection. Close closes both directions: the remote reads whatever is
+// still buffered and then gets io.EOF, its writes fail with ErrStreamClosed.
+type Stream struct {
+	id      uint32
+	session *session
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	recvBuf      bytes.Buffer
+	recvWindow   uint32
+	unacked      uint32
+	sendWindow   uint32
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+func newStream(id uint32, s *session) *Stream {
+	st := &Stream{
+		id:         id,
+		session:    s,
+		recvWindow: DefaultStreamWindow,
+		sendWindow: DefaultStreamWindow,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// ID returns the stream id, which the remote uses to look the stream up.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	st.mu.Lock()
+	for st.recvBuf.Len() == 0 && !st.remoteClosed && !st.localClosed && st.err == nil {
+		st.cond.Wait()
+	}
+
+	if st.recvBuf.Len() == 0 {
+		defer st.mu.Unlock()
+		switch {
+		case st.localClosed:
+			return 0, ErrStreamClosed
+		case st.err != nil:
+			return 0, st.err
+		default:
+			return 0, io.EOF
+		}
+	}
+
+	n, _ := st.recvBuf.Read(b)
+
+	// hand the window back once half of it has been consumed, so the
+	// sender is not stalled by one update per read.
+	st.unacked += uint32(n)
+	var increment uint32
+	if st.unacked >= DefaultStreamWindow/2 && !st.remoteClosed {
+		increment = st.unacked
+		st.recvWindow += increment
+		st.unacked = 0
+	}
+	st.mu.Unlock()
+
+	if increment > 0 {
+		payload := streamHeader(st.id)
+		payload = binary.BigEndian.AppendUint32(payload, increment)
+		if err := st.session.writeFrame(StreamWindow, payload); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.mu.Lock()
+		for st.sendWindow == 0 && !st.localClosed && !st.remoteClosed && st.err == nil {
+			st.cond.Wait()
+		}
+		switch {
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		case st.localClosed || st.remoteClosed:
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		n := min(len(b)-written, int(st.sendWindow), maxStreamDataSize)
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		payload := make([]byte, streamIDSize, streamIDSize+n)
+		binary.BigEndian.PutUint32(payload, st.id)
+		payload = append(payload, b[written:written+n]...)
+		if err := st.session.writeFrame(StreamData, payload); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close closes the stream in both directions. Data that was already written
+// is still delivered to the remote before it sees io.EOF.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	st.recvBuf.Reset()
+	remoteClosed, err := st.remoteClosed, st.err
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if remoteClosed || err != nil {
+		st.session.remove(st.id)
+	}
+	if err != nil {
+		return nil
+	}
+	return st.session.writeFrame(StreamClose, streamHeader(st.id))
+}
+
+func (st *Stream) receive(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if uint32(len(data)) > st.recvWindow {
+		return fmt.Errorf("p2p: remote exceeded the window of stream %d", st.id)
+	}
+	st.recvWindow -= uint32(len(data))
+
+	// nobody is going to read it anymore
+	if st.localClosed {
+		return nil
+	}
+
+	st.recvBuf.Write(data)
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *Stream) grow(increment uint32) {
+	st.mu.Lock()
+	st.sendWindow += increment
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	localClosed := st.localClosed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if localClosed {
+		st.session.remove(st.id)
+	}
+}
+
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	st.err = err
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func streamHeader(id uint32) []byte {
+	return binary.BigEndian.AppendUint32(make([]byte, 0, streamIDSize+4), id)
+}
@@ -0,0 +1,170 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// connectedPeers returns both ends of a real tcp connection between two transports.
+func connectedPeers(t *testing.T) (*TCPTransport, Peer, *TCPTransport, Peer) {
+	peers := make(chan Peer, 2)
+	newTransport := func() *TCPTransport {
+		tr := NewTCPTransport(TCPTransportOpts{
+			ListenAddr:    "127.0.0.1:0",
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			OnPeer: func(p Peer) error {
+				peers <- p
+				return nil
+			},
+		})
+		assert.Nil(t, tr.ListenAndAccept())
+		t.Cleanup(func() { tr.Close() })
+		return tr
+	}
+
+	a, b := newTransport(), newTransport()
+	assert.Nil(t, a.Dial(b.Address()))
+
+	var dialer, acceptor Peer
+	for range 2 {
+		select {
+		case p := <-peers:
+			if p.(*TCPPeer).outbound {
+				dialer = p
+			} else {
+				acceptor = p
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the connection")
+		}
+	}
+	return a, dialer, b, acceptor
+}
+
+func TestStreamsDoNotBlockEachOther(t *testing.T) {
+	_, dialer, b, acceptor := connectedPeers(t)
+
+	big := make([]byte, 4*DefaultStreamWindow)
+	rand.Read(big)
+
+	bigStream, err := dialer.OpenStream()
+	assert.Nil(t, err)
+
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := bigStream.Write(big)
+		if err == nil {
+			err = bigStream.Close()
+		}
+		writeDone <- err
+	}()
+
+	// the big stream is not being read yet, a second stream and a
+	// plain message must still get through
+	small, err := dialer.OpenStream()
+	assert.Nil(t, err)
+	_, err = small.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, small.Close())
+
+	assert.Nil(t, dialer.Send(frame(t, IncomingMessage, []byte("ping"))))
+
+	select {
+	case rpc := <-b.Consume():
+		assert.Equal(t, []byte("ping"), rpc.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was blocked by a stalled stream")
+	}
+
+	remoteSmall, ok := acceptor.Stream(small.ID())
+	assert.True(t, ok)
+	got, err := io.ReadAll(remoteSmall)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), got)
+	assert.Nil(t, remoteSmall.Close())
+
+	remoteBig, ok := acceptor.Stream(bigStream.ID())
+	assert.True(t, ok)
+	got, err = io.ReadAll(remoteBig)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(big, got))
+	assert.Nil(t, remoteBig.Close())
+	assert.Nil(t, <-writeDone)
+}
+
+func TestStreamCloseStopsWriter(t *testing.T) {
+	_, dialer, _, acceptor := connectedPeers(t)
+
+	stream, err := acceptor.OpenStream()
+	assert.Nil(t, err)
+
+	// the dialer side gives up on the stream without reading it
+	deadline := time.Now().Add(5 * time.Second)
+	var remote *Stream
+	for remote == nil && time.Now().Before(deadline) {
+		remote, _ = dialer.Stream(stream.ID())
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(t, remote)
+	assert.Nil(t, remote.Close())
+
+	_, err = stream.Write(make([]byte, 2*DefaultStreamWindow))
+	assert.ErrorIs(t, err, ErrStreamClosed)
+}
+
+func TestStreamsPastTheBacklogAreClosed(t *testing.T) {
+	_, dialer, _, acceptor := connectedPeers(t)
+	session := acceptor.(*TCPPeer).session
+
+	var streams []*Stream
+	for range acceptBacklog + 1 {
+		st, err := dialer.OpenStream()
+		assert.Nil(t, err)
+		streams = append(streams, st)
+	}
+
+	// none is accepted, the last one is refused
+	refused := streams[acceptBacklog]
+	_, err := refused.Write(make([]byte, 2*DefaultStreamWindow))
+	assert.ErrorIs(t, err, ErrStreamClosed)
+	_, ok := acceptor.Stream(refused.ID())
+	assert.False(t, ok)
+
+	// accepting one makes room for another
+	_, ok = acceptor.Stream(streams[0].ID())
+	assert.True(t, ok)
+	st, err := dialer.OpenStream()
+	assert.Nil(t, err)
+	_, err = st.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, st.Close())
+	deadline := time.Now().Add(5 * time.Second)
+	var remote *Stream
+	for remote == nil && time.Now().Before(deadline) {
+		remote, _ = acceptor.Stream(st.ID())
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(t, remote)
+	got, err := io.ReadAll(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), got)
+
+	// the streams never accepted go with the connection
+	session.close(nil)
+	session.mu.Lock()
+	assert.Empty(t, session.streams)
+	assert.Empty(t, session.pending)
+	session.mu.Unlock()
+}
+
+func frame(t *testing.T, frameType byte, payload []byte) []byte {
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteFrame(buf, frameType, payload))
+	return buf.Bytes()
+}
@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"log"
@@ -18,6 +19,11 @@ func (t *TCPTransport) Address() string {
 	return t.ListenAddr
 }
 
+// Implements the Transport interface
+func (t *TCPTransport) ID() string {
+	return t.NodeID
+}
+
 // Consume implements the Transport interface, which returns a read only channel for
 // reading incoming messages from another peer
 func (t *TCPTransport) Consume() <-chan RPC {
@@ -42,6 +48,11 @@ func (t *TCPTransport) ListenAndAccept() error {
 	}
 	t.listener = ln
 
+	// when asked for any free port, report the one we actually got
+	if _, port, err := net.SplitHostPort(t.ListenAddr); err == nil && port == "0" {
+		t.ListenAddr = ln.Addr().String()
+	}
+
 	go t.startAcceptLoop()
 	return nil
 }
@@ -55,6 +66,7 @@ func (t *TCPTransport) startAcceptLoop() {
 				return
 			}
 			fmt.Printf("[%s] TCP accept error: %v\n", t.ListenAddr, err)
+			continue
 		}
 
 		fmt.Printf("[%s] New Incoming Connection: %+v\n", t.ListenAddr, conn.RemoteAddr().String())
@@ -70,9 +82,21 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		conn.Close()
 	}()
 
-	peer := NewTCPPeer(conn, outbound)
+	hs, err := t.HandshakeFunc(conn, outbound)
+	if err != nil {
+		return
+	}
+	if t.AuthorizePeer != nil {
+		if err = t.AuthorizePeer(hs.PublicKey); err != nil {
+			return
+		}
+	}
 
-	if err = t.HandshakeFunc(peer); err != nil {
+	peer := NewTCPPeer(hs.Conn, outbound)
+	peer.publicKey = hs.PublicKey
+	defer func() { peer.session.close(err) }()
+
+	if err = t.exchangeHello(peer); err != nil {
 		return
 	}
 
@@ -82,26 +106,33 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		}
 	}
 
+	if t.OnPeerDisconnect != nil {
+		defer t.OnPeerDisconnect(peer)
+	}
+
 	// Read Loop
 	for {
 		rpc := RPC{}
-		err = t.Decoder.Decode(conn, &rpc)
+		err = t.Decoder.Decode(peer.Conn, &rpc)
 		if err != nil {
 			return
 		}
 
-		rpc.From = conn.RemoteAddr().String()
-
-		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] Incoming stream from [%s], waiting till stream is done...\n", t.ListenAddr, conn.RemoteAddr().String())
-
-			peer.wg.Wait()
-			fmt.Printf("[%s] Stream from [%s] closed. Resuming normal read loop.\n", t.ListenAddr, conn.RemoteAddr().String())
+		if rpc.Type == PeerHello {
+			err = errors.New("p2p: unexpected hello frame")
+			return
+		}
 
+		if rpc.Type != IncomingMessage {
+			// stream frames never block the read loop, a stream that is not
+			// being read just stops granting its sender more window
+			if err = peer.session.handleFrame(rpc.Type, rpc.Payload); err != nil {
+				return
+			}
 			continue
 		}
 
+		rpc.From = peer.id
 		t.rpcChan <- rpc
 	}
 }
@@ -116,33 +147,95 @@ type TCPPeer struct {
 	// If we accept and retrieve a conn:  outbound = false.
 	outbound bool
 
-	wg *sync.WaitGroup
+	// publicKey is the identity the remote proved during the handshake.
+	publicKey ed25519.PublicKey
+
+	// id and listenAddr are what the remote announced in its hello.
+	id         string
+	listenAddr string
+	connID     uint64
+
+	// writeLock serializes writes so frames of different streams and
+	// messages never interleave on the wire.
+	writeLock sync.Mutex
+	session   *session
+}
+
+// Write writes b to the connection in a single, uninterrupted write.
+func (p *TCPPeer) Write(b []byte) (int, error) {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	return p.Conn.Write(b)
 }
 
 // implements the Peer interface
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
+	_, err := p.Write(b)
 	return err
 }
 
 // implements the Peer interface
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+func (p *TCPPeer) ID() string {
+	return p.id
+}
+
+// implements the Peer interface
+func (p *TCPPeer) ListenAddr() string {
+	return p.listenAddr
+}
+
+// implements the Peer interface
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
+// implements the Peer interface
+func (p *TCPPeer) ConnID() uint64 {
+	return p.connID
+}
+
+// implements the Peer interface
+func (p *TCPPeer) PublicKey() ed25519.PublicKey {
+	return p.publicKey
+}
+
+// implements the Peer interface
+func (p *TCPPeer) OpenStream() (*Stream, error) {
+	return p.session.open()
+}
+
+// implements the Peer interface
+func (p *TCPPeer) Stream(id uint32) (*Stream, bool) {
+	return p.session.accept(id)
+}
+
+func (p *TCPPeer) writeFrame(frameType byte, payload []byte) error {
+	return WriteFrame(p, frameType, payload)
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
-	return &TCPPeer{
+	p := &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
 	}
+	p.session = newSession(p.writeFrame, outbound)
+	return p
 }
 
 type TCPTransportOpts struct {
-	ListenAddr    string
+	ListenAddr string
+	// NodeID identifies this node to its peers. With the secure handshake it
+	// must be NodeID(identity); a random id is used when left empty.
+	NodeID        string
 	HandshakeFunc HandshakeFunc
+	// AuthorizePeer decides whether a peer the handshake authenticated
+	// with publicKey is let in, the connection is dropped if it returns an
+	// error. Every peer is let in when it is nil.
+	AuthorizePeer func(publicKey ed25519.PublicKey) error
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// OnPeerDisconnect is called once a peer accepted by OnPeer is gone.
+	OnPeerDisconnect func(Peer)
 }
 
 type TCPTransport struct {
@@ -152,6 +245,9 @@ type TCPTransport struct {
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
+	if opts.NodeID == "" {
+		opts.NodeID = randomNodeID()
+	}
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcChan:          make(chan RPC, 1024),
@@ -1,17 +1,39 @@
 package p2p
 
-import "net"
+import (
+	"crypto/ed25519"
+	"net"
+)
 
 // Peer represents the remote node.
 type Peer interface {
 	//interface embedding
 	net.Conn
 	Send([]byte) error
-	CloseStream()
+	// ID returns the stable node id of the remote.
+	ID() string
+	// ListenAddr returns the address the remote can be dialed at.
+	ListenAddr() string
+	// Outbound reports whether we dialed the remote.
+	Outbound() bool
+	// ConnID returns the random id the dialer picked for this connection,
+	// it is the same on both ends.
+	ConnID() uint64
+	// PublicKey returns the identity the remote authenticated with during
+	// the handshake, nil if the handshake does not authenticate peers.
+	PublicKey() ed25519.PublicKey
+	// OpenStream opens a new stream multiplexed over the connection.
+	OpenStream() (*Stream, error)
+	// Stream returns a stream the remote opened, looked up by its id. The
+	// streams the remote opens past a backlog of ones not looked up yet
+	// are closed.
+	Stream(uint32) (*Stream, bool)
 }
 
 // Transport handles communication between nodes.
 type Transport interface {
+	// ID returns the node id this transport announces to its peers.
+	ID() string
 	Address() string
 	Dial(string) error
 	ListenAndAccept() error
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+)
+
+const (
+	DefaultReplicationFactor = 3
+	// DefaultVirtualNodes is the number of points each node gets on the
+	// ring of ConsistentHashPlacement.
+	DefaultVirtualNodes = 64
+)
+
+// Candidate is a node a replica of a file can be placed on.
+type Candidate struct {
+	ID string
+	// Used is the number of bytes the node reported to store.
+	Used int64
+}
+
+// PlacementStrategy picks the nodes the replicas of a file are stored on.
+type PlacementStrategy interface {
+	// Place returns up to n of the candidates. The candidates are the nodes
+	// closest to the file in the DHT, sorted by distance.
+	Place(hashedKey string, candidates []Candidate, n int) []Candidate
+}
+
+// ClosestPlacement stores replicas on the nodes closest to the file, which
+// are the first ones a DHT lookup for it reaches.
+type ClosestPlacement struct{}
+
+func (ClosestPlacement) Place(hashedKey string, candidates []Candidate, n int) []Candidate {
+	return candidates[:min(n, len(candidates))]
+}
+
+// RandomPlacement spreads replicas uniformly over the candidates.
+type RandomPlacement struct{}
+
+func (RandomPlacement) Place(hashedKey string, candidates []Candidate, n int) []Candidate {
+	shuffled := slices.Clone(candidates)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled[:min(n, len(shuffled))]
+}
+
+// LeastUsedPlacement stores replicas on the candidates with the least data.
+type LeastUsedPlacement struct{}
+
+func (LeastUsedPlacement) Place(hashedKey string, candidates []Candidate, n int) []Candidate {
+	sorted := slices.Clone(candidates)
+	slices.SortStableFunc(sorted, func(a, b Candidate) int {
+		return cmp.Compare(a.Used, b.Used)
+	})
+	return sorted[:min(n, len(sorted))]
+}
+
+// ConsistentHashPlacement puts every candidate on a hash ring and stores
+// replicas on the first distinct nodes following the file's position, so
+// a node joining or leaving only moves the replicas next to it.
+type ConsistentHashPlacement struct {
+	// VirtualNodes defaults to DefaultVirtualNodes.
+	VirtualNodes int
+}
+
+func (p ConsistentHashPlacement) Place(hashedKey string, candidates []Candidate, n int) []Candidate {
+	vnodes := p.VirtualNodes
+	if vnodes == 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	type point struct {
+		hash      uint64
+		candidate int
+	}
+	ring := make([]point, 0, len(candidates)*vnodes)
+	for i, c := range candidates {
+		for v := range vnodes {
+			ring = append(ring, point{ringHash(c.ID + "#" + strconv.Itoa(v)), i})
+		}
+	}
+	slices.SortFunc(ring, func(a, b point) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+
+	start, _ := slices.BinarySearchFunc(ring, ringHash(hashedKey), func(p point, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+
+	chosen := []Candidate{}
+	picked := make(map[int]bool)
+	for i := range ring {
+		if len(chosen) == n {
+			break
+		}
+		p := ring[(start+i)%len(ring)]
+		if !picked[p.candidate] {
+			picked[p.candidate] = true
+			chosen = append(chosen, candidates[p.candidate])
+		}
+	}
+	return chosen
+}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// ParsePlacement returns the placement strategy with the given name.
+func ParsePlacement(name string) (PlacementStrategy, error) {
+	switch name {
+	case "", "closest":
+		return ClosestPlacement{}, nil
+	case "random":
+		return RandomPlacement{}, nil
+	case "least-used":
+		return LeastUsedPlacement{}, nil
+	case "consistent-hash":
+		return ConsistentHashPlacement{}, nil
+	}
+	return nil, fmt.Errorf("unknown placement strategy '%s' (closest, random, least-used, consistent-hash)", name)
+}
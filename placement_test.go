@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCandidates(n int) []Candidate {
+	candidates := make([]Candidate, n)
+	for i := range candidates {
+		candidates[i] = Candidate{ID: fmt.Sprintf("node-%d", i), Used: int64(n-i) * 100}
+	}
+	return candidates
+}
+
+func TestPlacementStrategies(t *testing.T) {
+	candidates := testCandidates(6)
+
+	for _, name := range []string{"closest", "random", "least-used", "consistent-hash"} {
+		strategy, err := ParsePlacement(name)
+		assert.Nil(t, err)
+
+		chosen := strategy.Place(fileHash(nil, "file"), candidates, 3)
+		assert.Len(t, chosen, 3, name)
+
+		seen := map[string]bool{}
+		for _, c := range chosen {
+			assert.False(t, seen[c.ID], "%s picked %s twice", name, c.ID)
+			seen[c.ID] = true
+		}
+
+		// asking for more replicas than there are candidates uses all of them
+		assert.Len(t, strategy.Place(fileHash(nil, "file"), candidates, 10), len(candidates), name)
+	}
+
+	_, err := ParsePlacement("everywhere")
+	assert.NotNil(t, err)
+}
+
+func TestLeastUsedPlacement(t *testing.T) {
+	chosen := LeastUsedPlacement{}.Place(fileHash(nil, "file"), testCandidates(5), 2)
+	assert.Equal(t, []string{"node-4", "node-3"}, []string{chosen[0].ID, chosen[1].ID})
+}
+
+func TestConsistentHashPlacementIsStable(t *testing.T) {
+	candidates := testCandidates(10)
+	p := ConsistentHashPlacement{}
+
+	moved := 0
+	for i := range 200 {
+		key := fileHash(nil, fmt.Sprintf("file-%d", i))
+		before := p.Place(key, candidates, 1)[0]
+		assert.Equal(t, before, p.Place(key, candidates, 1)[0])
+
+		// a node joining only takes over the keys that now fall to it
+		after := p.Place(key, append(candidates, Candidate{ID: "node-new"}), 1)[0]
+		if after != before {
+			assert.Equal(t, "node-new", after.ID)
+			moved++
+		}
+	}
+	assert.Less(t, moved, 60)
+}
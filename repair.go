@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+	"github.com/TinySkillet/DecentralizedP2PStorage/dht"
+)
+
+const (
+	// DefaultRepairInterval is how often the replicas of our files are checked.
+	DefaultRepairInterval = time.Minute
+	// repairFileTimeout bounds checking and re-replicating a single file.
+	repairFileTimeout = 5 * time.Minute
+)
+
+// scheduleRepair wakes up the repair loop without waiting for the next tick.
+func (s *FileServer) scheduleRepair() {
+	select {
+	case s.repairch <- struct{}{}:
+	default:
+	}
+}
+
+// repairLoop keeps every file we stored at ReplicationFactor replicas. It
+// runs every RepairInterval and whenever a peer disconnects. The replicas are
+// tracked in the shares table, so it needs a database.
+func (s *FileServer) repairLoop() {
+	if s.DB == nil {
+		return
+	}
+
+	ticker := time.NewTicker(s.RepairInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.repairch:
+		case <-s.quitch:
+			return
+		}
+		s.repair()
+	}
+}
+
+func (s *FileServer) repair() {
+	files, err := s.DB.ListFiles(context.Background())
+	if err != nil {
+		log.Printf("[%s] Repair: listing files: %v\n", s.Transport.Address(), err)
+		return
+	}
+
+	for _, f := range files {
+		ctx, cancel := context.WithTimeout(context.Background(), repairFileTimeout)
+		if f.ID != s.hashKey(f.Name) {
+			if f, err = s.migrateFile(ctx, f); err != nil {
+				log.Printf("[%s] Renaming '%s': %v\n", s.Transport.Address(), f.Name, err)
+				cancel()
+				continue
+			}
+		}
+		if err := s.repairFile(ctx, f); err != nil {
+			log.Printf("[%s] Repair of '%s': %v\n", s.Transport.Address(), f.Name, err)
+		}
+		cancel()
+	}
+}
+
+// repairFile checks that the peers we placed replicas of f on still hold
+// them, forgets the ones that do not, and places new replicas until there
+// are ReplicationFactor again.
+func (s *FileServer) repairFile(ctx context.Context, f dbpkg.File) error {
+	shares, err := s.DB.ListShares(ctx, f.Hash, dbpkg.ShareOutbound)
+	if err != nil {
+		return err
+	}
+
+	holders := []string{}
+	for _, sh := range shares {
+		if s.hasReplica(ctx, sh.PeerID, f.Hash) {
+			holders = append(holders, sh.PeerID)
+			continue
+		}
+		fmt.Printf("[%s] Replica of '%s' on %s is gone\n", s.Transport.Address(), f.Name, sh.PeerID)
+		if err := s.DB.DeleteShare(ctx, f.Hash, sh.PeerID, dbpkg.ShareOutbound); err != nil {
+			return err
+		}
+	}
+
+	missing := s.ReplicationFactor - len(holders)
+	if missing <= 0 {
+		return nil
+	}
+
+	peers, err := s.closestPeers(ctx, f.Hash)
+	if err != nil {
+		return err
+	}
+	peers = slices.DeleteFunc(peers, func(p string) bool { return slices.Contains(holders, p) })
+
+	chosen := s.Placement.Place(f.Hash, s.usage(ctx, peers), missing)
+	if len(chosen) == 0 {
+		return fmt.Errorf("%d of %d replicas left and no peer to place new ones on", len(holders), s.ReplicationFactor)
+	}
+
+	for _, c := range chosen {
+		if err := s.copyReplica(ctx, f, holders, c.ID); err != nil {
+			log.Printf("[%s] Repair: replica of '%s' on %s failed: %v\n", s.Transport.Address(), f.Name, c.ID, err)
+			continue
+		}
+		s.recordReplica(f.Hash, c.ID)
+		holders = append(holders, c.ID)
+		fmt.Printf("[%s] Re-replicated '%s' to %s\n", s.Transport.Address(), f.Name, c.ID)
+	}
+	return nil
+}
+
+// hasReplica asks a peer whether it still holds the file, dialing it if
+// we are not connected. An unreachable peer does not hold it.
+func (s *FileServer) hasReplica(ctx context.Context, peer, hashedKey string) bool {
+	ctx, cancel := context.WithTimeout(ctx, dhtRequestTimeout)
+	defer cancel()
+
+	id, err := s.connectPeer(ctx, peer)
+	if err != nil {
+		return false
+	}
+	_, _, err = s.lookupFile(ctx, []string{id}, hashedKey)
+	return err == nil
+}
+
+// connectPeer connects to a peer we know by node id, using the address we
+// last saw it at.
+func (s *FileServer) connectPeer(ctx context.Context, id string) (string, error) {
+	if _, ok := s.peer(id); ok {
+		return id, nil
+	}
+
+	nodeID, err := dht.ParseID(id)
+	if err != nil {
+		return "", err
+	}
+	c := dht.Contact{ID: nodeID}
+	if s.DB != nil {
+		if p, err := s.DB.GetPeer(ctx, id); err == nil {
+			c.Addr = p.Address
+		}
+	}
+	return s.connect(ctx, c)
+}
+
+// copyReplica places a new replica of f on target. It is made from our own
+// copy if we still have it, otherwise a peer holding a replica sends it.
+func (s *FileServer) copyReplica(ctx context.Context, f dbpkg.File, holders []string, target string) error {
+	if s.store.Has(f.Name) {
+		dk, err := s.fileKey(ctx, f.Hash)
+		if err != nil {
+			return err
+		}
+		return s.storeOn(target, f.Name, dk)
+	}
+
+	peer, ok := s.peer(target)
+	if !ok {
+		return fmt.Errorf("peer %s not found in peer list", target)
+	}
+
+	err := errors.New("no surviving copy")
+	for _, holder := range holders {
+		if err = s.askReplicate(ctx, holder, f.Hash, target, peer.ListenAddr()); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// askReplicate has a peer holding a replica send a copy of it to target.
+func (s *FileServer) askReplicate(ctx context.Context, holder, hashedKey, target, targetAddr string) error {
+	id, responses, done := s.newRequest(1)
+	defer done()
+
+	msg := Message{
+		ID: id,
+		Payload: MessageReplicateFile{
+			Key:        hashedKey,
+			Target:     target,
+			TargetAddr: targetAddr,
+		},
+	}
+	if err := s.send(holder, &msg); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-responses:
+		v, ok := resp.Payload.(MessageStoreFileResponse)
+		if !ok {
+			return fmt.Errorf("unexpected response %T", resp.Payload)
+		}
+		if v.Error != "" {
+			return errors.New(v.Error)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleMessageReplicateFile copies a replica we hold to another peer on
+// behalf of the file's owner and reports the outcome to it.
+func (s *FileServer) handleMessageReplicateFile(from string, id uint64, msg MessageReplicateFile) error {
+	resp := MessageStoreFileResponse{Key: msg.Key}
+	err := s.replicateTo(from, msg)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if sendErr := s.send(from, &Message{ID: id, Payload: resp}); sendErr != nil && err == nil {
+		return sendErr
+	}
+	return err
+}
+
+func (s *FileServer) replicateTo(owner string, msg MessageReplicateFile) error {
+	if s.DB != nil {
+		shares, err := s.DB.ListShares(context.Background(), msg.Key, dbpkg.ShareInbound)
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(shares, func(sh dbpkg.Share) bool { return sh.PeerID == owner }) {
+			return fmt.Errorf("we hold no replica of '%s' for %s", msg.Key, owner)
+		}
+	}
+
+	target, err := dht.ParseID(msg.Target)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dhtRequestTimeout)
+	defer cancel()
+	if _, err := s.connect(ctx, dht.Contact{ID: target, Addr: msg.TargetAddr}); err != nil {
+		return err
+	}
+
+	// the replica is already encrypted, its chunks are sent as they are
+	chunks, err := s.storedChunks(msg.Key)
+	if err != nil {
+		return err
+	}
+	defer chunks.Close()
+
+	store := MessageStoreFile{
+		Key:   msg.Key,
+		Owner: owner,
+	}
+	return s.sendReplica(msg.Target, store, chunks)
+}
+
+// MessageReplicateFile asks a peer holding a replica to store a copy of it
+// on Target. It is answered with a MessageStoreFileResponse once Target
+// confirmed the copy.
+type MessageReplicateFile struct {
+	Key        string
+	Target     string
+	TargetAddr string
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// replicaHolders returns the live servers holding a replica of the file.
+func replicaHolders(servers []*FileServer, name string, dead map[*FileServer]bool) []string {
+	holders := []string{}
+	for _, s := range servers {
+		if !dead[s] && s.store.Has(s.hashKey(name)) {
+			holders = append(holders, s.Transport.ID())
+		}
+	}
+	return holders
+}
+
+func outboundShares(t *testing.T, s *FileServer, name string) []string {
+	shares, err := s.DB.ListShares(context.Background(), s.hashKey(name), dbpkg.ShareOutbound)
+	assert.Nil(t, err)
+	peers := []string{}
+	for _, sh := range shares {
+		peers = append(peers, sh.PeerID)
+	}
+	return peers
+}
+
+func TestRepairRestoresReplicationFactor(t *testing.T) {
+	servers := newTestCluster(t, 6, func() FileServerOpts {
+		return FileServerOpts{
+			BucketSize:        5,
+			ReplicationFactor: 2,
+			DB:                newTestDB(t),
+		}
+	})
+	byID := map[string]*FileServer{}
+	for _, s := range servers {
+		byID[s.Transport.ID()] = s
+	}
+	owner, name := servers[0], "notes.txt"
+	dead := map[*FileServer]bool{}
+
+	results, err := owner.Store(name, bytes.NewReader([]byte("remember the milk")))
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+	assert.ElementsMatch(t, replicaHolders(servers, name, dead), outboundShares(t, owner, name))
+
+	// a holder leaves, the owner re-replicates from its own copy
+	lost := byID[results[0].Peer]
+	kill(lost)
+	dead[lost] = true
+	waitFor(t, func() bool { _, ok := owner.peer(lost.Transport.ID()); return !ok })
+
+	owner.repair()
+	holders := replicaHolders(servers, name, dead)
+	assert.Len(t, holders, 2)
+	assert.ElementsMatch(t, holders, outboundShares(t, owner, name))
+
+	// the owner lost its own copy as well, a surviving replica is copied
+	assert.Nil(t, owner.store.Delete(name))
+	lost = byID[holders[0]]
+	kill(lost)
+	dead[lost] = true
+	waitFor(t, func() bool { _, ok := owner.peer(lost.Transport.ID()); return !ok })
+
+	owner.repair()
+	holders = replicaHolders(servers, name, dead)
+	assert.Len(t, holders, 2)
+	assert.ElementsMatch(t, holders, outboundShares(t, owner, name))
+	assert.NotContains(t, holders, owner.Transport.ID())
+
+	// and the copy can still be read
+	_, r, err := owner.Get(context.Background(), name)
+	assert.Nil(t, err)
+	if rc, ok := r.(interface{ Close() error }); ok {
+		defer rc.Close()
+	}
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(r)
+	assert.Equal(t, "remember the milk", buf.String())
+}
@@ -0,0 +1,875 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+)
+
+// The S3 endpoint serves a subset of the S3 API over path-style URLs,
+// /{bucket}/{key}. A bucket is a namespace of keys: object K of bucket B is
+// the file B/K, stored and listed like any other. Supported are buckets,
+// PutObject, GetObject, HeadObject, DeleteObject, DeleteObjects,
+// ListObjects (V1 and V2) and multipart uploads. Requests are not
+// authenticated; clients may sign them with any credentials.
+//
+// The ETag of an object is its hex SHA-256 digest, not its MD5, including
+// for objects assembled from a multipart upload.
+
+const (
+	s3Namespace   = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat  = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys     = 1000
+	s3MaxParts    = 10000
+	s3ListBatch   = 1000
+	s3UploadsRoot = ".s3-uploads"
+)
+
+// S3Handler returns the handler of the S3 endpoint. It needs a database,
+// where buckets and uploads are recorded.
+func (s *FileServer) S3Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleS3ListBuckets)
+	mux.HandleFunc("/{bucket}", s.handleS3Bucket)
+	mux.HandleFunc("/{bucket}/{key...}", s.handleS3Object)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.DB == nil {
+			s3Fail(w, r, errS3NotImplemented)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// s3Error is an error in the form S3 clients expect.
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string { return e.Code + ": " + e.Message }
+
+var (
+	errS3NoSuchBucket      = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist."}
+	errS3NoSuchKey         = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errS3NoSuchUpload      = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist."}
+	errS3BucketExists      = &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists."}
+	errS3BucketNotEmpty    = &s3Error{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty."}
+	errS3InvalidBucketName = &s3Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid."}
+	errS3InvalidPart       = &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found."}
+	errS3InvalidPartOrder  = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order."}
+	errS3MalformedXML      = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed."}
+	errS3IncompleteBody    = &s3Error{http.StatusBadRequest, "IncompleteBody", "The request body is shorter than announced."}
+	errS3InvalidArgument   = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument."}
+	errS3NotImplemented    = &s3Error{http.StatusNotImplemented, "NotImplemented", "This operation is not supported."}
+)
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// s3Fail answers with the S3 error err calls for.
+func s3Fail(w http.ResponseWriter, r *http.Request, err error) {
+	var e *s3Error
+	switch {
+	case errors.As(err, &e):
+	case errors.Is(err, ErrFileNotFound), errors.Is(err, fs.ErrNotExist):
+		e = errS3NoSuchKey
+	case errors.Is(err, errCutShort):
+		e = errS3IncompleteBody
+	case errors.Is(err, ErrTampered), errors.Is(err, ErrCorrupt):
+		e = &s3Error{http.StatusBadGateway, "InternalError", err.Error()}
+	case errors.Is(err, context.DeadlineExceeded):
+		e = &s3Error{http.StatusServiceUnavailable, "SlowDown", err.Error()}
+	default:
+		e = &s3Error{http.StatusInternalServerError, "InternalError", err.Error()}
+	}
+	if r.Method == http.MethodHead {
+		// a HEAD response has no body
+		w.WriteHeader(e.Status)
+		return
+	}
+	writeXML(w, e.Status, s3ErrorResponse{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Writing S3 response: %v\n", err)
+	}
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format(s3TimeFormat)
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+func (s *FileServer) s3Owner() s3Owner {
+	return s3Owner{ID: s.Transport.ID(), DisplayName: s.Transport.ID()}
+}
+
+func (s *FileServer) handleS3ListBuckets(w http.ResponseWriter, r *http.Request) {
+	buckets, err := s.DB.ListBuckets(r.Context())
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	res := s3ListBucketsResult{Xmlns: s3Namespace, Owner: s.s3Owner()}
+	for _, b := range buckets {
+		res.Buckets = append(res.Buckets, s3Bucket{Name: b.Name, CreationDate: s3Time(b.CreatedAt)})
+	}
+	writeXML(w, http.StatusOK, res)
+}
+
+// validBucketName checks the S3 rules for bucket names, which keep them
+// from containing a slash.
+func validBucketName(name string) bool {
+	if len(name) < 3 || len(name) > 63 {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case (c == '.' || c == '-') && i > 0 && i < len(name)-1:
+		default:
+			return false
+		}
+	}
+	return !strings.Contains(name, "..")
+}
+
+// bucketExists fails with NoSuchBucket unless the bucket was created.
+func (s *FileServer) bucketExists(ctx context.Context, bucket string) error {
+	if _, err := s.DB.GetBucket(ctx, bucket); errors.Is(err, sql.ErrNoRows) {
+		return errS3NoSuchBucket
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *FileServer) handleS3Bucket(w http.ResponseWriter, r *http.Request) {
+	bucket := r.PathValue("bucket")
+	q := r.URL.Query()
+	var err error
+	switch {
+	case r.Method == http.MethodPut && len(q) == 0:
+		err = s.s3CreateBucket(w, r, bucket)
+	case r.Method == http.MethodDelete && len(q) == 0:
+		err = s.s3DeleteBucket(w, r, bucket)
+	case r.Method == http.MethodHead:
+		if err = s.bucketExists(r.Context(), bucket); err == nil {
+			w.WriteHeader(http.StatusOK)
+		}
+	case r.Method == http.MethodGet && q.Has("location"):
+		if err = s.bucketExists(r.Context(), bucket); err == nil {
+			writeXML(w, http.StatusOK, s3LocationConstraint{Xmlns: s3Namespace})
+		}
+	case r.Method == http.MethodGet && q.Has("uploads"),
+		r.Method == http.MethodGet && (q.Has("versioning") || q.Has("acl") || q.Has("policy")):
+		err = errS3NotImplemented
+	case r.Method == http.MethodGet:
+		err = s.s3ListObjects(w, r, bucket)
+	case r.Method == http.MethodPost && q.Has("delete"):
+		err = s.s3DeleteObjects(w, r, bucket)
+	default:
+		err = errS3NotImplemented
+	}
+	if err != nil {
+		s3Fail(w, r, err)
+	}
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+func (s *FileServer) s3CreateBucket(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if !validBucketName(bucket) {
+		return errS3InvalidBucketName
+	}
+	if err := s.DB.CreateBucket(r.Context(), bucket); errors.Is(err, dbpkg.ErrBucketExists) {
+		return errS3BucketExists
+	} else if err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *FileServer) s3DeleteBucket(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if err := s.bucketExists(r.Context(), bucket); err != nil {
+		return err
+	}
+	files, err := s.DB.ListFilesByPrefix(r.Context(), bucket+"/", "", 1)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return errS3BucketNotEmpty
+	}
+	if err := s.DB.DeleteBucket(r.Context(), bucket); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// s3Listing is a page of the objects of a bucket.
+type s3Listing struct {
+	Contents  []s3Object
+	Prefixes  []s3CommonPrefix
+	Truncated bool
+	// Next is the last key or common prefix of the page, where the next
+	// page starts after.
+	Next string
+}
+
+// listBucket lists up to max objects of a bucket whose keys start with
+// prefix and sort after after. With a delimiter, the keys that contain it
+// past the prefix are rolled up into common prefixes, which count towards
+// max like keys.
+func (s *FileServer) listBucket(ctx context.Context, bucket, prefix, delimiter, after string, max int) (*s3Listing, error) {
+	var (
+		l      s3Listing
+		count  int
+		lastCP = after
+		cursor = bucket + "/" + after
+	)
+	for {
+		files, err := s.DB.ListFilesByPrefix(ctx, bucket+"/"+prefix, cursor, s3ListBatch)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			cursor = f.Name
+			key := strings.TrimPrefix(f.Name, bucket+"/")
+			if delimiter != "" {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					cp := key[:len(prefix)+i+len(delimiter)]
+					if cp == lastCP {
+						continue
+					}
+					if count == max {
+						l.Truncated = true
+						return &l, nil
+					}
+					l.Prefixes = append(l.Prefixes, s3CommonPrefix{Prefix: cp})
+					lastCP, l.Next = cp, cp
+					count++
+					continue
+				}
+			}
+			if count == max {
+				l.Truncated = true
+				return &l, nil
+			}
+			l.Contents = append(l.Contents, s3Object{
+				Key:          key,
+				LastModified: s3Time(f.CreatedAt),
+				ETag:         `"` + f.Digest + `"`,
+				Size:         f.Size,
+				StorageClass: "STANDARD",
+			})
+			l.Next = key
+			count++
+		}
+		if len(files) < s3ListBatch {
+			return &l, nil
+		}
+	}
+}
+
+type s3ListBucketResult struct {
+	XMLName        xml.Name         `xml:"ListBucketResult"`
+	Xmlns          string           `xml:"xmlns,attr"`
+	Name           string           `xml:"Name"`
+	Prefix         string           `xml:"Prefix"`
+	Delimiter      string           `xml:"Delimiter,omitempty"`
+	MaxKeys        int              `xml:"MaxKeys"`
+	EncodingType   string           `xml:"EncodingType,omitempty"`
+	IsTruncated    bool             `xml:"IsTruncated"`
+	Contents       []s3Object       `xml:"Contents"`
+	CommonPrefixes []s3CommonPrefix `xml:"CommonPrefixes"`
+	// ListObjectsV2
+	KeyCount              *int   `xml:"KeyCount,omitempty"`
+	ContinuationToken     string `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string `xml:"StartAfter,omitempty"`
+	// ListObjects
+	Marker     *string `xml:"Marker,omitempty"`
+	NextMarker string  `xml:"NextMarker,omitempty"`
+}
+
+func (s *FileServer) s3ListObjects(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if err := s.bucketExists(r.Context(), bucket); err != nil {
+		return err
+	}
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	max := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errS3InvalidArgument
+		}
+		max = min(n, s3MaxKeys)
+	}
+
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			b, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return &s3Error{http.StatusBadRequest, "InvalidArgument", "The continuation token is not valid."}
+			}
+			after = string(b)
+		}
+	}
+	l, err := s.listBucket(r.Context(), bucket, prefix, delimiter, after, max)
+	if err != nil {
+		return err
+	}
+
+	// keys may hold characters XML cannot, clients ask for them escaped
+	escape := func(s string) string { return s }
+	if q.Get("encoding-type") == "url" {
+		escape = func(s string) string { return strings.ReplaceAll(url.QueryEscape(s), "+", "%20") }
+	}
+	res := s3ListBucketResult{
+		Xmlns:        s3Namespace,
+		Name:         bucket,
+		Prefix:       escape(prefix),
+		Delimiter:    escape(delimiter),
+		MaxKeys:      max,
+		EncodingType: q.Get("encoding-type"),
+		IsTruncated:  l.Truncated,
+		Contents:     l.Contents,
+	}
+	for i := range res.Contents {
+		res.Contents[i].Key = escape(res.Contents[i].Key)
+	}
+	for _, cp := range l.Prefixes {
+		res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{Prefix: escape(cp.Prefix)})
+	}
+	if v2 {
+		keyCount := len(l.Contents) + len(l.Prefixes)
+		res.KeyCount = &keyCount
+		res.ContinuationToken = q.Get("continuation-token")
+		res.StartAfter = escape(q.Get("start-after"))
+		if l.Truncated {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(l.Next))
+		}
+	} else {
+		marker := escape(after)
+		res.Marker = &marker
+		if l.Truncated {
+			res.NextMarker = escape(l.Next)
+		}
+	}
+	writeXML(w, http.StatusOK, res)
+	return nil
+}
+
+type s3Delete struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []s3Deleted     `xml:"Deleted"`
+	Errors  []s3DeleteError `xml:"Error"`
+}
+
+type s3Deleted struct {
+	Key string `xml:"Key"`
+}
+
+type s3DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (s *FileServer) s3DeleteObjects(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if err := s.bucketExists(r.Context(), bucket); err != nil {
+		return err
+	}
+	var req s3Delete
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&req); err != nil {
+		return errS3MalformedXML
+	}
+	res := s3DeleteResult{Xmlns: s3Namespace}
+	for _, o := range req.Objects {
+		if err := s.deleteObject(r.Context(), bucket+"/"+o.Key); err != nil {
+			res.Errors = append(res.Errors, s3DeleteError{Key: o.Key, Code: "InternalError", Message: err.Error()})
+			continue
+		}
+		if !req.Quiet {
+			res.Deleted = append(res.Deleted, s3Deleted{Key: o.Key})
+		}
+	}
+	writeXML(w, http.StatusOK, res)
+	return nil
+}
+
+// deleteObject deletes a file; like S3, deleting a missing one succeeds.
+func (s *FileServer) deleteObject(ctx context.Context, key string) error {
+	if !s.store.Has(key) && !s.knownFile(ctx, key) {
+		return nil
+	}
+	return s.Delete(key)
+}
+
+func (s *FileServer) handleS3Object(w http.ResponseWriter, r *http.Request) {
+	bucket, key := r.PathValue("bucket"), r.PathValue("key")
+	if key == "" {
+		// "/bucket/" is the bucket itself
+		s.handleS3Bucket(w, r)
+		return
+	}
+	if err := s.bucketExists(r.Context(), bucket); err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+
+	q := r.URL.Query()
+	name := bucket + "/" + key
+	var err error
+	switch {
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		err = s.s3UploadPart(w, r, bucket, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		err = errS3NotImplemented
+	case r.Method == http.MethodPut:
+		err = s.s3PutObject(w, r, name)
+	case r.Method == http.MethodGet && q.Has("uploadId"):
+		err = s.s3ListParts(w, r, bucket, key)
+	case r.Method == http.MethodGet:
+		err = s.s3GetObject(w, r, name)
+	case r.Method == http.MethodHead:
+		err = s.s3HeadObject(w, r, name)
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		err = s.s3AbortUpload(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		if err = s.deleteObject(r.Context(), name); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		err = s.s3CreateUpload(w, r, bucket, key)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		err = s.s3CompleteUpload(w, r, bucket, key)
+	default:
+		err = errS3NotImplemented
+	}
+	if err != nil {
+		s3Fail(w, r, err)
+	}
+}
+
+// s3Body returns the content of a request body, which SDKs may send in
+// aws-chunked encoding.
+func s3Body(r *http.Request) io.Reader {
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") ||
+		strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return requestBody{&awsChunkedReader{r: bufio.NewReader(r.Body)}}
+	}
+	return requestBody{r.Body}
+}
+
+func (s *FileServer) s3PutObject(w http.ResponseWriter, r *http.Request, name string) error {
+	if _, err := s.Store(name, s3Body(r)); err != nil {
+		return err
+	}
+	digest, err := s.store.Digest(name)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", `"`+digest+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// objectModTime is the time a file was stored, zero if it is unknown.
+func (s *FileServer) objectModTime(ctx context.Context, name string) time.Time {
+	f, err := s.DB.GetFile(ctx, s.hashKey(name))
+	if err != nil {
+		return time.Time{}
+	}
+	return f.CreatedAt
+}
+
+func (s *FileServer) s3GetObject(w http.ResponseWriter, r *http.Request, name string) error {
+	_, fr, err := s.Get(r.Context(), name)
+	if err != nil {
+		return err
+	}
+	if c, ok := fr.(io.Closer); ok {
+		defer c.Close()
+	}
+	if digest, err := s.store.Digest(name); err == nil {
+		w.Header().Set("ETag", `"`+digest+`"`)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if rs, ok := fr.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(name), s.objectModTime(r.Context(), name), rs)
+		return nil
+	}
+	io.Copy(w, fr)
+	return nil
+}
+
+func (s *FileServer) s3HeadObject(w http.ResponseWriter, r *http.Request, name string) error {
+	size, digest, err := s.localStat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		size, digest, err = s.networkStat(r.Context(), name)
+	}
+	if err != nil {
+		return err
+	}
+
+	if digest != "" {
+		w.Header().Set("ETag", `"`+digest+`"`)
+	}
+	if t := s.objectModTime(r.Context(), name); !t.IsZero() {
+		w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// Parts of a multipart upload are kept in the local store until the upload
+// is completed, then assembled into the object and deleted. Their chunks
+// are shared with the object, so assembling them copies little.
+
+type s3InitiateUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3CompleteUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type s3ListPartsResult struct {
+	XMLName  xml.Name `xml:"ListPartsResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+	Parts    []s3Part `xml:"Part"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size"`
+}
+
+func uploadPartKey(uploadID string, part int) string {
+	return fmt.Sprintf("%s/%s/%d", s3UploadsRoot, uploadID, part)
+}
+
+// s3Upload returns the upload of a request, which must be one of the
+// object.
+func (s *FileServer) s3Upload(r *http.Request, bucket, key string) (*dbpkg.Upload, error) {
+	u, err := s.DB.GetUpload(r.Context(), r.URL.Query().Get("uploadId"))
+	if errors.Is(err, dbpkg.ErrNoSuchUpload) {
+		return nil, errS3NoSuchUpload
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Bucket != bucket || u.Key != key {
+		return nil, errS3NoSuchUpload
+	}
+	return u, nil
+}
+
+func (s *FileServer) s3CreateUpload(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	u := dbpkg.Upload{ID: newKeyID(), Bucket: bucket, Key: key}
+	if err := s.DB.CreateUpload(r.Context(), u); err != nil {
+		return err
+	}
+	writeXML(w, http.StatusOK, s3InitiateUploadResult{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadID: u.ID})
+	return nil
+}
+
+func (s *FileServer) s3UploadPart(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	u, err := s.s3Upload(r, bucket, key)
+	if err != nil {
+		return err
+	}
+	part, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || part < 1 || part > s3MaxParts {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000."}
+	}
+
+	// a failed write leaves the part uploaded before in place, which
+	// upload_parts still records
+	partKey := uploadPartKey(u.ID, part)
+	size, err := s.store.Write(partKey, s3Body(r))
+	if err != nil {
+		return err
+	}
+	digest, err := s.store.Digest(partKey)
+	if err != nil {
+		return err
+	}
+	if err := s.DB.PutUploadPart(r.Context(), dbpkg.UploadPart{
+		UploadID:   u.ID,
+		PartNumber: part,
+		ETag:       digest,
+		Size:       size,
+	}); err != nil {
+		return err
+	}
+	w.Header().Set("ETag", `"`+digest+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *FileServer) s3ListParts(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	u, err := s.s3Upload(r, bucket, key)
+	if err != nil {
+		return err
+	}
+	parts, err := s.DB.ListUploadParts(r.Context(), u.ID)
+	if err != nil {
+		return err
+	}
+	res := s3ListPartsResult{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadID: u.ID}
+	for _, p := range parts {
+		res.Parts = append(res.Parts, s3Part{PartNumber: p.PartNumber, ETag: `"` + p.ETag + `"`, Size: p.Size})
+	}
+	writeXML(w, http.StatusOK, res)
+	return nil
+}
+
+func (s *FileServer) s3CompleteUpload(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	u, err := s.s3Upload(r, bucket, key)
+	if err != nil {
+		return err
+	}
+	var req s3CompleteUpload
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		return errS3MalformedXML
+	}
+	parts, err := s.DB.ListUploadParts(r.Context(), u.ID)
+	if err != nil {
+		return err
+	}
+	uploaded := make(map[int]string, len(parts))
+	for _, p := range parts {
+		uploaded[p.PartNumber] = p.ETag
+	}
+
+	readers := make([]io.Reader, len(req.Parts))
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			return errS3InvalidPartOrder
+		}
+		if etag, ok := uploaded[p.PartNumber]; !ok || etag != strings.Trim(p.ETag, `"`) {
+			return errS3InvalidPart
+		}
+		readers[i] = &partReader{store: s.store, key: uploadPartKey(u.ID, p.PartNumber)}
+	}
+
+	name := bucket + "/" + key
+	if _, err := s.Store(name, io.MultiReader(readers...)); err != nil {
+		return err
+	}
+	digest, err := s.store.Digest(name)
+	if err != nil {
+		return err
+	}
+	if err := s.removeUpload(r.Context(), u.ID, parts); err != nil {
+		return err
+	}
+	writeXML(w, http.StatusOK, s3CompleteUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + name,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     `"` + digest + `"`,
+	})
+	return nil
+}
+
+func (s *FileServer) s3AbortUpload(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	u, err := s.s3Upload(r, bucket, key)
+	if err != nil {
+		return err
+	}
+	parts, err := s.DB.ListUploadParts(r.Context(), u.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.removeUpload(r.Context(), u.ID, parts); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// removeUpload deletes the parts of an upload and forgets it.
+func (s *FileServer) removeUpload(ctx context.Context, uploadID string, parts []dbpkg.UploadPart) error {
+	for _, p := range parts {
+		if err := s.store.Delete(uploadPartKey(uploadID, p.PartNumber)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return s.DB.DeleteUpload(ctx, uploadID)
+}
+
+// partReader opens a part when it is first read, so that assembling an
+// upload keeps a single part open at a time.
+type partReader struct {
+	store *Store
+	key   string
+	r     io.Reader
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	if p.r == nil {
+		_, r, err := p.store.Read(p.key)
+		if err != nil {
+			return 0, err
+		}
+		p.r = r
+	}
+	n, err := p.r.Read(b)
+	if err == io.EOF {
+		if c, ok := p.r.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes the aws-chunked encoding of SDK uploads:
+// chunks of "<hex size>[;chunk-signature=...]\r\n<data>\r\n" ending with a
+// chunk of size zero and optional trailers. Signatures and trailing
+// checksums are not verified.
+type awsChunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("aws-chunked: bad chunk size %q", size)
+		}
+		if n == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = n
+	}
+
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+	if c.left == 0 {
+		// the CRLF that ends the chunk
+		if _, err := c.r.Discard(2); err != nil {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3Objects(t *testing.T) {
+	servers := newTestCluster(t, 2, func() FileServerOpts {
+		return FileServerOpts{
+			ReplicationFactor: 1,
+			DB:                newTestDB(t),
+		}
+	})
+	owner := servers[0]
+	srv := httptest.NewServer(owner.S3Handler())
+	defer srv.Close()
+	url := srv.URL + "/backups/2024/db.dump"
+	data := randomData(3, 300*1024)
+	digest := bytesHash(data)
+
+	resp, body := httpDo(t, http.MethodPut, url, bytes.NewReader(data))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), "<Code>NoSuchBucket</Code>")
+
+	resp, _ = httpDo(t, http.MethodPut, srv.URL+"/backups", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body = httpDo(t, http.MethodPut, srv.URL+"/backups", nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Contains(t, string(body), "<Code>BucketAlreadyOwnedByYou</Code>")
+	resp, _ = httpDo(t, http.MethodPut, srv.URL+"/Not_Valid", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, body = httpDo(t, http.MethodGet, srv.URL+"/", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var buckets s3ListBucketsResult
+	assert.Nil(t, xml.Unmarshal(body, &buckets))
+	assert.Len(t, buckets.Buckets, 1)
+	assert.Equal(t, "backups", buckets.Buckets[0].Name)
+
+	resp, _ = httpDo(t, http.MethodPut, url, bytes.NewReader(data))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"`+digest+`"`, resp.Header.Get("ETag"))
+	// the object is the file bucket/key
+	assert.True(t, owner.store.Has("backups/2024/db.dump"))
+
+	resp, body = httpDo(t, http.MethodGet, url, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, body)
+	resp, body = httpDo(t, http.MethodGet, url, nil, "Range", "bytes=1000-1999")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, data[1000:2000], body)
+	resp, body = httpDo(t, http.MethodHead, url, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(data)), resp.Header.Get("Content-Length"))
+	assert.Equal(t, `"`+digest+`"`, resp.Header.Get("ETag"))
+	assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+	assert.Empty(t, body)
+
+	// SDKs stream uploads in aws-chunked encoding
+	chunked := fmt.Sprintf("%x;chunk-signature=abc\r\n%s\r\n%x;chunk-signature=def\r\n%s\r\n0;chunk-signature=ghi\r\nx-amz-checksum-crc32:AAAAAA==\r\n\r\n",
+		1000, data[:1000], 500, data[1000:1500])
+	resp, _ = httpDo(t, http.MethodPut, srv.URL+"/backups/chunked", strings.NewReader(chunked),
+		"X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, body = httpDo(t, http.MethodGet, srv.URL+"/backups/chunked", nil)
+	assert.Equal(t, data[:1500], body)
+	resp, _ = httpDo(t, http.MethodPut, srv.URL+"/backups/cut", strings.NewReader(chunked[:800]),
+		"X-Amz-Content-Sha256", "STREAMING-UNSIGNED-PAYLOAD-TRAILER")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.False(t, owner.store.Has("backups/cut"))
+
+	resp, body = httpDo(t, http.MethodDelete, srv.URL+"/backups", nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Contains(t, string(body), "<Code>BucketNotEmpty</Code>")
+
+	for _, key := range []string{"2024/db.dump", "chunked"} {
+		resp, _ = httpDo(t, http.MethodDelete, srv.URL+"/backups/"+key, nil)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+	resp, body = httpDo(t, http.MethodGet, url, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), "<Code>NoSuchKey</Code>")
+	resp, _ = httpDo(t, http.MethodHead, url, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	// deleting a missing object succeeds
+	resp, _ = httpDo(t, http.MethodDelete, url, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, _ = httpDo(t, http.MethodDelete, srv.URL+"/backups", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = httpDo(t, http.MethodHead, srv.URL+"/backups", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestS3ListObjects(t *testing.T) {
+	s := newTestServer(t, FileServerOpts{DB: newTestDB(t)})
+	srv := httptest.NewServer(s.S3Handler())
+	defer srv.Close()
+	httpDo(t, http.MethodPut, srv.URL+"/photos", nil)
+	keys := []string{"2023/a.jpg", "2023/b.jpg", "2024/c.jpg", "2024/d/e.jpg", "index.html", "zoo.jpg"}
+	for _, key := range keys {
+		resp, _ := httpDo(t, http.MethodPut, srv.URL+"/photos/"+key, strings.NewReader(key))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	// files outside the bucket are not listed
+	_, err := s.Store("photosphere/x.jpg", strings.NewReader("x"))
+	assert.Nil(t, err)
+
+	list := func(query string) s3ListBucketResult {
+		resp, body := httpDo(t, http.MethodGet, srv.URL+"/photos?list-type=2&"+query, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var res s3ListBucketResult
+		assert.Nil(t, xml.Unmarshal(body, &res))
+		return res
+	}
+	names := func(res s3ListBucketResult) []string {
+		var out []string
+		for _, o := range res.Contents {
+			out = append(out, o.Key)
+		}
+		for _, cp := range res.CommonPrefixes {
+			out = append(out, cp.Prefix)
+		}
+		return out
+	}
+
+	res := list("")
+	assert.Equal(t, keys, names(res))
+	assert.Equal(t, int64(len("index.html")), res.Contents[4].Size)
+	assert.Equal(t, `"`+bytesHash([]byte("index.html"))+`"`, res.Contents[4].ETag)
+	assert.False(t, res.IsTruncated)
+
+	assert.Equal(t, []string{"2024/c.jpg", "2024/d/e.jpg"}, names(list("prefix=2024/")))
+	assert.Equal(t, []string{"index.html", "zoo.jpg", "2023/", "2024/"}, names(list("delimiter=/")))
+	assert.Equal(t, []string{"2024/c.jpg", "2024/d/"}, names(list("prefix=2024/&delimiter=/")))
+	assert.Equal(t, []string{"index.html", "zoo.jpg"}, names(list("start-after=2024/d/e.jpg")))
+
+	// pages of two, continuing after the last key or common prefix
+	var got []string
+	query := "delimiter=/&max-keys=2"
+	for pages := 0; ; pages++ {
+		assert.Less(t, pages, 3)
+		res := list(query)
+		assert.Equal(t, 2, *res.KeyCount)
+		got = append(got, names(res)...)
+		if !res.IsTruncated {
+			break
+		}
+		query = "delimiter=/&max-keys=2&continuation-token=" + res.NextContinuationToken
+	}
+	assert.ElementsMatch(t, []string{"2023/", "2024/", "index.html", "zoo.jpg"}, got)
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	s := newTestServer(t, FileServerOpts{DB: newTestDB(t)})
+	srv := httptest.NewServer(s.S3Handler())
+	defer srv.Close()
+	httpDo(t, http.MethodPut, srv.URL+"/videos", nil)
+	url := srv.URL + "/videos/movie.mp4"
+	data := randomData(4, 900*1024)
+
+	resp, body := httpDo(t, http.MethodPost, url+"?uploads", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var upload s3InitiateUploadResult
+	assert.Nil(t, xml.Unmarshal(body, &upload))
+	assert.NotEmpty(t, upload.UploadID)
+
+	// parts may be uploaded in any order, and uploaded again
+	parts := [][]byte{data[:400*1024], data[400*1024 : 800*1024], data[800*1024:]}
+	etags := make([]string, len(parts))
+	for _, i := range []int{2, 0, 1, 0} {
+		resp, _ := httpDo(t, http.MethodPut, fmt.Sprintf("%s?partNumber=%d&uploadId=%s", url, i+1, upload.UploadID), bytes.NewReader(parts[i]))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		etags[i] = resp.Header.Get("ETag")
+		assert.Equal(t, `"`+bytesHash(parts[i])+`"`, etags[i])
+	}
+	// a retry that fails keeps the part uploaded before
+	cut := fmt.Sprintf("%x\r\n%s", len(parts[1]), parts[1][:1000])
+	resp, _ = httpDo(t, http.MethodPut, url+"?partNumber=2&uploadId="+upload.UploadID, strings.NewReader(cut),
+		"X-Amz-Content-Sha256", "STREAMING-UNSIGNED-PAYLOAD-TRAILER")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.True(t, s.store.Has(uploadPartKey(upload.UploadID, 2)))
+	resp, body = httpDo(t, http.MethodGet, url+"?uploadId="+upload.UploadID, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var listed s3ListPartsResult
+	assert.Nil(t, xml.Unmarshal(body, &listed))
+	assert.Len(t, listed.Parts, 3)
+
+	complete := func(order ...int) (*http.Response, []byte) {
+		var xmlBody strings.Builder
+		xmlBody.WriteString("<CompleteMultipartUpload>")
+		for _, i := range order {
+			fmt.Fprintf(&xmlBody, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, etags[i])
+		}
+		xmlBody.WriteString("</CompleteMultipartUpload>")
+		return httpDo(t, http.MethodPost, url+"?uploadId="+upload.UploadID, strings.NewReader(xmlBody.String()))
+	}
+	resp, body = complete(1, 0, 2)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "<Code>InvalidPartOrder</Code>")
+	etags[1] = `"bogus"`
+	resp, body = complete(0, 1, 2)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "<Code>InvalidPart</Code>")
+	etags[1] = listed.Parts[1].ETag
+
+	resp, body = complete(0, 1, 2)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var completed s3CompleteUploadResult
+	assert.Nil(t, xml.Unmarshal(body, &completed))
+	assert.Equal(t, `"`+bytesHash(data)+`"`, completed.ETag)
+	_, body = httpDo(t, http.MethodGet, url, nil)
+	assert.Equal(t, data, body)
+
+	// the parts are gone with the upload
+	for i := range parts {
+		assert.False(t, s.store.Has(uploadPartKey(upload.UploadID, i+1)))
+	}
+	resp, body = complete(0, 1, 2)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), "<Code>NoSuchUpload</Code>")
+
+	// an aborted upload leaves nothing behind
+	_, body = httpDo(t, http.MethodPost, url+"?uploads", nil)
+	assert.Nil(t, xml.Unmarshal(body, &upload))
+	httpDo(t, http.MethodPut, url+"?partNumber=1&uploadId="+upload.UploadID, bytes.NewReader(parts[0]))
+	resp, _ = httpDo(t, http.MethodDelete, url+"?uploadId="+upload.UploadID, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.False(t, s.store.Has(uploadPartKey(upload.UploadID, 1)))
+	resp, _ = httpDo(t, http.MethodPut, url+"?partNumber=2&uploadId="+upload.UploadID, bytes.NewReader(parts[1]))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
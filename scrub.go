@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"time"
+
+	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+)
+
+const (
+	// DefaultScrubInterval is how often the local store is scrubbed.
+	DefaultScrubInterval = 24 * time.Hour
+	// DefaultScrubRate is how many bytes per second the background
+	// scrubber reads, so it does not compete with transfers for the disk.
+	DefaultScrubRate = 8 << 20
+)
+
+// ScrubReport is the outcome of scrubbing the local store.
+type ScrubReport struct {
+	// Objects and Bytes count the objects that were re-hashed and the
+	// bytes read doing so.
+	Objects int
+	Bytes   int64
+	// OrphanChunks and OrphanBytes count the chunks no object referred to,
+	// which were removed.
+	OrphanChunks int
+	OrphanBytes  int64
+	// Problems are the corrupt objects and the files of ours that are
+	// missing from the store.
+	Problems []ScrubProblem
+}
+
+// ScrubProblem is an object that failed scrubbing.
+type ScrubProblem struct {
+	// Key is the name of one of our files, the id of a replica we hold for
+	// another node, or the path of an object we know nothing about.
+	Key string
+	// Missing is set for a file of ours that is not in the store, Err
+	// tells what is wrong with a corrupt object.
+	Missing bool
+	Err     error
+	// Repair tells what was done about it.
+	Repair string
+}
+
+func (p ScrubProblem) String() string {
+	if p.Missing {
+		return fmt.Sprintf("missing '%s': %s", p.Key, p.Repair)
+	}
+	return fmt.Sprintf("corrupt '%s': %v: %s", p.Key, p.Err, p.Repair)
+}
+
+// scrubLoop scrubs the local store every ScrubInterval.
+func (s *FileServer) scrubLoop() {
+	ticker := time.NewTicker(s.ScrubInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quitch:
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-s.quitch:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		report, err := s.Scrub(ctx, s.ScrubRate)
+		cancel()
+		if err != nil {
+			log.Printf("[%s] Scrub: %v\n", s.Transport.Address(), err)
+			continue
+		}
+		for _, p := range report.Problems {
+			log.Printf("[%s] Scrub: %s\n", s.Transport.Address(), p)
+		}
+		fmt.Printf("[%s] Scrubbed %d objects (%d bytes), %d problem(s), removed %d orphan chunks (%d bytes)\n",
+			s.Transport.Address(), report.Objects, report.Bytes, len(report.Problems), report.OrphanChunks, report.OrphanBytes)
+	}
+}
+
+// scrubObject is what we know about an object in the store.
+type scrubObject struct {
+	key    string
+	digest string
+	// ours is set for our own files, owners lists the nodes we hold a
+	// replica for
+	ours   bool
+	owners []string
+}
+
+// Scrub re-hashes every object in the local store, reading at most rate
+// bytes per second (no limit if rate is 0 or less). Corrupt objects are
+// quarantined. A corrupt or missing file of ours is fetched again from a
+// peer holding a replica; a corrupt replica we hold for another node is
+// dropped, so the owner's repair places a new one. Chunks no object refers
+// to are removed last.
+func (s *FileServer) Scrub(ctx context.Context, rate int64) (*ScrubReport, error) {
+	s.scrubLock.Lock()
+	defer s.scrubLock.Unlock()
+
+	files, known, err := s.scrubObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ScrubReport{}
+	t := throttle{ctx: ctx, rate: rate, start: time.Now()}
+	seen := make(map[string]bool)
+	err = s.store.WalkObjects(func(path string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path = filepath.Clean(path)
+		seen[path] = true
+		obj, ok := known[path]
+		if !ok {
+			obj.key = path
+		}
+
+		report.Objects++
+		err := s.store.verifyObject(path, obj.digest, func(n int) {
+			report.Bytes += int64(n)
+			t.wait(n)
+		})
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			// an object deleted while we walk is gone, not corrupt
+			return nil
+		}
+		if !errors.Is(err, ErrCorrupt) {
+			return err
+		}
+
+		if err := s.store.quarantineObject(path); err != nil {
+			return err
+		}
+		problem := ScrubProblem{Key: obj.key, Err: err}
+		switch {
+		case obj.ours:
+			problem.Repair = s.refetch(ctx, obj.key)
+		case len(obj.owners) > 0:
+			problem.Repair = s.dropReplica(ctx, obj.key, obj.owners)
+		default:
+			problem.Repair = "quarantined"
+		}
+		report.Problems = append(report.Problems, problem)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for _, f := range files {
+		if seen[filepath.Clean(s.store.FullPathForKey(f.Name))] {
+			continue
+		}
+		report.Problems = append(report.Problems, ScrubProblem{
+			Key:     f.Name,
+			Missing: true,
+			Repair:  s.refetch(ctx, f.Name),
+		})
+	}
+
+	report.OrphanChunks, report.OrphanBytes, err = s.store.SweepChunks(ctx)
+	return report, err
+}
+
+// scrubObjects returns our files and what we know about the objects in
+// the store by path: our files and the replicas we hold for other nodes.
+func (s *FileServer) scrubObjects(ctx context.Context) ([]dbpkg.File, map[string]scrubObject, error) {
+	known := make(map[string]scrubObject)
+	if s.DB == nil {
+		return nil, known, nil
+	}
+
+	replicas, err := s.DB.ListSharesByDirection(ctx, dbpkg.ShareInbound)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, sh := range replicas {
+		// moves an object still stored under its legacy path
+		s.store.Has(sh.FileID)
+		path := filepath.Clean(s.store.FullPathForKey(sh.FileID))
+		obj := known[path]
+		obj.key = sh.FileID
+		obj.owners = append(obj.owners, sh.PeerID)
+		known[path] = obj
+	}
+
+	files, err := s.DB.ListFiles(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range files {
+		s.store.Has(f.Name)
+		known[filepath.Clean(s.store.FullPathForKey(f.Name))] = scrubObject{key: f.Name, digest: f.Digest, ours: true}
+	}
+	return files, known, nil
+}
+
+// refetch fetches one of our files again from a peer and tells how that
+// went.
+func (s *FileServer) refetch(ctx context.Context, key string) string {
+	_, r, err := s.Get(ctx, key)
+	if err != nil {
+		return fmt.Sprintf("fetching it again failed: %v", err)
+	}
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+	return "fetched again from a peer"
+}
+
+// dropReplica forgets a replica we no longer have, so the repair of its
+// owners places a new one.
+func (s *FileServer) dropReplica(ctx context.Context, hashedKey string, owners []string) string {
+	s.dht.Values.Delete(fileID(hashedKey))
+	for _, owner := range owners {
+		if err := s.DB.DeleteShare(ctx, hashedKey, owner, dbpkg.ShareInbound); err != nil {
+			return fmt.Sprintf("quarantined, forgetting the replica failed: %v", err)
+		}
+	}
+	return "quarantined, the owner places a new replica"
+}
+
+// throttle paces reads to rate bytes per second, a rate of 0 or less does
+// not limit them.
+type throttle struct {
+	ctx   context.Context
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttle) wait(n int) {
+	if t.rate <= 0 {
+		return
+	}
+	t.read += int64(n)
+	due := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	ahead := due - time.Since(t.start)
+	if ahead <= 0 {
+		return
+	}
+	timer := time.NewTimer(ahead)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-t.ctx.Done():
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// flipBit corrupts the first chunk of the object key on disk.
+func flipBit(t *testing.T, s *Store, key string) {
+	m, err := s.ReadManifest(key)
+	assert.Nil(t, err)
+	chunk, err := s.ReadChunk(m.Chunks[0].Hash)
+	assert.Nil(t, err)
+	chunk[len(chunk)/2] ^= 1
+	assert.Nil(t, os.WriteFile(s.chunkPath(m.Chunks[0].Hash), chunk, 0o644))
+}
+
+func TestScrubRepairsTheStore(t *testing.T) {
+	servers := newTestCluster(t, 2, func() FileServerOpts {
+		return FileServerOpts{
+			ReplicationFactor: 1,
+			DB:                newTestDB(t),
+		}
+	})
+	owner, holder := servers[0], servers[1]
+	ctx := context.Background()
+
+	files := map[string][]byte{
+		"rotten.bin":  randomData(10, 200*1024),
+		"deleted.bin": randomData(11, 200*1024),
+		"replica.bin": randomData(12, 200*1024),
+	}
+	for name, data := range files {
+		_, err := owner.Store(name, bytes.NewReader(data))
+		assert.Nil(t, err)
+	}
+
+	report, err := owner.Scrub(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Objects)
+	assert.Empty(t, report.Problems)
+
+	flipBit(t, owner.store, "rotten.bin")
+	assert.Nil(t, owner.store.Delete("deleted.bin"))
+	flipBit(t, holder.store, holder.hashKey("replica.bin"))
+
+	report, err = owner.Scrub(ctx, 0)
+	assert.Nil(t, err)
+	problems := map[string]ScrubProblem{}
+	for _, p := range report.Problems {
+		problems[p.Key] = p
+	}
+	assert.Len(t, problems, 2)
+	assert.ErrorIs(t, problems["rotten.bin"].Err, ErrCorrupt)
+	assert.Equal(t, "fetched again from a peer", problems["rotten.bin"].Repair)
+	assert.True(t, problems["deleted.bin"].Missing)
+	assert.Equal(t, "fetched again from a peer", problems["deleted.bin"].Repair)
+	for _, name := range []string{"rotten.bin", "deleted.bin"} {
+		assert.Nil(t, owner.store.Verify(name, bytesHash(files[name])))
+	}
+
+	// the holder cannot repair a replica, it drops it for the owner to replace
+	report, err = holder.Scrub(ctx, 0)
+	assert.Nil(t, err)
+	assert.Len(t, report.Problems, 1)
+	assert.Equal(t, holder.hashKey("replica.bin"), report.Problems[0].Key)
+	assert.False(t, holder.store.Has(holder.hashKey("replica.bin")))
+	shares, err := holder.DB.ListShares(ctx, holder.hashKey("replica.bin"), dbpkg.ShareInbound)
+	assert.Nil(t, err)
+	assert.Empty(t, shares)
+}
+
+func TestThrottleLimitsTheRate(t *testing.T) {
+	start := time.Now()
+	th := throttle{ctx: context.Background(), rate: 1 << 20, start: start}
+	for range 4 {
+		th.wait(64 << 10)
+	}
+	// 256 KiB at 1 MiB/s
+	assert.GreaterOrEqual(t, time.Since(start), 240*time.Millisecond)
+}
@@ -2,21 +2,29 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"crypto/ed25519"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"context"
 
 	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+	"github.com/TinySkillet/DecentralizedP2PStorage/dht"
 	"github.com/TinySkillet/DecentralizedP2PStorage/p2p"
 )
 
 func (s *FileServer) Start() error {
+	if err := s.store.RemoveTemp(); err != nil {
+		return err
+	}
 	if err := s.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
@@ -24,6 +32,12 @@ func (s *FileServer) Start() error {
 	if len(s.BootstrapNodes) != 0 {
 		s.bootstrapNetwork()
 	}
+	go s.maintainDHT()
+	// the first repair also renames files stored under old identifiers
+	s.scheduleRepair()
+	go s.repairLoop()
+	go s.rekeyLoop()
+	go s.scrubLoop()
 
 	s.loop()
 
@@ -43,6 +57,7 @@ func (s *FileServer) loop() {
 			err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg)
 			if err != nil {
 				log.Printf("[%s] Decoding error: %v", s.Transport.Address(), err)
+				continue
 			}
 
 			if err := s.handleMessage(rpc.From, &msg); err != nil {
@@ -58,65 +73,229 @@ func (s *FileServer) loop() {
 func (s *FileServer) handleMessage(from string, msg *Message) error {
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
+		// transfers run on their own stream, so they must not hold up the loop
+		go s.handleAsync(from, func() error { return s.handleMessageStoreFile(from, msg.ID, v) })
+	case MessageStoreFileResponse:
+		s.deliver(msg.ID, from, v)
 	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
+		return s.handleMessageGetFile(from, msg.ID, v)
+	case MessageGetFileResponse:
+		return s.handleMessageGetFileResponse(from, msg.ID, v)
+	case MessageFetchFile:
+		go s.handleAsync(from, func() error { return s.handleMessageFetchFile(from, v) })
 	case MessageDeleteFile:
 		return s.handleMessageDeleteFile(from, v)
+	case MessageReplicateFile:
+		go s.handleAsync(from, func() error { return s.handleMessageReplicateFile(from, msg.ID, v) })
+	case MessageGetUsage:
+		go s.handleAsync(from, func() error { return s.handleMessageGetUsage(from, msg.ID) })
+	case MessageGetUsageResponse:
+		s.deliver(msg.ID, from, v)
+	case MessageShareFile:
+		go s.handleAsync(from, func() error { return s.handleMessageShareFile(from, msg.ID, v) })
+	case MessageShareFileResponse:
+		s.deliver(msg.ID, from, v)
+	case MessageRenameFile:
+		go s.handleAsync(from, func() error { return s.handleMessageRenameFile(from, msg.ID, v) })
+	case MessageDHTPing, MessageDHTFindNode, MessageDHTFindValue, MessageDHTStore:
+		return s.handleMessageDHT(from, msg.ID, v)
+	case MessageDHTResponse:
+		s.deliver(msg.ID, from, v)
 	}
 	return nil
 }
 
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, found := s.peers[from]
-	if !found {
-		return fmt.Errorf("peer (%s) could not be found in the peers list", from)
+func (s *FileServer) handleAsync(from string, handle func() error) {
+	if err := handle(); err != nil {
+		log.Printf("[%s] Error while handling message from %s: %v\n", s.Transport.Address(), from, err)
+	}
+}
+
+// handleMessageStoreFile writes the replica a peer streams to us and tells
+// it whether that worked.
+func (s *FileServer) handleMessageStoreFile(from string, id uint64, msg MessageStoreFile) error {
+	resp := MessageStoreFileResponse{Key: msg.Key}
+	err := s.storeReplica(from, msg)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if sendErr := s.send(from, &Message{ID: id, Payload: resp}); sendErr != nil && err == nil {
+		return sendErr
+	}
+	return err
+}
+
+func (s *FileServer) storeReplica(from string, msg MessageStoreFile) error {
+	stream, err := s.acceptStream(from, msg.StreamID)
+	if err != nil {
+		return err
 	}
+	defer stream.Close()
 
-	n, err := s.store.Write(msg.Key, io.LimitReader(peer, msg.Size))
+	w, err := s.store.CreateManifest(msg.Key)
+	if err != nil {
+		return err
+	}
+	chunks, received, err := s.receiveChunks(stream, w)
 	if err != nil {
+		w.Discard()
+		return fmt.Errorf("receiving '%s': %w", msg.Key, err)
+	}
+	if err := w.Close(); err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] Written %d bytes to disk\n", s.Transport.Address(), n)
+	// lookups for the file end at the first node that records it holds a replica
+	s.dht.Values.Put(fileID(msg.Key), []byte(s.Transport.ID()))
+
+	if s.DB != nil {
+		owner := msg.Owner
+		if owner == "" {
+			owner = from
+		}
+		_ = s.DB.AddShare(context.Background(), dbpkg.Share{
+			FileID:    msg.Key,
+			PeerID:    owner,
+			Direction: dbpkg.ShareInbound,
+		})
+	}
+
+	fmt.Printf("[%s] Written %d bytes to disk, %d of %d chunks were stored already\n",
+		s.Transport.Address(), w.Size(), chunks-received, chunks)
 
-	peer.CloseStream()
 	return nil
 }
 
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	fmt.Printf("[%s] Received request to serve file '%s'\n", s.Transport.Address(), msg.Key)
+// receiveChunks reads the batches of a replica from the stream, asks for
+// the chunks we do not have and adds all of them to w. It returns the number
+// of chunks in the replica and how many of them were sent.
+func (s *FileServer) receiveChunks(stream io.ReadWriter, w *ManifestWriter) (int, int, error) {
+	chunks, received := 0, 0
+	for {
+		batch, err := readChunkBatch(stream)
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(batch) == 0 {
+			return chunks, received, nil
+		}
 
-	if !s.store.Has(msg.Key) {
-		return fmt.Errorf("[%s] Received request to serve file %s but it does not exist on disk", s.Transport.Address(), msg.Key)
+		// only the chunks we do not have yet are sent
+		missing := s.missingChunks(batch)
+		if err := writeChunkList(stream, missing); err != nil {
+			return 0, 0, err
+		}
+
+		for i, c := range batch {
+			if len(missing) == 0 || missing[0] != i {
+				if err := w.Add(c); err != nil {
+					return 0, 0, err
+				}
+				continue
+			}
+			missing = missing[1:]
+
+			data := make([]byte, c.Size)
+			if _, err := io.ReadFull(stream, data); err != nil {
+				return 0, 0, fmt.Errorf("stream ended in chunk %d: %w", chunks+i, err)
+			}
+			if bytesHash(data) != c.Hash {
+				return 0, 0, fmt.Errorf("chunk %d does not match its hash", chunks+i)
+			}
+			if _, err := w.Put(data); err != nil {
+				return 0, 0, err
+			}
+			received++
+		}
+		chunks += len(batch)
 	}
+}
 
-	fmt.Printf("[%s] Serving file '%s' over the network\n", s.Transport.Address(), msg.Key)
+func (s *FileServer) handleMessageGetFile(from string, id uint64, msg MessageGetFile) error {
+	fmt.Printf("[%s] Received lookup for file '%s' from %s\n", s.Transport.Address(), msg.Key, from)
 
-	size, r, err := s.store.Read(msg.Key)
+	resp := MessageGetFileResponse{
+		Key:    msg.Key,
+		Status: FileNotFound,
+	}
+
+	if s.store.Has(msg.Key) {
+		// replicas stored as a single file before chunking are chunked
+		// when they are fetched, their size stays the same
+		size, r, err := s.store.readStream(msg.Key)
+		if err != nil {
+			resp.Status = FileError
+			resp.Error = err.Error()
+		} else {
+			r.Close()
+			resp.Status = FileFound
+			resp.Size = size
+		}
+	}
+
+	return s.send(from, &Message{ID: id, Payload: resp})
+}
+
+func (s *FileServer) handleMessageGetFileResponse(from string, id uint64, msg MessageGetFileResponse) error {
+	if !s.deliver(id, from, msg) {
+		// the request was already answered by another peer or timed out
+		fmt.Printf("[%s] Dropping late response %d from %s for file '%s'\n", s.Transport.Address(), id, from, msg.Key)
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessageGetUsage(from string, id uint64) error {
+	used, err := s.store.Usage()
 	if err != nil {
 		return err
 	}
+	return s.send(from, &Message{ID: id, Payload: MessageGetUsageResponse{Used: used}})
+}
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		defer rc.Close()
+func (s *FileServer) handleMessageFetchFile(from string, msg MessageFetchFile) error {
+	// closing the stream on any error tells the requester to stop waiting
+	stream, err := s.acceptStream(from, msg.StreamID)
+	if err != nil {
+		return err
 	}
+	defer stream.Close()
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not found in peer list", from)
+	if !s.store.Has(msg.Key) {
+		return fmt.Errorf("[%s] Received request to serve file %s but it does not exist on disk", s.Transport.Address(), msg.Key)
 	}
 
-	// send the 'IncomingStream' byte to the peer first
-	peer.Send([]byte{p2p.IncomingStream})
-
-	// then we can send the file size
-	binary.Write(peer, binary.LittleEndian, size)
+	fmt.Printf("[%s] Serving file '%s' over the network\n", s.Transport.Address(), msg.Key)
 
-	n, err := io.Copy(peer, r)
+	chunks, err := s.storedChunks(msg.Key)
 	if err != nil {
 		return err
 	}
+	defer chunks.Close()
+
+	var n int64
+	for {
+		c, load, err := chunks.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		data, err := load()
+		if err != nil {
+			return err
+		}
+		if err := writeChunkRef(stream, c); err != nil {
+			return err
+		}
+		if _, err := stream.Write(data); err != nil {
+			return err
+		}
+		n += c.Size
+	}
+	if err := writeChunkRef(stream, ChunkRef{}); err != nil {
+		return err
+	}
 
 	fmt.Printf("[%s] Written %d bytes over the network to %s\n", s.Transport.Address(), n, from)
 	return nil
@@ -125,6 +304,11 @@ func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error
 func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
 	fmt.Printf("[%s] Received delete request for file with hash '%s' from %s\n", s.Transport.Address(), msg.Key, from)
 
+	s.dht.Values.Delete(fileID(msg.Key))
+	if s.DB != nil {
+		_ = s.DB.DeleteShare(context.Background(), msg.Key, from, dbpkg.ShareInbound)
+	}
+
 	// The msg.Key is the hashed key. Files can be stored in two ways:
 	// 1. Locally stored with original key (metadata in DB, file stored with hashed path)
 	// 2. Received from peer with hashed key (no metadata, file stored with double-hashed path)
@@ -170,6 +354,10 @@ func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile)
 }
 
 func (s *FileServer) stream(msg *Message) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
 
 	// Peer implements net.Conn which implements Writer interface
 	// therefore we can use Peer as a writer
@@ -179,7 +367,7 @@ func (s *FileServer) stream(msg *Message) error {
 	}
 
 	mw := io.MultiWriter(peers...)
-	return gob.NewEncoder(mw).Encode(msg)
+	return p2p.WriteFrame(mw, p2p.IncomingMessage, buf.Bytes())
 }
 
 func (s *FileServer) broadcast(msg *Message) error {
@@ -188,13 +376,17 @@ func (s *FileServer) broadcast(msg *Message) error {
 		return err
 	}
 
+	frame := new(bytes.Buffer)
+	if err := p2p.WriteFrame(frame, p2p.IncomingMessage, buf.Bytes()); err != nil {
+		return err
+	}
+
 	s.peersLock.Lock()
 	defer s.peersLock.Unlock()
 
 	for addr, peer := range s.peers {
 		fmt.Printf("[%s] Sending message to peer %s\n", s.Transport.Address(), addr)
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
+		if err := peer.Send(frame.Bytes()); err != nil {
 			fmt.Printf("[%s] Error sending message to peer %s: %v\n", s.Transport.Address(), addr, err)
 			return err
 		}
@@ -203,96 +395,504 @@ func (s *FileServer) broadcast(msg *Message) error {
 	return nil
 }
 
-func (s *FileServer) Get(key string) (int64, io.Reader, error) {
+// send encodes msg and writes it as a single frame to the peer with the given address.
+func (s *FileServer) send(to string, msg *Message) error {
+	peer, ok := s.peer(to)
+	if !ok {
+		return fmt.Errorf("peer %s not found in peer list", to)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	frame := new(bytes.Buffer)
+	if err := p2p.WriteFrame(frame, p2p.IncomingMessage, buf.Bytes()); err != nil {
+		return err
+	}
+	return peer.Send(frame.Bytes())
+}
+
+// acceptStream looks up the stream a peer opened for a transfer.
+func (s *FileServer) acceptStream(from string, id uint32) (*p2p.Stream, error) {
+	peer, ok := s.peer(from)
+	if !ok {
+		return nil, fmt.Errorf("peer %s not found in peer list", from)
+	}
+	stream, ok := peer.Stream(id)
+	if !ok {
+		return nil, fmt.Errorf("peer %s has no open stream %d", from, id)
+	}
+	return stream, nil
+}
+
+func (s *FileServer) peer(addr string) (p2p.Peer, bool) {
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+// newRequest allocates a request ID and registers a channel that receives
+// every response carrying that ID until the returned cancel func is called.
+func (s *FileServer) newRequest(size int) (uint64, <-chan response, func()) {
+	id := s.nextRequestID.Add(1)
+	ch := make(chan response, size)
+
+	s.pendingLock.Lock()
+	s.pending[id] = ch
+	s.pendingLock.Unlock()
+
+	return id, ch, func() {
+		s.pendingLock.Lock()
+		delete(s.pending, id)
+		s.pendingLock.Unlock()
+	}
+}
+
+// deliver hands a response to the request waiting on id. It reports false
+// when nobody is waiting for it (anymore).
+func (s *FileServer) deliver(id uint64, from string, payload any) bool {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	ch, ok := s.pending[id]
+	if !ok {
+		return false
+	}
+
+	select {
+	case ch <- response{From: from, Payload: payload}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Get returns the content of a file, from our own copy if we have one and
+// it matches its digest, otherwise fetched from a peer holding a replica. A
+// corrupt copy of our own is quarantined and fetched again.
+func (s *FileServer) Get(ctx context.Context, key string) (int64, io.Reader, error) {
+	want := s.wantDigest(ctx, key)
 	if s.store.Has(key) {
-		fmt.Printf("[%s] File '%s' found locally! Serving file from disk...\n", s.Transport.Address(), key)
-		return s.store.Read(key)
+		err := s.store.Verify(key, want)
+		if err == nil {
+			fmt.Printf("[%s] File '%s' found locally! Serving file from disk...\n", s.Transport.Address(), key)
+			return s.store.Read(key)
+		}
+		if !errors.Is(err, ErrCorrupt) {
+			return 0, nil, err
+		}
+		log.Printf("[%s] Local copy of '%s' is corrupt, fetching it again: %v\n", s.Transport.Address(), key, err)
+		if err := s.store.Quarantine(key); err != nil {
+			return 0, nil, err
+		}
 	}
 
 	fmt.Printf("[%s] Did not find file '%s' locally, searching on network...\n", s.Transport.Address(), key)
 
+	dk, err := s.fileKey(ctx, s.hashKey(key))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	from, size, err := s.locateFile(ctx, s.hashKey(key))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	peer, ok := s.peer(from)
+	if !ok {
+		return 0, nil, fmt.Errorf("peer %s disconnected before the transfer started", from)
+	}
+
+	stream, err := peer.OpenStream()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer stream.Close()
+
 	msg := Message{
-		Payload: MessageGetFile{
-			Key: hashKey(key),
+		ID: s.nextRequestID.Add(1),
+		Payload: MessageFetchFile{
+			Key:      s.hashKey(key),
+			StreamID: stream.ID(),
 		},
 	}
-
-	if err := s.broadcast(&msg); err != nil {
+	if err := s.send(from, &msg); err != nil {
 		return 0, nil, err
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	pr, pw := io.Pipe()
+	go func() {
+		// without a digest to check, only a sealed replica can be trusted
+		pw.CloseWithError(decryptChunks(stream, size, dk, want != "", pw))
+	}()
+	n, err := s.store.WriteVerified(key, pr, want)
+	pr.Close()
+	if err != nil {
+		return 0, nil, fmt.Errorf("transfer of '%s' from %s: %w", key, from, err)
+	}
 
-	for _, peer := range s.peers {
-		// first read the file size so we can limit the amt of bytes
-		// that we read from the connection, so it will not keep hanging
+	fmt.Printf("[%s] Received %d bytes over the network from [%s]\n", s.Transport.Address(), n, from)
 
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
+	return s.store.Read(key)
+}
 
-		n, err := s.store.WriteDecrypt(s.EncryptionKey, key, io.LimitReader(peer, fileSize))
-		if err != nil {
-			return 0, nil, err
+// wantDigest returns the digest recorded for one of our files, empty if we
+// have no record of it or it was stored before digests were recorded.
+func (s *FileServer) wantDigest(ctx context.Context, key string) string {
+	if s.DB == nil {
+		return ""
+	}
+	f, err := s.DB.GetFile(ctx, s.hashKey(key))
+	if err != nil {
+		return ""
+	}
+	return f.Digest
+}
+
+// locateFile finds a node holding the file with the given (hashed) key. The
+// DHT lookup ends at a node that recorded a replica, or at the nodes closest
+// to the file, which are the ones a replica is stored on.
+func (s *FileServer) locateFile(ctx context.Context, hashedKey string) (string, int64, error) {
+	_, holder, closest, err := s.dht.FindValue(ctx, fileID(hashedKey))
+	switch {
+	case errors.Is(err, dht.ErrNoNodes):
+		return "", 0, ErrFileNotFound
+	case err == nil && holder.ID == s.dht.Self.ID:
+		// our own record, the replica we hold is not stored under the plain key
+		closest, err = s.dht.Lookup(ctx, fileID(hashedKey))
+	case err == nil:
+		// ask the holder first, the closest nodes should have a replica too
+		closest = slices.DeleteFunc(closest, func(c dht.Contact) bool { return c.ID == holder.ID })
+		closest = append([]dht.Contact{holder}, closest...)
+	case errors.Is(err, dht.ErrNotFound):
+		err = nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	return s.lookupFile(ctx, s.connectAll(ctx, closest), hashedKey)
+}
+
+// lookupFile asks the given peers whether they hold the file with the given
+// (hashed) key and returns the id of the first one that does, together with
+// the size of its copy.
+func (s *FileServer) lookupFile(ctx context.Context, peers []string, hashedKey string) (string, int64, error) {
+	if len(peers) == 0 {
+		return "", 0, ErrFileNotFound
+	}
+
+	id, responses, done := s.newRequest(len(peers))
+	defer done()
+
+	msg := Message{
+		ID: id,
+		Payload: MessageGetFile{
+			Key: hashedKey,
+		},
+	}
+
+	asked := 0
+	for _, peer := range peers {
+		if err := s.send(peer, &msg); err != nil {
+			fmt.Printf("[%s] Error sending message to peer %s: %v\n", s.Transport.Address(), peer, err)
+			continue
+		}
+		asked++
+	}
+
+	var lastErr error
+	for range asked {
+		select {
+		case resp := <-responses:
+			v := resp.Payload.(MessageGetFileResponse)
+			switch v.Status {
+			case FileFound:
+				return resp.From, v.Size, nil
+			case FileError:
+				lastErr = fmt.Errorf("peer %s: %s", resp.From, v.Error)
+			}
+		case <-ctx.Done():
+			return "", 0, fmt.Errorf("waiting for file lookup responses: %w", ctx.Err())
 		}
+	}
 
-		fmt.Printf("[%s] Received %d bytes over the network from [%s]\n", s.Transport.Address(), n, peer.RemoteAddr())
-		peer.CloseStream()
+	if lastErr != nil {
+		return "", 0, fmt.Errorf("%w: %v", ErrFileNotFound, lastErr)
 	}
+	return "", 0, ErrFileNotFound
+}
 
-	return s.store.Read(key)
+// ReplicaResult is the outcome of storing one replica of a file on a peer.
+type ReplicaResult struct {
+	Peer string
+	Err  error
+}
 
+// Store writes the file locally and replicates it to ReplicationFactor
+// peers picked by the placement strategy. Every replica is streamed on its
+// own, so a slow peer only delays its own copy. The returned results tell
+// which replicas were confirmed by their peer.
+func (s *FileServer) Store(key string, r io.Reader) ([]ReplicaResult, error) {
+	return s.storeWith(key, r, s.ReplicationFactor, s.Placement)
 }
 
-func (s *FileServer) Store(key string, r io.Reader) error {
+// storeWith stores a file like Store, placing n replicas with the given
+// strategy instead of the node's.
+func (s *FileServer) storeWith(key string, r io.Reader, n int, placement PlacementStrategy) ([]ReplicaResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	fileBuf := new(bytes.Buffer)
-	tee := io.TeeReader(r, fileBuf)
+	dk, err := s.fileKeyForStore(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 
-	size, err := s.store.Write(key, tee)
+	size, err := s.store.Write(key, r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Record file metadata if DB is configured
 	if s.DB != nil {
+		digest, err := s.store.Digest(key)
+		if err != nil {
+			return nil, err
+		}
 		_ = s.DB.InsertFileWithKey(context.Background(), dbpkg.File{
-			ID:        hashKey(key),
+			ID:        s.hashKey(key),
 			Name:      key,
-			Hash:      hashKey(key),
+			Hash:      s.hashKey(key),
+			Digest:    digest,
 			Size:      size,
 			LocalPath: s.store.FullPathForKey(key),
-		}, "default")
+		}, dk.ID)
 	}
 
-	msg := Message{
-		Payload: MessageStoreFile{
-			Key:  hashKey(key),
-			Size: size + 16, // IV which is 16 bytes is prepended
-		},
+	targets, err := s.placeReplicas(ctx, s.hashKey(key), n, placement)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := s.broadcast(&msg); err != nil {
+	results := make([]ReplicaResult, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.storeOn(target, key, dk)
+			results[i] = ReplicaResult{Peer: target, Err: err}
+		}()
+	}
+	wg.Wait()
+
+	stored := 0
+	for _, res := range results {
+		if res.Err != nil {
+			fmt.Printf("[%s] Replica of '%s' on %s failed: %v\n", s.Transport.Address(), key, res.Peer, res.Err)
+			continue
+		}
+		stored++
+		s.recordReplica(s.hashKey(key), res.Peer)
+	}
+
+	fmt.Printf("[%s] Stored %d bytes, replicated to %d of %d peer(s)\n", s.Transport.Address(), size, stored, len(targets))
+
+	return results, nil
+}
+
+// storeOn replicates one of our files to a peer, encrypted with its data key.
+func (s *FileServer) storeOn(peer, key string, dk dataKey) error {
+	chunks, err := s.encryptedChunks(key, dk)
+	if err != nil {
 		return err
 	}
+	defer chunks.Close()
 
-	time.Sleep(500 * time.Millisecond)
+	msg := MessageStoreFile{
+		Key:   s.hashKey(key),
+		Owner: s.Transport.ID(),
+	}
+	return s.sendReplica(peer, msg, chunks)
+}
 
-	peers := []io.Writer{}
+// placeReplicas picks the n peers the replicas of a file go to. The
+// candidates are the nodes closest to the file, the placement strategy
+// chooses among them.
+func (s *FileServer) placeReplicas(ctx context.Context, hashedKey string, n int, placement PlacementStrategy) ([]string, error) {
+	peers, err := s.closestPeers(ctx, hashedKey)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+	candidates := s.usage(ctx, peers)
+	chosen := placement.Place(hashedKey, candidates, n)
+
+	targets := make([]string, len(chosen))
+	for i, c := range chosen {
+		targets[i] = c.ID
+	}
+	return targets, nil
+}
+
+// usage asks the given peers how much data they store. Peers that do not
+// answer in time are reported with what we know, nothing.
+func (s *FileServer) usage(ctx context.Context, peers []string) []Candidate {
+	candidates := make([]Candidate, len(peers))
+	index := make(map[string]int, len(peers))
+	for i, peer := range peers {
+		candidates[i] = Candidate{ID: peer}
+		index[peer] = i
+	}
+	if len(peers) == 0 {
+		return candidates
 	}
 
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	n, err := copyEncrypt(s.EncryptionKey, fileBuf, mw)
+	id, responses, done := s.newRequest(len(peers))
+	defer done()
+
+	asked := 0
+	for _, peer := range peers {
+		if err := s.send(peer, &Message{ID: id, Payload: MessageGetUsage{}}); err == nil {
+			asked++
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	for range asked {
+		select {
+		case resp := <-responses:
+			if v, ok := resp.Payload.(MessageGetUsageResponse); ok {
+				candidates[index[resp.From]].Used = v.Used
+			}
+		case <-ctx.Done():
+			return candidates
+		}
+	}
+	return candidates
+}
+
+// recordReplica remembers that a peer holds a replica of one of our files,
+// so the repair loop can keep an eye on it.
+func (s *FileServer) recordReplica(hashedKey, peer string) {
+	if s.DB == nil {
+		return
+	}
+	_ = s.DB.AddShare(context.Background(), dbpkg.Share{
+		FileID:    hashedKey,
+		PeerID:    peer,
+		Direction: dbpkg.ShareOutbound,
+	})
+}
+
+// sendReplica announces the replica described by msg to a peer, streams
+// the chunks it is missing and waits until the peer confirms it has written
+// the replica.
+func (s *FileServer) sendReplica(to string, msg MessageStoreFile, chunks replicaChunks) error {
+	peer, ok := s.peer(to)
+	if !ok {
+		return fmt.Errorf("peer %s not found in peer list", to)
+	}
+
+	stream, err := peer.OpenStream()
 	if err != nil {
 		return err
 	}
+	defer stream.Close()
 
-	fmt.Printf("[%s] Received and written %d bytes to disk\n", s.Transport.Address(), n)
+	id, responses, done := s.newRequest(1)
+	defer done()
 
-	return nil
+	msg.StreamID = stream.ID()
+	if err := s.send(to, &Message{ID: id, Payload: msg}); err != nil {
+		return err
+	}
+
+	if err := sendChunks(stream, chunks); err != nil {
+		return err
+	}
+
+	// the peer closes the stream once it is done with the replica, reading
+	// it tells us early when the connection is lost instead
+	streamErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, stream)
+		streamErr <- err
+	}()
+
+	timeout := time.After(replicaAckTimeout)
+	for {
+		select {
+		case resp := <-responses:
+			v, ok := resp.Payload.(MessageStoreFileResponse)
+			if !ok {
+				return fmt.Errorf("unexpected response %T", resp.Payload)
+			}
+			if v.Error != "" {
+				return errors.New(v.Error)
+			}
+			return nil
+		case err := <-streamErr:
+			if err != nil {
+				return err
+			}
+			// closed normally, the confirmation is on its way
+			streamErr = nil
+		case <-timeout:
+			return fmt.Errorf("no confirmation within %s", replicaAckTimeout)
+		}
+	}
+}
+
+// sendChunks writes the chunks of a replica to the stream in batches and
+// the chunks of each batch the peer asks for.
+func sendChunks(stream io.ReadWriter, chunks replicaChunks) error {
+	batch := make([]ChunkRef, 0, chunkBatchSize)
+	loads := make([]func() ([]byte, error), 0, chunkBatchSize)
+	for done := false; !done; {
+		batch, loads = batch[:0], loads[:0]
+		for len(batch) < chunkBatchSize {
+			c, load, err := chunks.Next()
+			if errors.Is(err, io.EOF) {
+				done = true
+				break
+			}
+			if err != nil {
+				return err
+			}
+			batch = append(batch, c)
+			loads = append(loads, load)
+		}
+
+		if err := writeChunkBatch(stream, batch); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		missing, err := readChunkList(stream, len(batch))
+		if err != nil {
+			return fmt.Errorf("reading missing chunks: %w", err)
+		}
+		for _, i := range missing {
+			data, err := loads[i]()
+			if err != nil {
+				return err
+			}
+			if _, err := stream.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the last batch was full, an empty one ends the replica
+	return writeChunkBatch(stream, nil)
 }
 
 func (s *FileServer) Delete(key string) error {
@@ -307,34 +907,49 @@ func (s *FileServer) Delete(key string) error {
 		fmt.Printf("[%s] Deleted file '%s' from local storage\n", s.Transport.Address(), key)
 	}
 
-	// Check if we have any peers connected
-	s.peersLock.Lock()
-	peerCount := len(s.peers)
-	peerAddrs := make([]string, 0, len(s.peers))
-	for addr := range s.peers {
-		peerAddrs = append(peerAddrs, addr)
-	}
-	s.peersLock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	fmt.Printf("[%s] Connected to %d peer(s): %v\n", s.Transport.Address(), peerCount, peerAddrs)
+	// the replicas live on the nodes closest to the file, and on the
+	// ones we placed them on
+	targets, err := s.closestPeers(ctx, s.hashKey(key))
+	if err != nil {
+		return err
+	}
+	if s.DB != nil {
+		shares, _ := s.DB.ListShares(ctx, s.hashKey(key), dbpkg.ShareOutbound)
+		for _, sh := range shares {
+			if !slices.Contains(targets, sh.PeerID) {
+				if id, err := s.connectPeer(ctx, sh.PeerID); err == nil {
+					targets = append(targets, id)
+				}
+			}
+		}
+		_ = s.DB.DeleteShares(ctx, s.hashKey(key))
+		// a file still recorded would be scrubbed and repaired back
+		if err := s.DB.DeleteFile(ctx, s.hashKey(key)); err != nil {
+			return err
+		}
+	}
 
-	if peerCount == 0 {
-		fmt.Printf("[%s] No peers connected, cannot broadcast delete message\n", s.Transport.Address())
+	if len(targets) == 0 {
+		fmt.Printf("[%s] No peers reachable, cannot send delete message\n", s.Transport.Address())
 		return nil
 	}
 
-	// Broadcast delete message to all peers
 	msg := Message{
 		Payload: MessageDeleteFile{
-			Key: hashKey(key),
+			Key: s.hashKey(key),
 		},
 	}
 
-	if err := s.broadcast(&msg); err != nil {
-		return err
+	for _, addr := range targets {
+		if err := s.send(addr, &msg); err != nil {
+			return err
+		}
 	}
 
-	fmt.Printf("[%s] Broadcasted delete request for '%s' to %d peer(s)\n", s.Transport.Address(), key, peerCount)
+	fmt.Printf("[%s] Sent delete request for '%s' to %d peer(s)\n", s.Transport.Address(), key, len(targets))
 	return nil
 }
 
@@ -342,18 +957,55 @@ func (s *FileServer) Stop() {
 	close(s.quitch)
 }
 
+// AuthorizePeer is the transport's AuthorizePeer hook. It lets in the nodes
+// whose public key is trusted in the database, or every node with
+// AllowAnyPeer or without a database.
+func (s *FileServer) AuthorizePeer(pub ed25519.PublicKey) error {
+	if s.AllowAnyPeer || s.DB == nil {
+		return nil
+	}
+	ok, err := s.DB.IsTrustedPeer(context.Background(), hex.EncodeToString(pub))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", p2p.ErrUntrustedPeer, p2p.NodeID(pub))
+	}
+	return nil
+}
+
 // in OnPeer
 func (s *FileServer) OnPeer(p p2p.Peer) error {
+	if p.ID() == s.Transport.ID() {
+		return fmt.Errorf("refusing connection to ourselves")
+	}
+
 	s.peersLock.Lock()
 	defer s.peersLock.Unlock()
-	s.peers[p.RemoteAddr().String()] = p
-	fmt.Printf("[%s] Connected with remote %s\n", s.Transport.Address(), p.RemoteAddr().String())
+
+	if contact, ok := peerContact(p); ok {
+		s.dht.Observe(contact)
+	}
+
+	if existing, ok := s.peers[p.ID()]; ok {
+		// both nodes dialed each other at the same time (or one of them
+		// several times). Both ends rank the connections the same way,
+		// so they end up keeping the same one.
+		if !s.preferConn(p, existing) {
+			return fmt.Errorf("already connected to %s", p.ID())
+		}
+		fmt.Printf("[%s] Replacing duplicate connection to %s\n", s.Transport.Address(), p.ID())
+		existing.Close()
+	}
+
+	s.peers[p.ID()] = p
+	fmt.Printf("[%s] Connected with remote %s at %s\n", s.Transport.Address(), p.ID(), p.ListenAddr())
 
 	if s.DB != nil {
 		now := time.Now()
 		_ = s.DB.UpsertPeer(context.Background(), dbpkg.Peer{
-			ID:       p.RemoteAddr().String(),
-			Address:  p.RemoteAddr().String(),
+			ID:       p.ID(),
+			Address:  p.ListenAddr(),
 			Status:   "connected",
 			LastSeen: &now,
 		})
@@ -361,6 +1013,45 @@ func (s *FileServer) OnPeer(p p2p.Peer) error {
 	return nil
 }
 
+// OnPeerDisconnect forgets a peer whose connection is gone, unless it was
+// already replaced by a newer connection to the same node.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+
+	if current, ok := s.peers[p.ID()]; !ok || current != p {
+		return
+	}
+	delete(s.peers, p.ID())
+	fmt.Printf("[%s] Disconnected from remote %s\n", s.Transport.Address(), p.ID())
+
+	// the peer may have taken replicas of our files with it
+	s.scheduleRepair()
+
+	if s.DB != nil {
+		now := time.Now()
+		_ = s.DB.UpsertPeer(context.Background(), dbpkg.Peer{
+			ID:       p.ID(),
+			Address:  p.ListenAddr(),
+			Status:   "disconnected",
+			LastSeen: &now,
+		})
+	}
+}
+
+// preferConn reports whether connection p should replace the existing
+// connection to the same node. Connections dialed by the node with the lower
+// id win, ties are broken by the connection id.
+func (s *FileServer) preferConn(p, existing p2p.Peer) bool {
+	lowerDialed := func(c p2p.Peer) bool {
+		return c.Outbound() == (s.Transport.ID() < c.ID())
+	}
+	if lowerDialed(p) != lowerDialed(existing) {
+		return lowerDialed(p)
+	}
+	return p.ConnID() > existing.ConnID()
+}
+
 func (s *FileServer) bootstrapNetwork() error {
 	for _, addr := range s.BootstrapNodes {
 		if len(addr) == 0 {
@@ -398,16 +1089,68 @@ func (s *FileServer) waitForPeers(timeout time.Duration) error {
 func init() {
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetFileResponse{})
+	gob.Register(MessageFetchFile{})
 	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageStoreFileResponse{})
+	gob.Register(MessageReplicateFile{})
+	gob.Register(MessageGetUsage{})
+	gob.Register(MessageGetUsageResponse{})
 }
 
 type FileServerOpts struct {
-	EncryptionKey     []byte
+	// EncryptionKey is the master key, it wraps the data keys of files.
+	// With a database, the active master key in the keys table takes over
+	// once the master key is rotated.
+	EncryptionKey []byte
+	// EncryptionKeyID is the id of EncryptionKey in the keys table.
+	// Defaults to DefaultKeyID.
+	EncryptionKeyID string
+	// EncryptionAlgo is the algorithm replicas are encrypted with.
+	// Defaults to AlgoAES256GCM.
+	EncryptionAlgo string
+	// Identity is the node's Ed25519 key, files shared with the node are
+	// wrapped for it.
+	Identity ed25519.PrivateKey
+	// NamespaceKey is the secret the identifiers of files on the network
+	// are derived with. A node can only get a file shared with it if both
+	// use the same one. Without it identifiers are the SHA-256 of the key.
+	NamespaceKey      []byte
 	StorageRoot       string
 	PathTransformFunc PathTransformFunc
-	Transport         p2p.Transport
-	BootstrapNodes    []string
-	DB                *dbpkg.DB
+	// LegacyPathTransformFunc is the path transform an existing storage
+	// root was written with, objects are moved to PathTransformFunc when
+	// they are accessed.
+	LegacyPathTransformFunc PathTransformFunc
+	Transport               p2p.Transport
+	BootstrapNodes          []string
+	DB                      *dbpkg.DB
+	// AllowAnyPeer lets in every node the handshake authenticates. By
+	// default AuthorizePeer only lets in the nodes trusted in DB.
+	AllowAnyPeer bool
+	// BucketSize is the k of the DHT: the size of the routing table
+	// buckets and the number of nodes closest to a file that replicas
+	// can be placed on. Defaults to dht.DefaultK.
+	BucketSize int
+	// ReplicationFactor is the number of peers a stored file is copied to,
+	// at most BucketSize. Defaults to DefaultReplicationFactor.
+	ReplicationFactor int
+	// Placement picks the peers among the candidates. Defaults to
+	// ClosestPlacement.
+	Placement PlacementStrategy
+	// RepairInterval is how often the replicas of our files are checked.
+	// Defaults to DefaultRepairInterval.
+	RepairInterval time.Duration
+	// RekeyInterval is how often data keys wrapped by a retired master key
+	// are rewrapped. Defaults to DefaultRekeyInterval.
+	RekeyInterval time.Duration
+	// ScrubInterval is how often the local store is scrubbed. Defaults to
+	// DefaultScrubInterval.
+	ScrubInterval time.Duration
+	// ScrubRate is how many bytes per second the background scrubber
+	// reads. A rate of 0 means DefaultScrubRate. A negative rate means no
+	// limit.
+	ScrubRate int64
 }
 
 type FileServer struct {
@@ -416,36 +1159,148 @@ type FileServer struct {
 	peersLock sync.Mutex
 	peers     map[string]p2p.Peer
 
+	nextRequestID atomic.Uint64
+	pendingLock   sync.Mutex
+	pending       map[uint64]chan response
+
+	dht *dht.Node
+
+	// repairch wakes up the repair loop early
+	repairch chan struct{}
+
+	// scrubLock keeps scrubs from running at the same time
+	scrubLock sync.Mutex
+
 	store  *Store
 	quitch chan struct{}
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
+	if opts.ReplicationFactor == 0 {
+		opts.ReplicationFactor = DefaultReplicationFactor
+	}
+	if opts.Placement == nil {
+		opts.Placement = ClosestPlacement{}
+	}
+	if opts.RepairInterval == 0 {
+		opts.RepairInterval = DefaultRepairInterval
+	}
+	if opts.RekeyInterval == 0 {
+		opts.RekeyInterval = DefaultRekeyInterval
+	}
+	if opts.ScrubInterval == 0 {
+		opts.ScrubInterval = DefaultScrubInterval
+	}
+	if opts.ScrubRate == 0 {
+		opts.ScrubRate = DefaultScrubRate
+	}
+	if opts.EncryptionKeyID == "" {
+		opts.EncryptionKeyID = DefaultKeyID
+	}
+	if opts.EncryptionAlgo == "" {
+		opts.EncryptionAlgo = AlgoAES256GCM
+	}
 	storeOpts := StoreOpts{
-		Root:              opts.StorageRoot,
-		PathTransformFunc: opts.PathTransformFunc,
+		Root:                    opts.StorageRoot,
+		PathTransformFunc:       opts.PathTransformFunc,
+		LegacyPathTransformFunc: opts.LegacyPathTransformFunc,
 	}
-	return &FileServer{
+	s := &FileServer{
 		FileServerOpts: opts,
 		store:          NewStore(storeOpts),
 		quitch:         make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
+		pending:        make(map[uint64]chan response),
+		repairch:       make(chan struct{}, 1),
+	}
+
+	self, err := dht.ParseID(opts.Transport.ID())
+	if err != nil {
+		// not reachable through the DHT, but we can still use it
+		self = dht.RandomID()
 	}
+	s.dht = dht.NewNode(dht.NodeOpts{
+		Self:    dht.Contact{ID: self, Addr: opts.Transport.Address()},
+		Network: dhtNetwork{s},
+		K:       opts.BucketSize,
+	})
+	return s
 }
 
+var ErrFileNotFound = errors.New("file not found on the network")
+
+// replicaAckTimeout is how long we wait for a peer to confirm a replica
+// once we have streamed it.
+const replicaAckTimeout = 30 * time.Second
+
 type Message struct {
+	// ID correlates a request with its responses. Responses carry
+	// the ID of the request they answer.
+	ID      uint64
 	Payload any
 }
 
+// response is a reply to one of our requests, delivered by the message loop.
+type response struct {
+	From    string
+	Payload any
+}
+
+// MessageStoreFile announces a file the sender streams on the stream
+// with the given id.
+// The chunks follow on the stream in batches, only the ones the receiver is
+// missing are sent.
 type MessageStoreFile struct {
-	Key  string
-	Size int64
+	Key      string
+	StreamID uint32
+	// Owner is the node that stored the file, it differs from the sender
+	// when a replica is copied during repair.
+	Owner string
+}
+
+// MessageStoreFileResponse confirms a MessageStoreFile once the replica is
+// written, or reports why it was not.
+type MessageStoreFileResponse struct {
+	Key   string
+	Error string
 }
 
+// MessageGetUsage asks a peer how many bytes it stores, it is answered
+// with a MessageGetUsageResponse.
+type MessageGetUsage struct{}
+
+type MessageGetUsageResponse struct {
+	Used int64
+}
+
+// MessageGetFile asks a peer whether it holds a file, it is answered
+// with a MessageGetFileResponse.
 type MessageGetFile struct {
 	Key string
 }
 
+type FileStatus int
+
+const (
+	FileFound FileStatus = iota
+	FileNotFound
+	FileError
+)
+
+type MessageGetFileResponse struct {
+	Key    string
+	Status FileStatus
+	Size   int64
+	Error  string
+}
+
+// MessageFetchFile asks a peer to stream a file it reported as found
+// on the stream with the given id.
+type MessageFetchFile struct {
+	Key      string
+	StreamID uint32
+}
+
 type MessageDeleteFile struct {
 	Key string
 }
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+	"github.com/TinySkillet/DecentralizedP2PStorage/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer starts a node on a free local port with its own storage
+// root. Fields set in opts are kept.
+func newTestServer(t testing.TB, opts FileServerOpts) *FileServer {
+	identity := newIdentity()
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		NodeID:        p2p.NodeID(identity.Public().(ed25519.PublicKey)),
+		HandshakeFunc: p2p.NewSecureHandshakeFunc(identity),
+		Decoder:       p2p.DefaultDecoder{},
+	})
+
+	if opts.EncryptionKey == nil {
+		opts.EncryptionKey = newEcryptionKey()
+	}
+	opts.Identity = identity
+	opts.StorageRoot = t.TempDir()
+	opts.PathTransformFunc = CASPathTransformFunc
+	opts.Transport = tr
+
+	s := NewFileServer(opts)
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerDisconnect = s.OnPeerDisconnect
+
+	assert.Nil(t, tr.ListenAndAccept())
+	s.bootstrapNetwork()
+	go s.loop()
+	t.Cleanup(func() {
+		s.Stop()
+		tr.Close()
+	})
+	return s
+}
+
+func waitFor(t testing.TB, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func peerIDs(s *FileServer) []string {
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	ids := []string{}
+	for id := range s.peers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestPeersKeyedByNodeID(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{})
+
+	// dial each other at the same time, a couple of times
+	for range 3 {
+		go a.Transport.Dial(b.Transport.Address())
+		go b.Transport.Dial(a.Transport.Address())
+	}
+
+	waitFor(t, func() bool { return len(peerIDs(a)) == 1 && len(peerIDs(b)) == 1 })
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Equal(t, []string{b.Transport.ID()}, peerIDs(a))
+	assert.Equal(t, []string{a.Transport.ID()}, peerIDs(b))
+
+	peer, _ := a.peer(b.Transport.ID())
+	assert.Equal(t, b.Transport.Address(), peer.ListenAddr())
+
+	// both sides kept the same connection
+	other, _ := b.peer(a.Transport.ID())
+	assert.Equal(t, peer.LocalAddr().String(), other.RemoteAddr().String())
+}
+
+func TestOnlyTrustedPeersAreLetIn(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{DB: newTestDB(t)})
+	a.Transport.(*p2p.TCPTransport).AuthorizePeer = a.AuthorizePeer
+	b := newTestServer(t, FileServerOpts{})
+
+	pub := b.Identity.Public().(ed25519.PublicKey)
+	assert.ErrorIs(t, a.AuthorizePeer(pub), p2p.ErrUntrustedPeer)
+
+	// b authenticates, but a does not know its key
+	assert.Nil(t, b.Transport.Dial(a.Transport.Address()))
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, peerIDs(a))
+	assert.Empty(t, peerIDs(b))
+
+	assert.Nil(t, a.DB.TrustPeer(context.Background(), hex.EncodeToString(pub)))
+	assert.Nil(t, b.Transport.Dial(a.Transport.Address()))
+	waitFor(t, func() bool { return len(peerIDs(a)) == 1 && len(peerIDs(b)) == 1 })
+	assert.Equal(t, []string{b.Transport.ID()}, peerIDs(a))
+
+	// an open node lets in any key
+	a.AllowAnyPeer = true
+	assert.Nil(t, a.AuthorizePeer(newIdentity().Public().(ed25519.PublicKey)))
+}
+
+// closestServers returns the k servers closest to the file, by brute force.
+func closestServers(servers []*FileServer, key string, k int) []*FileServer {
+	target := fileID(fileHash(nil, key))
+	sorted := slices.Clone(servers)
+	slices.SortFunc(sorted, func(a, b *FileServer) int {
+		da, db := target.Xor(a.dht.Self.ID), target.Xor(b.dht.Self.ID)
+		return bytes.Compare(da[:], db[:])
+	})
+	return sorted[:k]
+}
+
+// newTestDB opens a migrated database in a temporary directory.
+func newTestDB(t *testing.T) *dbpkg.DB {
+	d, err := dbpkg.Open(filepath.Join(t.TempDir(), "p2p.db"))
+	assert.Nil(t, err)
+	assert.Nil(t, d.Migrate(context.Background()))
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// newTestCluster starts n nodes sharing one encryption key, which all join
+// the DHT through the first one. Every node gets its own copy of the opts
+// returned by newOpts.
+func newTestCluster(t testing.TB, n int, newOpts func() FileServerOpts) []*FileServer {
+	encKey := newEcryptionKey()
+	opts := func() FileServerOpts {
+		o := newOpts()
+		o.EncryptionKey = encKey
+		return o
+	}
+
+	seed := newTestServer(t, opts())
+	servers := []*FileServer{seed}
+	for range n - 1 {
+		o := opts()
+		o.BootstrapNodes = []string{seed.Transport.Address()}
+		servers = append(servers, newTestServer(t, o))
+	}
+	waitFor(t, func() bool {
+		// the joining nodes may see the connection after the seed does
+		for _, s := range servers[1:] {
+			if len(peerIDs(s)) == 0 {
+				return false
+			}
+		}
+		return len(peerIDs(seed)) == n-1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// the nodes that joined early learn about the later ones in a second round
+	for range 2 {
+		for _, s := range servers[1:] {
+			assert.Nil(t, s.dht.Bootstrap(ctx))
+		}
+	}
+	return servers
+}
+
+func TestFilesStoredOnClosestNodes(t *testing.T) {
+	const k = 3
+	servers := newTestCluster(t, 12, func() FileServerOpts {
+		return FileServerOpts{BucketSize: k}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	owner, name, data := servers[5], "holiday.jpg", []byte("a very large photo")
+	results, err := owner.Store(name, bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Len(t, results, k)
+
+	others := slices.DeleteFunc(slices.Clone(servers), func(s *FileServer) bool { return s == owner })
+	closest := closestServers(others, name, k)
+	for _, s := range closest {
+		assert.True(t, s.store.Has(owner.hashKey(name)))
+	}
+	for _, s := range others {
+		if !slices.Contains(closest, s) {
+			assert.False(t, s.store.Has(owner.hashKey(name)), "replica stored on a node that is not among the closest")
+		}
+	}
+
+	// a node that holds no replica finds one through the DHT
+	var reader *FileServer
+	for _, s := range others {
+		if !slices.Contains(closest, s) {
+			reader = s
+			break
+		}
+	}
+	_, r, err := reader.Get(ctx, name)
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+	assert.Equal(t, data, got)
+}
+
+// killingPlacement picks the closest candidates, but takes the node of the
+// first one down before the replicas are sent.
+type killingPlacement struct {
+	servers []*FileServer
+	killed  string
+}
+
+func (p *killingPlacement) Place(hashedKey string, candidates []Candidate, n int) []Candidate {
+	chosen := ClosestPlacement{}.Place(hashedKey, candidates, n)
+	p.killed = chosen[0].ID
+	for _, s := range p.servers {
+		if s.Transport.ID() == p.killed {
+			kill(s)
+		}
+	}
+	return chosen
+}
+
+// kill takes a node off the network: it stops listening and drops all its
+// connections.
+func kill(s *FileServer) {
+	s.Transport.Close()
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	for _, peer := range s.peers {
+		peer.Close()
+	}
+}
+
+func TestStoreReportsReplicaResults(t *testing.T) {
+	placement := &killingPlacement{}
+	servers := newTestCluster(t, 8, func() FileServerOpts {
+		return FileServerOpts{
+			BucketSize:        5,
+			ReplicationFactor: 2,
+			Placement:         placement,
+		}
+	})
+	placement.servers = servers
+
+	results, err := servers[0].Store("report.pdf", bytes.NewReader([]byte("quarterly numbers")))
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+
+	stored := 0
+	for _, s := range servers[1:] {
+		if s.store.Has(servers[0].hashKey("report.pdf")) {
+			stored++
+		}
+	}
+	assert.Equal(t, 1, stored)
+
+	for _, res := range results {
+		if res.Peer == placement.killed {
+			assert.NotNil(t, res.Err)
+		} else {
+			assert.Nil(t, res.Err)
+		}
+	}
+}
+
+func chunkCount(t *testing.T, s *Store) int {
+	n := 0
+	err := filepath.WalkDir(filepath.Join(s.Root, chunksDir), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			n++
+		}
+		return err
+	})
+	assert.Nil(t, err)
+	return n
+}
+
+func TestStoreSendsOnlyMissingChunks(t *testing.T) {
+	servers := newTestCluster(t, 2, func() FileServerOpts {
+		return FileServerOpts{ReplicationFactor: 1}
+	})
+	owner, peer := servers[0], servers[1]
+
+	data := randomData(5, 2*1024*1024)
+	_, err := owner.Store("v1", bytes.NewReader(data))
+	assert.Nil(t, err)
+	before := chunkCount(t, peer.store)
+	assert.Greater(t, before, 10)
+
+	// a new version with a few bytes inserted shares all but a chunk or two
+	edited := slices.Concat(data[:1<<20], []byte("an edit"), data[1<<20:])
+	_, err = owner.Store("v2", bytes.NewReader(edited))
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, chunkCount(t, peer.store)-before, 2)
+
+	assert.Nil(t, owner.store.Delete("v2"))
+	_, r, err := owner.Get(context.Background(), "v2")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, edited, got)
+}
+
+// peakHeap runs f and returns how far the heap in use grew above where it
+// was before, sampled every few milliseconds.
+func peakHeap(f func()) uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	base := ms.HeapInuse
+
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			peak = max(peak, ms.HeapInuse)
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	f()
+	close(done)
+	<-sampled
+	return max(peak, base) - base
+}
+
+// BenchmarkStoreLargeFile stores files far larger than the memory a store
+// may use, the heap must not grow with the size of the file.
+func BenchmarkStoreLargeFile(b *testing.B) {
+	const maxHeap = 32 << 20
+
+	for _, size := range []int64{32 << 20, 256 << 20} {
+		b.Run(fmt.Sprintf("%dMiB", size>>20), func(b *testing.B) {
+			servers := newTestCluster(b, 2, func() FileServerOpts {
+				return FileServerOpts{ReplicationFactor: 1}
+			})
+			b.SetBytes(size)
+			b.ResetTimer()
+
+			var peak uint64
+			for i := range b.N {
+				// every round stores new content, so nothing is deduplicated
+				r := io.LimitReader(rand.NewChaCha8([32]byte{byte(i)}), size)
+				peak = max(peak, peakHeap(func() {
+					results, err := servers[0].Store(fmt.Sprintf("large-%d", i), r)
+					assert.Nil(b, err)
+					assert.Len(b, results, 1)
+					assert.Nil(b, results[0].Err)
+				}))
+			}
+
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+			if peak > maxHeap {
+				b.Errorf("heap grew by %d MiB storing %d MiB", peak>>20, size>>20)
+			}
+		})
+	}
+}
+
+func TestGetDetectsTamperedReplica(t *testing.T) {
+	servers := newTestCluster(t, 2, func() FileServerOpts {
+		return FileServerOpts{ReplicationFactor: 1}
+	})
+	owner, holder := servers[0], servers[1]
+
+	data := randomData(8, 300*1024)
+	_, err := owner.Store("tamper.bin", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	// the holder swaps a chunk for a modified one with a matching hash, which
+	// only authenticated encryption catches
+	m, err := holder.store.ReadManifest(holder.hashKey("tamper.bin"))
+	assert.Nil(t, err)
+	chunk, err := holder.store.ReadChunk(m.Chunks[0].Hash)
+	assert.Nil(t, err)
+	chunk[len(chunk)/2] ^= 1
+	hash, err := holder.store.PutChunk(chunk)
+	assert.Nil(t, err)
+	m.Chunks[0].Hash = hash
+	assert.Nil(t, holder.store.WriteManifest(holder.hashKey("tamper.bin"), m))
+
+	assert.Nil(t, owner.store.Delete("tamper.bin"))
+	_, _, err = owner.Get(context.Background(), "tamper.bin")
+	assert.ErrorIs(t, err, ErrTampered)
+	assert.False(t, owner.store.Has("tamper.bin"))
+}
+
+func TestGetRefetchesCorruptCopy(t *testing.T) {
+	servers := newTestCluster(t, 2, func() FileServerOpts {
+		return FileServerOpts{ReplicationFactor: 1}
+	})
+	owner := servers[0]
+	owner.DB = newTestDB(t)
+	ctx := context.Background()
+
+	data := randomData(9, 300*1024)
+	_, err := owner.Store("rot.bin", bytes.NewReader(data))
+	assert.Nil(t, err)
+	f, err := owner.DB.GetFile(ctx, owner.hashKey("rot.bin"))
+	assert.Nil(t, err)
+	assert.Equal(t, bytesHash(data), f.Digest)
+
+	// a bit of our own copy flips on disk
+	flipBit(t, owner.store, "rot.bin")
+
+	_, r, err := owner.Get(ctx, "rot.bin")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+	assert.Nil(t, owner.store.Verify("rot.bin", f.Digest))
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+	"github.com/TinySkillet/DecentralizedP2PStorage/dht"
+	"github.com/TinySkillet/DecentralizedP2PStorage/p2p"
+)
+
+// A file is shared by sending the recipient node its data key, wrapped with
+// a key only the recipient can derive: an ephemeral X25519 key agreement
+// with the X25519 form of the recipient's Ed25519 identity. The recipient
+// keeps the data key wrapped by its own master key, from then on it gets
+// and decrypts the file like one of its own. A share never replaces the
+// key of one of the recipient's own files: it would make the recipient
+// encrypt them with a key the sender knows.
+
+// shareKeyInfo is the HKDF info of the key a data key is wrapped with for
+// a recipient.
+const shareKeyInfo = "p2p share key"
+
+// curve25519P is the field prime 2^255 - 19.
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// ParsePublicKey parses a hex encoded Ed25519 node identity.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key '%s', expected %d hex encoded bytes", s, ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// sharePublicKey converts an Ed25519 public key to the X25519 public key of
+// the same secret scalar, u = (1 + y) / (1 - y) (RFC 7748, section 4.1).
+func sharePublicKey(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	le := slices.Clone([]byte(pub))
+	le[31] &= 0x7f // the sign of x
+	slices.Reverse(le)
+	y := new(big.Int).SetBytes(le)
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, errors.New("invalid public key")
+	}
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, errors.New("invalid public key")
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+
+	b := u.FillBytes(make([]byte, 32))
+	slices.Reverse(b)
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// sharePrivateKey returns the X25519 private key of an Ed25519 identity,
+// the scalar Ed25519 derives from the seed.
+func sharePrivateKey(priv ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	h := sha512.Sum512(priv.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+// shareKey derives the key a data key is wrapped with for the holder of
+// recipient from an X25519 shared secret.
+func shareKey(secret []byte, ephemeral, recipient *ecdh.PublicKey) ([]byte, error) {
+	salt := slices.Concat(ephemeral.Bytes(), recipient.Bytes())
+	return hkdf.Key(sha256.New, secret, salt, shareKeyInfo, 32)
+}
+
+// Share gives the node with the given identity access to one of our files
+// by sending it the file's data key. The recipient must be reachable.
+func (s *FileServer) Share(ctx context.Context, key string, recipient ed25519.PublicKey) error {
+	if s.DB == nil {
+		return errors.New("sharing needs a database")
+	}
+	dk, err := s.fileKey(ctx, s.hashKey(key))
+	if err != nil {
+		return err
+	}
+	if dk.WrappedBy == "" {
+		// sending the master key would share every file
+		return fmt.Errorf("file '%s' has no data key of its own, store it again to share it", key)
+	}
+
+	recipientX, err := sharePublicKey(recipient)
+	if err != nil {
+		return err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	secret, err := ephemeral.ECDH(recipientX)
+	if err != nil {
+		return err
+	}
+	kek, err := shareKey(secret, ephemeral.PublicKey(), recipientX)
+	if err != nil {
+		return err
+	}
+	wrapped, err := wrapKey(dk.Algo, kek, dk.Key)
+	if err != nil {
+		return err
+	}
+
+	recipientID := p2p.NodeID(recipient)
+	peer, err := s.findPeer(ctx, recipientID)
+	if err != nil {
+		return fmt.Errorf("reaching %s: %w", recipientID, err)
+	}
+
+	id, responses, done := s.newRequest(1)
+	defer done()
+	msg := Message{
+		ID: id,
+		Payload: MessageShareFile{
+			Key:        s.hashKey(key),
+			Name:       key,
+			Algo:       dk.Algo,
+			Ephemeral:  ephemeral.PublicKey().Bytes(),
+			WrappedKey: wrapped,
+		},
+	}
+	if err := s.send(peer, &msg); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-responses:
+		v, ok := resp.Payload.(MessageShareFileResponse)
+		if !ok {
+			return fmt.Errorf("unexpected response %T", resp.Payload)
+		}
+		if v.Error != "" {
+			return errors.New(v.Error)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return s.DB.AddShare(ctx, dbpkg.Share{
+		FileID:    s.hashKey(key),
+		PeerID:    recipientID,
+		Direction: dbpkg.ShareGranted,
+	})
+}
+
+// findPeer connects to a node by id, looking up its address in the DHT if
+// we do not know it.
+func (s *FileServer) findPeer(ctx context.Context, id string) (string, error) {
+	if peer, err := s.connectPeer(ctx, id); err == nil {
+		return peer, nil
+	}
+
+	nodeID, err := dht.ParseID(id)
+	if err != nil {
+		return "", err
+	}
+	closest, err := s.dht.Lookup(ctx, nodeID)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range closest {
+		if c.ID == nodeID {
+			return s.connect(ctx, c)
+		}
+	}
+	return "", errors.New("node not found")
+}
+
+// handleMessageShareFile accepts the data key of a file another node
+// shares with us.
+func (s *FileServer) handleMessageShareFile(from string, id uint64, msg MessageShareFile) error {
+	resp := MessageShareFileResponse{Key: msg.Key}
+	err := s.acceptShare(from, msg)
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		fmt.Printf("[%s] %s shared file '%s' with us\n", s.Transport.Address(), from, msg.Name)
+	}
+	if sendErr := s.send(from, &Message{ID: id, Payload: resp}); sendErr != nil && err == nil {
+		return sendErr
+	}
+	return err
+}
+
+func (s *FileServer) acceptShare(from string, msg MessageShareFile) error {
+	if s.DB == nil || s.Identity == nil {
+		return errors.New("node does not accept shared files")
+	}
+	if err := checkAlgorithm(msg.Algo); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err := s.checkNotOurs(ctx, msg.Key); err != nil {
+		return err
+	}
+
+	priv, err := sharePrivateKey(s.Identity)
+	if err != nil {
+		return err
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(msg.Ephemeral)
+	if err != nil {
+		return err
+	}
+	secret, err := priv.ECDH(ephemeral)
+	if err != nil {
+		return err
+	}
+	kek, err := shareKey(secret, ephemeral, priv.PublicKey())
+	if err != nil {
+		return err
+	}
+	dek, err := unwrapKey(kek, msg.WrappedKey)
+	if err != nil {
+		return fmt.Errorf("unwrapping the data key: %w", err)
+	}
+
+	_, wrapped, err := s.wrapDataKey(ctx, msg.Name, msg.Algo, dek)
+	if err != nil {
+		return err
+	}
+	if err := s.DB.PutSharedKey(ctx, msg.Key, from, wrapped); err != nil {
+		return err
+	}
+	return s.DB.AddShare(ctx, dbpkg.Share{
+		FileID:    msg.Key,
+		PeerID:    from,
+		Direction: dbpkg.ShareReceived,
+	})
+}
+
+// checkNotOurs fails if the file with the given (hashed) key is one of our
+// own files.
+func (s *FileServer) checkNotOurs(ctx context.Context, hashedKey string) error {
+	_, err := s.DB.GetFile(ctx, hashedKey)
+	if err == nil {
+		return errors.New("file is not yours to share")
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	_, err = s.DB.GetFileKey(ctx, hashedKey)
+	if err == nil {
+		return errors.New("file is not yours to share")
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	gob.Register(MessageShareFile{})
+	gob.Register(MessageShareFileResponse{})
+}
+
+// MessageShareFile hands the recipient the data key of a file, wrapped
+// for it. It is answered with a MessageShareFileResponse.
+type MessageShareFile struct {
+	Key  string
+	Name string
+	Algo string
+	// Ephemeral is the sender's X25519 public key for this share.
+	Ephemeral  []byte
+	WrappedKey []byte
+}
+
+type MessageShareFileResponse struct {
+	Key   string
+	Error string
+}
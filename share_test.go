@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io"
+	"testing"
+
+	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharePublicKeyMatchesPrivateKey(t *testing.T) {
+	for range 20 {
+		identity := newIdentity()
+		priv, err := sharePrivateKey(identity)
+		assert.Nil(t, err)
+		pub, err := sharePublicKey(identity.Public().(ed25519.PublicKey))
+		assert.Nil(t, err)
+		assert.Equal(t, priv.PublicKey().Bytes(), pub.Bytes())
+	}
+
+	_, err := ParsePublicKey("abcd")
+	assert.NotNil(t, err)
+}
+
+func TestShareFile(t *testing.T) {
+	servers := newTestCluster(t, 4, func() FileServerOpts {
+		return FileServerOpts{ReplicationFactor: 3}
+	})
+	owner, recipient, outsider := servers[0], servers[1], servers[2]
+	owner.DB, recipient.DB = newTestDB(t), newTestDB(t)
+	ctx := context.Background()
+
+	data := []byte("the team's shared notes")
+	_, err := owner.Store("notes.txt", bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Nil(t, owner.Share(ctx, "notes.txt", recipient.Identity.Public().(ed25519.PublicKey)))
+
+	granted, err := owner.DB.ListShares(ctx, owner.hashKey("notes.txt"), dbpkg.ShareGranted)
+	assert.Nil(t, err)
+	assert.Len(t, granted, 1)
+	assert.Equal(t, recipient.Transport.ID(), granted[0].PeerID)
+	received, err := recipient.DB.ListShares(ctx, owner.hashKey("notes.txt"), dbpkg.ShareReceived)
+	assert.Nil(t, err)
+	assert.Len(t, received, 1)
+	assert.Equal(t, owner.Transport.ID(), received[0].PeerID)
+
+	_, r, err := recipient.Get(ctx, "notes.txt")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	// the file is encrypted with its data key, not the master key the
+	// nodes of the test cluster have in common
+	_, _, err = outsider.Get(ctx, "notes.txt")
+	assert.ErrorIs(t, err, ErrTampered)
+}
+
+func TestShareNeedsADataKey(t *testing.T) {
+	servers := newTestCluster(t, 2, func() FileServerOpts {
+		return FileServerOpts{ReplicationFactor: 1}
+	})
+	owner := servers[0]
+
+	_, err := owner.Store("legacy.txt", bytes.NewReader([]byte("no data key")))
+	assert.Nil(t, err)
+	owner.DB = newTestDB(t)
+	err = owner.Share(context.Background(), "legacy.txt", servers[1].Identity.Public().(ed25519.PublicKey))
+	assert.ErrorContains(t, err, "no data key")
+}
+
+func TestShareDoesNotReplaceOwnKey(t *testing.T) {
+	servers := newTestCluster(t, 3, func() FileServerOpts {
+		return FileServerOpts{ReplicationFactor: 1}
+	})
+	attacker, victim := servers[0], servers[1]
+	attacker.DB, victim.DB = newTestDB(t), newTestDB(t)
+	ctx := context.Background()
+
+	_, err := victim.Store("plans.txt", bytes.NewReader([]byte("the victim's plans")))
+	assert.Nil(t, err)
+	before, err := victim.fileKey(ctx, victim.hashKey("plans.txt"))
+	assert.Nil(t, err)
+
+	_, err = attacker.Store("plans.txt", bytes.NewReader([]byte("a key the attacker knows")))
+	assert.Nil(t, err)
+	err = attacker.Share(ctx, "plans.txt", victim.Identity.Public().(ed25519.PublicKey))
+	assert.ErrorContains(t, err, "not yours to share")
+
+	after, err := victim.fileKey(ctx, victim.hashKey("plans.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+	dk, err := victim.fileKeyForStore(ctx, "plans.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, before, dk)
+}
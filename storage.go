@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -9,15 +10,28 @@ import (
 	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 )
 
 const DEFAULT_ROOT_FOLDER = "p2pnetwork"
 
+// CASPathTransformFunc stores an object under the SHA-256 of its key, split
+// into directories of five characters.
 func CASPathTransformFunc(key string) PathKey {
+	hash := sha256.Sum256([]byte(key))
+	return casPathKey(hex.EncodeToString(hash[:]))
+}
+
+// LegacyCASPathTransformFunc is the SHA-1 based CASPathTransformFunc
+// storage roots were written with before.
+func LegacyCASPathTransformFunc(key string) PathKey {
 	hash := sha1.Sum([]byte(key))
-	hashString := hex.EncodeToString(hash[:])
+	return casPathKey(hex.EncodeToString(hash[:]))
+}
 
+func casPathKey(hashString string) PathKey {
 	blockSize := 5
 	sliceLen := len(hashString) / blockSize
 
@@ -39,49 +53,119 @@ func (s *Store) Read(key string) (int64, io.Reader, error) {
 }
 
 func (s *Store) Write(key string, r io.Reader) (int64, error) {
-	return s.writeStream(key, r)
+	return s.writeStream(key, r, "")
 }
 
-func (s *Store) WriteDecrypt(encryptionKey []byte, key string, r io.Reader) (int64, error) {
+// WriteVerified writes like Write, but leaves the object as it was unless
+// the content hashes to digest.
+func (s *Store) WriteVerified(key string, r io.Reader, digest string) (int64, error) {
+	return s.writeStream(key, r, digest)
+}
 
-	f, err := s.openFileForWriting(key)
+// writeStream splits r into content defined chunks, stores the chunks it
+// does not have yet and records them in the manifest of key. Only one chunk
+// is held in memory at a time.
+func (s *Store) writeStream(key string, r io.Reader, digest string) (int64, error) {
+	w, err := s.CreateManifest(key)
 	if err != nil {
 		return 0, err
 	}
-	n, err := copyDecrypt(encryptionKey, r, f)
-	return int64(n), err
-}
+	w.Expect(digest)
 
-func (s *Store) writeStream(key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(key)
-	if err != nil {
+	chunker := NewChunker(r)
+	for {
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			_, err = w.Put(chunk)
+		}
+		if err != nil {
+			w.Discard()
+			return 0, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
 		return 0, err
 	}
-	return io.Copy(f, r)
+	return w.Size(), nil
 }
 
+// Delete removes the object and the chunks no other object refers to.
 func (s *Store) Delete(key string) error {
-	pathKey := s.PathTransformFunc(key)
+	pathKey := s.objectPath(key)
 
 	defer func() {
 		log.Printf("Deleted [%s] from disk\n", pathKey.Filename)
 	}()
 
-	parentDir := strings.Split(pathKey.FullPath(), "/")[0]
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
 
-	parentDirWRoot := fmt.Sprintf("%s/%s", s.Root, parentDir)
-	if err := os.RemoveAll(parentDirWRoot); err != nil {
+	// the references are counted before the manifest goes
+	if _, err := s.chunkRefs(); err != nil {
+		return err
+	}
+	// an object that is not a manifest has no chunks, an unreadable one
+	// the chunks before the damage, as counted
+	fullPath := filepath.Join(s.Root, pathKey.FullPath())
+	chunks, _ := manifestChunks(fullPath)
+
+	// other objects can share the directories of the path, only the
+	// ones left empty go
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+	s.pruneEmptyDirs(filepath.Dir(fullPath))
+	return s.unrefChunks(chunks)
+}
+
+// Rename moves the object stored under oldKey to newKey. The chunks of a
+// manifest are shared, only the manifest itself moves.
+func (s *Store) Rename(oldKey, newKey string) error {
+	oldPath := filepath.Join(s.Root, s.objectPath(oldKey).FullPath())
+	newPath := filepath.Join(s.Root, s.PathTransformFunc(newKey).FullPath())
+	if err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
 		return err
 	}
+	s.pruneEmptyDirs(filepath.Dir(oldPath))
 	return nil
 }
 
+// Usage returns the number of bytes stored under the root folder.
+func (s *Store) Usage() (int64, error) {
+	var total int64
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
 func (s *Store) Clear() error {
 	return os.RemoveAll(s.Root)
 }
 
 func (s *Store) Has(key string) bool {
-	pathKey := s.PathTransformFunc(key)
+	pathKey := s.objectPath(key)
 	fullPath := fmt.Sprintf("%s/%s", s.Root, pathKey.FullPath())
 
 	_, err := os.Stat(fullPath)
@@ -93,34 +177,103 @@ func (s *Store) Has(key string) bool {
 	return true
 }
 
-func (s *Store) readStream(key string) (int64, io.ReadCloser, error) {
-	pathKey := s.PathTransformFunc(key)
-
-	fullPath := fmt.Sprintf("%s/%s", s.Root, pathKey.FullPath())
-
-	fileInfo, err := os.Stat(fullPath)
+func (s *Store) readStream(key string) (int64, io.ReadSeekCloser, error) {
+	f, err := os.Open(filepath.Join(s.Root, s.objectPath(key).FullPath()))
 	if err != nil {
 		return 0, nil, err
 	}
+	m, err := newManifestReader(io.NopCloser(f))
+	if err == nil {
+		return m.Size, &chunkReader{store: s, file: f, manifest: m}, nil
+	}
+	if !errors.Is(err, ErrNotManifest) {
+		f.Close()
+		return 0, nil, err
+	}
 
-	file, err := os.Open(fullPath)
+	// objects written before chunking are stored as a single file
+	fileInfo, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return 0, nil, err
 	}
-
-	return fileInfo.Size(), file, err
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	return fileInfo.Size(), f, nil
 }
 
-func (s *Store) openFileForWriting(key string) (*os.File, error) {
-	pathKey := s.PathTransformFunc(key)
+// tempMarker is part of the name of the temporary file an object or a
+// chunk is written to before it is renamed into place.
+const tempMarker = ".tmp-"
 
-	pathnameWithRoot := fmt.Sprintf("%s/%s", s.Root, pathKey.Pathname)
-	if err := os.MkdirAll(pathnameWithRoot, os.ModePerm); err != nil {
+func isTemp(path string) bool {
+	return strings.Contains(filepath.Base(path), tempMarker)
+}
+
+// createTemp creates the temporary file path is written to.
+func createTemp(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
 		return nil, err
 	}
+	return os.CreateTemp(filepath.Dir(path), filepath.Base(path)+tempMarker+"*")
+}
 
-	fullPath := fmt.Sprintf("%s/%s", s.Root, pathKey.FullPath())
-	return os.Create(fullPath)
+// writeFileAtomic writes data to path through a temporary file, so path
+// never holds part of it.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}()
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// RemoveTemp removes the temporary files of writes that did not complete,
+// it is called before anything is written.
+func (s *Store) RemoveTemp() error {
+	return filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() && isTemp(path) {
+			log.Printf("Removing incomplete write %s\n", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
 }
 
 type PathTransformFunc func(string) PathKey
@@ -143,12 +296,25 @@ func DefaultPathTransformFunc(key string) PathKey {
 
 type Store struct {
 	StoreOpts
+
+	// chunkLock serializes writing and collecting chunks, so two writers
+	// of the same chunk do not race and collection does not remove a chunk
+	// that is being written. It guards refs.
+	chunkLock sync.Mutex
+	// refs counts the references to each chunk in the manifests of the
+	// store, complete or being written. It is built from the manifests on
+	// disk the first time it is needed and kept up to date from then on.
+	refs map[string]int
 }
 
 type StoreOpts struct {
 	// Root is the root folder containing all files and folders of the p2p system
 	Root              string
 	PathTransformFunc PathTransformFunc
+	// LegacyPathTransformFunc is the path transform objects were stored
+	// with before PathTransformFunc, if it changed. Objects are moved to
+	// their new path the first time they are accessed.
+	LegacyPathTransformFunc PathTransformFunc
 }
 
 func NewStore(opts StoreOpts) *Store {
@@ -164,6 +330,46 @@ func NewStore(opts StoreOpts) *Store {
 	}
 }
 
+// objectPath returns the path of the object stored under key, moving it
+// there first if it is still stored under its legacy path.
+func (s *Store) objectPath(key string) PathKey {
+	pathKey := s.PathTransformFunc(key)
+	if s.LegacyPathTransformFunc == nil {
+		return pathKey
+	}
+
+	fullPath := filepath.Join(s.Root, pathKey.FullPath())
+	if _, err := os.Stat(fullPath); !errors.Is(err, fs.ErrNotExist) {
+		return pathKey
+	}
+	legacy := filepath.Join(s.Root, s.LegacyPathTransformFunc(key).FullPath())
+	if _, err := os.Stat(legacy); err != nil {
+		return pathKey
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		log.Printf("Moving [%s] to its new path: %v\n", key, err)
+		return pathKey
+	}
+	if err := os.Rename(legacy, fullPath); err != nil {
+		log.Printf("Moving [%s] to its new path: %v\n", key, err)
+		return pathKey
+	}
+	s.pruneEmptyDirs(filepath.Dir(legacy))
+	return pathKey
+}
+
+// pruneEmptyDirs removes dir and its parents up to the root for as long as
+// they are empty.
+func (s *Store) pruneEmptyDirs(dir string) {
+	root := filepath.Clean(s.Root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
 // FullPathForKey returns the absolute path on disk where the file for the given
 // logical key is stored. This is useful for metadata recording. It does not
 // perform any filesystem access.
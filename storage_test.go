@@ -2,8 +2,13 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,12 +18,51 @@ func TestPathTransformFunc(t *testing.T) {
 	key := "cooldawg"
 	pathkey := CASPathTransformFunc(key)
 
-	expectedFilename := "1ff51b817f2aa0ff28845b648e54fa24e05cb151"
+	expectedFilename := "8878c0763449d2849e88ad152a20f136bbbb038678f9d325af0a797c513c9905"
 
-	expectedPathname := "1ff51/b817f/2aa0f/f2884/5b648/e54fa/24e05/cb151"
+	expectedPathname := "8878c/07634/49d28/49e88/ad152/a20f1/36bbb/b0386/78f9d/325af/0a797/c513c"
 
 	assert.Equal(t, pathkey.Filename, expectedFilename)
 	assert.Equal(t, pathkey.Pathname, expectedPathname)
+
+	legacy := LegacyCASPathTransformFunc(key)
+	assert.Equal(t, "1ff51b817f2aa0ff28845b648e54fa24e05cb151", legacy.Filename)
+	assert.Equal(t, "1ff51/b817f/2aa0f/f2884/5b648/e54fa/24e05/cb151", legacy.Pathname)
+}
+
+func TestLegacyPathsAreMoved(t *testing.T) {
+	legacy := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: LegacyCASPathTransformFunc,
+	})
+	data := []byte("written before the paths changed")
+	_, err := legacy.Write("old.txt", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	s := NewStore(StoreOpts{
+		Root:                    legacy.Root,
+		PathTransformFunc:       CASPathTransformFunc,
+		LegacyPathTransformFunc: LegacyCASPathTransformFunc,
+	})
+	assert.True(t, s.Has("old.txt"))
+	_, r, err := s.Read("old.txt")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	// the object moved, the directories of its legacy path are gone
+	assert.NoFileExists(t, legacy.FullPathForKey("old.txt"))
+	assert.NoDirExists(t, filepath.Join(s.Root, strings.Split(LegacyCASPathTransformFunc("old.txt").Pathname, "/")[0]))
+	assert.FileExists(t, s.FullPathForKey("old.txt"))
+
+	assert.Nil(t, s.Rename("old.txt", "new.txt"))
+	assert.False(t, s.Has("old.txt"))
+	_, r, err = s.Read("new.txt")
+	assert.Nil(t, err)
+	got, err = io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
 }
 
 func TestDelete(t *testing.T) {
@@ -30,7 +74,7 @@ func TestDelete(t *testing.T) {
 	key := "absolutechad"
 
 	data := []byte("i don't fucking know bro")
-	if _, err := s.writeStream(key, bytes.NewReader(data)); err != nil {
+	if _, err := s.writeStream(key, bytes.NewReader(data), ""); err != nil {
 		t.Error(err)
 	}
 
@@ -39,6 +83,60 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestDeleteKeepsKeysSharingPrefixes(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	// pairs of keys whose paths share the first directory
+	byPrefix := make(map[string]string)
+	var pairs [][2]string
+	for i := 0; len(pairs) < 4; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		prefix := strings.Split(CASPathTransformFunc(key).Pathname, "/")[0]
+		if other, ok := byPrefix[prefix]; ok {
+			pairs = append(pairs, [2]string{other, key})
+			delete(byPrefix, prefix)
+			continue
+		}
+		byPrefix[prefix] = key
+	}
+
+	for _, pair := range pairs {
+		for _, key := range pair {
+			_, err := s.writeStream(key, strings.NewReader("data of "+key), "")
+			assert.Nil(t, err)
+		}
+	}
+
+	for _, pair := range pairs {
+		gone, kept := pair[0], pair[1]
+		assert.Nil(t, s.Delete(gone))
+		assert.False(t, s.Has(gone))
+		assert.True(t, s.Has(kept))
+		_, r, err := s.Read(kept)
+		assert.Nil(t, err)
+		b, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, "data of "+kept, string(b))
+
+		// only the directories left empty are removed
+		prefix := strings.Split(CASPathTransformFunc(gone).Pathname, "/")[0]
+		assert.DirExists(t, filepath.Join(s.Root, prefix))
+		assert.NoDirExists(t, filepath.Join(s.Root, CASPathTransformFunc(gone).Pathname))
+	}
+
+	for _, pair := range pairs {
+		assert.Nil(t, s.Delete(pair[1]))
+	}
+	entries, err := os.ReadDir(s.Root)
+	assert.Nil(t, err)
+	for _, e := range entries {
+		assert.Equal(t, chunksDir, e.Name())
+	}
+}
+
 func TestStore(t *testing.T) {
 	s := newStore()
 	defer teardown(t, s)
@@ -47,7 +145,7 @@ func TestStore(t *testing.T) {
 		key := fmt.Sprintf("absolutechad_%d", i)
 		data := []byte("some kind of png")
 
-		if _, err := s.writeStream(key, bytes.NewReader(data)); err != nil {
+		if _, err := s.writeStream(key, bytes.NewReader(data), ""); err != nil {
 			t.Error(err)
 		}
 
@@ -81,3 +179,61 @@ func teardown(t *testing.T, s *Store) {
 		t.Error(err)
 	}
 }
+
+// failingReader returns err once the data is read.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func tempFiles(t *testing.T, s *Store) []string {
+	var temp []string
+	assert.Nil(t, filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && isTemp(path) {
+			temp = append(temp, path)
+		}
+		return err
+	}))
+	return temp
+}
+
+func TestWritesAreAtomic(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	old := randomData(13, 300*1024)
+	_, err := s.Write("object", bytes.NewReader(old))
+	assert.Nil(t, err)
+
+	// the peer drops mid-transfer
+	dropped := errors.New("connection reset")
+	_, err = s.Write("object", &failingReader{data: randomData(14, 300*1024), err: dropped})
+	assert.ErrorIs(t, err, dropped)
+	// the content is not what it should be
+	_, err = s.WriteVerified("object", bytes.NewReader(randomData(15, 1024)), bytesHash(old))
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	_, r, err := s.Read("object")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, old, got)
+	assert.Empty(t, tempFiles(t, s))
+
+	// the node crashes before the write completes
+	w, err := s.CreateManifest("crashed")
+	assert.Nil(t, err)
+	_, err = w.Put([]byte("the only chunk"))
+	assert.Nil(t, err)
+	assert.False(t, s.Has("crashed"))
+	assert.Len(t, tempFiles(t, s), 1)
+	assert.Nil(t, s.RemoveTemp())
+	assert.Empty(t, tempFiles(t, s))
+}
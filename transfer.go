@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Replicas and fetched files travel as chunks on a stream, so neither side
+// holds more than a batch of chunk references and a chunk in memory.
+//
+// A replica is sent in batches: the sender writes the references of up to
+// chunkBatchSize chunks, the receiver answers with a chunk list of the ones
+// it is missing and the sender writes those. An empty batch ends the replica.
+//
+// A fetched file is sent as a chunk reference followed by the chunk, for
+// every chunk, and ends with an empty reference.
+const chunkBatchSize = 256
+
+// Chunks are encrypted on their own so that replicas deduplicate, nothing
+// in a chunk says where it belongs. A replica therefore ends with a seal
+// chunk, "p2pm" followed by an HMAC-SHA256 of the references of the chunks
+// before it, in order, under a key derived from the data key. A peer that
+// drops, reorders or repeats chunks of a replica it serves breaks the seal.
+const (
+	sealMagic = "p2pm"
+	sealSize  = len(sealMagic) + sha256.Size
+)
+
+func newChunkSeal(key []byte) (hash.Hash, error) {
+	sealKey, err := hkdf.Key(sha256.New, key, nil, "p2p chunk seal", 32)
+	if err != nil {
+		return nil, err
+	}
+	return hmac.New(sha256.New, sealKey), nil
+}
+
+// isChunkSeal reports whether a chunk is a seal, encrypted chunks start
+// with streamMagic.
+func isChunkSeal(data []byte) bool {
+	return len(data) == sealSize && string(data[:len(sealMagic)]) == sealMagic
+}
+
+// chunkRefSize is the size of an encoded chunk reference,
+// [sha256: 32 bytes][size: 4 bytes].
+const chunkRefSize = 32 + 4
+
+func appendChunkRef(buf []byte, c ChunkRef) ([]byte, error) {
+	hash, err := hex.DecodeString(c.Hash)
+	if err != nil || len(hash) != 32 {
+		return nil, fmt.Errorf("invalid chunk hash '%s'", c.Hash)
+	}
+	buf = append(buf, hash...)
+	return binary.BigEndian.AppendUint32(buf, uint32(c.Size)), nil
+}
+
+func decodeChunkRef(b []byte) (ChunkRef, error) {
+	c := ChunkRef{
+		Hash: hex.EncodeToString(b[:32]),
+		Size: int64(binary.BigEndian.Uint32(b[32:])),
+	}
+	if c.Size > maxEncryptedChunkSize {
+		return ChunkRef{}, fmt.Errorf("chunk %s of %d bytes exceeds the maximum chunk size", c.Hash, c.Size)
+	}
+	return c, nil
+}
+
+// writeChunkRef writes a single chunk reference, the empty reference ends
+// a fetched file.
+func writeChunkRef(w io.Writer, c ChunkRef) error {
+	if c == (ChunkRef{}) {
+		_, err := w.Write(make([]byte, chunkRefSize))
+		return err
+	}
+	buf, err := appendChunkRef(nil, c)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// readChunkRef reads a chunk reference, it returns io.EOF for the empty
+// reference.
+func readChunkRef(r io.Reader) (ChunkRef, error) {
+	var buf [chunkRefSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return ChunkRef{}, err
+	}
+	c, err := decodeChunkRef(buf[:])
+	if err != nil {
+		return ChunkRef{}, err
+	}
+	if c.Size == 0 {
+		return ChunkRef{}, io.EOF
+	}
+	return c, nil
+}
+
+// A batch is [count: 4 bytes][chunk reference]..., big endian.
+func writeChunkBatch(w io.Writer, batch []ChunkRef) error {
+	buf := make([]byte, 0, 4+chunkRefSize*len(batch))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(batch)))
+	for _, c := range batch {
+		var err error
+		if buf, err = appendChunkRef(buf, c); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func readChunkBatch(r io.Reader) ([]ChunkRef, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	count := binary.BigEndian.Uint32(header[:])
+	if count > chunkBatchSize {
+		return nil, fmt.Errorf("batch of %d chunks exceeds %d", count, chunkBatchSize)
+	}
+
+	buf := make([]byte, chunkRefSize*count)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	batch := make([]ChunkRef, count)
+	for i := range batch {
+		c, err := decodeChunkRef(buf[i*chunkRefSize:])
+		if err != nil {
+			return nil, err
+		}
+		if c.Size == 0 {
+			return nil, errors.New("empty chunk in batch")
+		}
+		batch[i] = c
+	}
+	return batch, nil
+}
+
+// A chunk list is [count: 4 bytes][chunk index: 4 bytes]..., big endian.
+func writeChunkList(w io.Writer, indexes []int) error {
+	buf := make([]byte, 0, 4+4*len(indexes))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(indexes)))
+	for _, i := range indexes {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(i))
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readChunkList reads a chunk list for a batch of n chunks. The indexes
+// are increasing.
+func readChunkList(r io.Reader, n int) ([]int, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	count := binary.BigEndian.Uint32(header[:])
+	if count > uint32(n) {
+		return nil, fmt.Errorf("chunk list of %d entries for %d chunks", count, n)
+	}
+
+	buf := make([]byte, 4*count)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	indexes := make([]int, count)
+	for i := range indexes {
+		index := int(binary.BigEndian.Uint32(buf[4*i:]))
+		if index >= n || (i > 0 && index <= indexes[i-1]) {
+			return nil, fmt.Errorf("chunk index %d out of order", index)
+		}
+		indexes[i] = index
+	}
+	return indexes, nil
+}
+
+// missingChunks returns the indexes of the chunks of a batch we do not
+// have, listing every distinct chunk once.
+func (s *FileServer) missingChunks(batch []ChunkRef) []int {
+	missing := []int{}
+	seen := make(map[string]bool)
+	for i, c := range batch {
+		if seen[c.Hash] {
+			continue
+		}
+		seen[c.Hash] = true
+		if !s.store.HasChunk(c.Hash) {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// replicaChunks iterates over the chunks of a replica sent to a peer.
+type replicaChunks interface {
+	// Next returns the reference of the next chunk and a function loading
+	// it, which is only called if the peer is missing the chunk. It
+	// returns io.EOF after the last chunk.
+	Next() (ChunkRef, func() ([]byte, error), error)
+	Close() error
+}
+
+// encryptedChunks makes a replica from one of our own files. Chunks are
+// encrypted deterministically, so a chunk is encrypted again when it is
+// sent instead of being held in memory until then.
+type encryptedChunks struct {
+	algo     string
+	key      []byte
+	store    *Store
+	manifest *ManifestReader
+	seal     hash.Hash
+	sealed   bool
+}
+
+func (s *FileServer) encryptedChunks(key string, dk dataKey) (*encryptedChunks, error) {
+	seal, err := newChunkSeal(dk.Key)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.store.OpenChunked(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedChunks{algo: dk.Algo, key: dk.Key, store: s.store, manifest: m, seal: seal}, nil
+}
+
+func (e *encryptedChunks) Next() (ChunkRef, func() ([]byte, error), error) {
+	if e.sealed {
+		return ChunkRef{}, nil, io.EOF
+	}
+	c, err := e.manifest.Next()
+	if errors.Is(err, io.EOF) {
+		e.sealed = true
+		seal := e.seal.Sum([]byte(sealMagic))
+		return ChunkRef{Hash: bytesHash(seal), Size: int64(len(seal))}, func() ([]byte, error) { return seal, nil }, nil
+	}
+	if err != nil {
+		return ChunkRef{}, nil, err
+	}
+
+	load := func() ([]byte, error) {
+		data, err := e.store.ReadChunk(c.Hash)
+		if err != nil {
+			return nil, err
+		}
+		return encryptChunk(e.algo, e.key, data)
+	}
+	data, err := load()
+	if err != nil {
+		return ChunkRef{}, nil, err
+	}
+	ref := ChunkRef{Hash: bytesHash(data), Size: int64(len(data))}
+	buf, err := appendChunkRef(nil, ref)
+	if err != nil {
+		return ChunkRef{}, nil, err
+	}
+	e.seal.Write(buf)
+	return ref, load, nil
+}
+
+func (e *encryptedChunks) Close() error {
+	return e.manifest.Close()
+}
+
+// storedChunks sends a replica we hold for another node as it is. A
+// replica stored as a single file before chunking is chunked first.
+type storedChunks struct {
+	store    *Store
+	manifest *ManifestReader
+}
+
+func (s *FileServer) storedChunks(hashedKey string) (*storedChunks, error) {
+	m, err := s.store.OpenChunked(hashedKey)
+	if err != nil {
+		return nil, err
+	}
+	return &storedChunks{store: s.store, manifest: m}, nil
+}
+
+func (c *storedChunks) Next() (ChunkRef, func() ([]byte, error), error) {
+	ref, err := c.manifest.Next()
+	if err != nil {
+		return ChunkRef{}, nil, err
+	}
+	return ref, func() ([]byte, error) { return c.store.ReadChunk(ref.Hash) }, nil
+}
+
+func (c *storedChunks) Close() error {
+	return c.manifest.Close()
+}
+
+// decryptChunks reads the chunks of a fetched file from r, verifies each
+// one against its hash, decrypts it with the file's data key and writes the
+// plaintext to w.
+// size is the size of the replica the peer reported. The replica must end
+// with a seal matching its chunks, unless unsealed is set: replicas stored
+// before they were sealed can be read when the caller verifies the content
+// against its digest instead. So can the replicas of files stored before
+// data keys existed, which are encrypted with AES-CTR as a whole.
+func decryptChunks(r io.Reader, size int64, dk dataKey, unsealed bool, w io.Writer) error {
+	seal, err := newChunkSeal(dk.Key)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxEncryptedChunkSize)
+	var (
+		read   int64
+		sealed bool
+		legacy *legacyDecrypter
+	)
+	for i := 0; ; i++ {
+		c, err := readChunkRef(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("transfer ended before chunk %d: %w", i, err)
+		}
+
+		data := buf[:c.Size]
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("transfer ended in chunk %d: %w", i, err)
+		}
+		if bytesHash(data) != c.Hash {
+			return fmt.Errorf("chunk %d does not match its hash", i)
+		}
+		read += c.Size
+		if i == 0 && dk.Legacy && unsealed && !bytes.HasPrefix(data, []byte(streamMagic)) && !isChunkSeal(data) {
+			legacy = newLegacyDecrypter(dk.Key)
+		}
+		if legacy != nil {
+			plaintext, err := legacy.decrypt(data)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(plaintext); err != nil {
+				return err
+			}
+			continue
+		}
+		if sealed {
+			return fmt.Errorf("%w: chunk %d follows the seal", ErrTampered, i)
+		}
+		if isChunkSeal(data) {
+			if !hmac.Equal(data[len(sealMagic):], seal.Sum(nil)) {
+				return fmt.Errorf("%w: chunks do not match the seal", ErrTampered)
+			}
+			sealed = true
+			continue
+		}
+		ref, err := appendChunkRef(nil, c)
+		if err != nil {
+			return err
+		}
+		seal.Write(ref)
+
+		plaintext, err := decryptChunk(dk.Key, data)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return err
+		}
+	}
+
+	if read != size {
+		return fmt.Errorf("received %d bytes of chunks, expected %d", read, size)
+	}
+	if legacy != nil {
+		return legacy.close()
+	}
+	if !sealed && !unsealed {
+		return fmt.Errorf("%w: replica is not sealed", ErrTampered)
+	}
+	return nil
+}
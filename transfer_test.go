@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	dbpkg "github.com/TinySkillet/DecentralizedP2PStorage/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// replicaChunkList returns the chunks of a replica of data as a peer sends
+// them, the seal last.
+func replicaChunkList(t *testing.T, data []byte, dk dataKey) [][]byte {
+	s := &FileServer{store: NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})}
+	_, err := s.store.Write("file", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	chunks, err := s.encryptedChunks("file", dk)
+	assert.Nil(t, err)
+	defer chunks.Close()
+	var out [][]byte
+	for {
+		_, load, err := chunks.Next()
+		if errors.Is(err, io.EOF) {
+			return out
+		}
+		assert.Nil(t, err)
+		c, err := load()
+		assert.Nil(t, err)
+		out = append(out, c)
+	}
+}
+
+// serveChunks encodes chunks the way a fetched file is sent and returns it
+// with the size of the replica.
+func serveChunks(t *testing.T, chunks [][]byte) (io.Reader, int64) {
+	buf := new(bytes.Buffer)
+	var size int64
+	for _, c := range chunks {
+		assert.Nil(t, writeChunkRef(buf, ChunkRef{Hash: bytesHash(c), Size: int64(len(c))}))
+		buf.Write(c)
+		size += int64(len(c))
+	}
+	assert.Nil(t, writeChunkRef(buf, ChunkRef{}))
+	return buf, size
+}
+
+func TestDecryptChunksChecksTheSeal(t *testing.T) {
+	dk := dataKey{Algo: AlgoAES256GCM, Key: newEcryptionKey()}
+	data := randomData(3, 1024*1024)
+	chunks := replicaChunkList(t, data, dk)
+	assert.Greater(t, len(chunks), 3)
+	assert.True(t, isChunkSeal(chunks[len(chunks)-1]))
+
+	r, size := serveChunks(t, chunks)
+	out := new(bytes.Buffer)
+	assert.Nil(t, decryptChunks(r, size, dk, false, out))
+	assert.Equal(t, data, out.Bytes())
+
+	last := len(chunks) - 1
+	tampered := map[string][][]byte{
+		"dropped":    slices.Concat(chunks[:1], chunks[2:]),
+		"reordered":  slices.Concat(chunks[1:2], chunks[:1], chunks[2:]),
+		"duplicated": slices.Concat(chunks[:1], chunks),
+		"truncated":  slices.Concat(chunks[:last-1], chunks[last:]),
+		"unsealed":   chunks[:last],
+		"extended":   slices.Concat(chunks, chunks[:1]),
+	}
+	for name, chunks := range tampered {
+		r, size := serveChunks(t, chunks)
+		err := decryptChunks(r, size, dk, false, io.Discard)
+		assert.ErrorIs(t, err, ErrTampered, name)
+	}
+
+	// replicas stored before they were sealed, for a caller that checks
+	// the digest
+	r, size = serveChunks(t, chunks[:last])
+	assert.Nil(t, decryptChunks(r, size, dk, true, io.Discard))
+}
+
+// legacyReplica encrypts data the way replicas were stored before data
+// keys existed: [iv][AES-CTR] over the whole file.
+func legacyReplica(t *testing.T, key, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	assert.Nil(t, err)
+	replica := make([]byte, aes.BlockSize+len(data))
+	iv := replica[:aes.BlockSize]
+	copy(iv, randomData(4, aes.BlockSize))
+	cipher.NewCTR(block, iv).XORKeyStream(replica[aes.BlockSize:], data)
+	return replica
+}
+
+func TestDecryptChunksReadsLegacyReplicas(t *testing.T) {
+	key := newEcryptionKey()
+	data := randomData(4, 200*1024)
+	replica := legacyReplica(t, key, data)
+	// the IV spans the first two chunks
+	chunks := [][]byte{replica[:5], replica[5 : 64*1024], replica[64*1024:]}
+
+	r, size := serveChunks(t, chunks)
+	out := new(bytes.Buffer)
+	legacy := dataKey{Algo: AlgoAES256GCM, Key: key, Legacy: true}
+	assert.Nil(t, decryptChunks(r, size, legacy, true, out))
+	assert.Equal(t, data, out.Bytes())
+
+	// nothing authenticates them, the caller must check the digest
+	r, size = serveChunks(t, chunks)
+	err := decryptChunks(r, size, legacy, false, io.Discard)
+	assert.ErrorIs(t, err, ErrTampered)
+
+	// only files stored with a master key directly can have such replicas
+	r, size = serveChunks(t, chunks)
+	err = decryptChunks(r, size, dataKey{Algo: AlgoAES256GCM, Key: key}, true, io.Discard)
+	assert.ErrorIs(t, err, ErrTampered)
+}
+
+func TestGetReadsReplicasStoredBeforeDataKeys(t *testing.T) {
+	servers := newTestCluster(t, 2, func() FileServerOpts {
+		return FileServerOpts{ReplicationFactor: 1}
+	})
+	owner, peer := servers[0], servers[1]
+	ctx := context.Background()
+
+	d := newTestDB(t)
+	_, err := d.GetOrCreateActiveKey(ctx, func() []byte { return owner.EncryptionKey })
+	assert.Nil(t, err)
+	owner.DB = d
+
+	// the peer holds the replicas as older versions stored them, one with
+	// a digest recorded and one without
+	data := randomData(5, 300*1024)
+	for name, digest := range map[string]string{"checked.bin": bytesHash(data), "unchecked.bin": ""} {
+		writeSingleFileObject(t, peer.store, owner.hashKey(name), legacyReplica(t, owner.EncryptionKey, data))
+		assert.Nil(t, d.InsertFileWithKey(ctx, dbpkg.File{
+			ID:     owner.hashKey(name),
+			Name:   name,
+			Hash:   owner.hashKey(name),
+			Digest: digest,
+			Size:   int64(len(data)),
+		}, DefaultKeyID))
+	}
+
+	_, r, err := owner.Get(ctx, "checked.bin")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	_, _, err = owner.Get(ctx, "unchecked.bin")
+	assert.ErrorIs(t, err, ErrTampered)
+	assert.False(t, owner.store.Has("unchecked.bin"))
+}
+
+// writeSingleFileObject stores data under key the way objects were stored
+// before chunking: as a file of its own.
+func writeSingleFileObject(t *testing.T, store *Store, key string, data []byte) {
+	path := store.FullPathForKey(key)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+	assert.Nil(t, os.WriteFile(path, data, 0o644))
+}
+
+func TestSingleFileReplicasAreServed(t *testing.T) {
+	s := &FileServer{store: NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})}
+	data := randomData(5, 3*1024*1024)
+	writeSingleFileObject(t, s.store, "replica", data)
+	_, err := s.store.OpenManifest("replica")
+	assert.ErrorIs(t, err, ErrNotManifest)
+
+	chunks, err := s.storedChunks("replica")
+	assert.Nil(t, err)
+	got := new(bytes.Buffer)
+	for {
+		c, load, err := chunks.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.Nil(t, err)
+		b, err := load()
+		assert.Nil(t, err)
+		assert.Equal(t, c.Hash, bytesHash(b))
+		got.Write(b)
+	}
+	assert.Nil(t, chunks.Close())
+	assert.Equal(t, data, got.Bytes())
+
+	// the replica was chunked on the way
+	m, err := s.store.ReadManifest("replica")
+	assert.Nil(t, err)
+	assert.Greater(t, len(m.Chunks), 1)
+	assert.Nil(t, s.store.Verify("replica", bytesHash(data)))
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A directory is stored as a tree: each file under <key>/<relative path>,
+// then an index of the tree under <key>/.p2ptree.json. The index records
+// the directories and the files that were stored, with their modes and
+// modification times, and is what a recursive get reconstructs the tree
+// from. Only directories and regular files are stored.
+
+const treeIndexName = ".p2ptree.json"
+
+func treeIndexKey(key string) string {
+	return key + "/" + treeIndexName
+}
+
+// TreeEntry is a file or directory of a stored tree. Path is relative to
+// the root of the tree, with slashes; the root itself is ".".
+type TreeEntry struct {
+	Path    string      `json:"path"`
+	Dir     bool        `json:"dir,omitempty"`
+	Size    int64       `json:"size,omitempty"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+}
+
+type TreeIndex struct {
+	Entries []TreeEntry `json:"entries"`
+}
+
+// TreeFailure is a file of a tree that could not be stored or restored.
+type TreeFailure struct {
+	Path string
+	Err  error
+}
+
+// TreeReport is the outcome of storing or getting a tree.
+type TreeReport struct {
+	Files    int
+	Bytes    int64
+	Failures []TreeFailure
+}
+
+func (r *TreeReport) fail(path string, err error) {
+	r.Failures = append(r.Failures, TreeFailure{Path: path, Err: err})
+}
+
+// treeMode keeps the bits of a mode that are restored. The index may come
+// from another node, so setuid and setgid are not among them.
+func treeMode(m fs.FileMode) fs.FileMode {
+	return m & (fs.ModePerm | fs.ModeSticky)
+}
+
+// StoreTree stores the files under dir below key, parallel at a time, with
+// store, then the index of the tree. Files that cannot be read or stored
+// are reported, and left out of the index.
+func StoreTree(dir, key string, parallel int, store func(key string, r io.Reader, size int64) error) (*TreeReport, error) {
+	report := new(TreeReport)
+	var dirs, files []TreeEntry
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		rel, relErr := filepath.Rel(dir, p)
+		if relErr != nil {
+			return relErr
+		}
+		rel = filepath.ToSlash(rel)
+		if err != nil {
+			if p == dir {
+				return err
+			}
+			report.fail(rel, err)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if rel == treeIndexName {
+			report.fail(rel, errors.New("name reserved for the index of the tree"))
+			return nil
+		}
+
+		switch {
+		case d.IsDir():
+			fi, err := d.Info()
+			if err != nil {
+				report.fail(rel, err)
+				return fs.SkipDir
+			}
+			dirs = append(dirs, TreeEntry{Path: rel, Dir: true, Mode: treeMode(fi.Mode()), ModTime: fi.ModTime()})
+		case d.Type().IsRegular():
+			files = append(files, TreeEntry{Path: rel})
+		default:
+			report.fail(rel, fmt.Errorf("not a regular file (%s)", d.Type()))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	stored := runTree(files, parallel, func(e *TreeEntry) error {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(e.Path)))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		e.Size, e.Mode, e.ModTime = fi.Size(), treeMode(fi.Mode()), fi.ModTime()
+		return store(key+"/"+e.Path, f, fi.Size())
+	}, func(e TreeEntry, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		report.fail(e.Path, err)
+	})
+	for _, e := range stored {
+		report.Files++
+		report.Bytes += e.Size
+	}
+
+	index, err := json.Marshal(TreeIndex{Entries: append(dirs, stored...)})
+	if err != nil {
+		return report, err
+	}
+	if err := store(treeIndexKey(key), bytes.NewReader(index), int64(len(index))); err != nil {
+		return report, fmt.Errorf("storing the index of the tree: %w", err)
+	}
+	return report, nil
+}
+
+// GetTree reconstructs the tree stored below key in dir, fetching files
+// parallel at a time with get. Files are written through temporary files,
+// so a file that fails is not left half written; directories get their
+// modes and times last, as writing into them changes their times.
+func GetTree(key, dir string, parallel int, get func(key string) (io.ReadCloser, error)) (*TreeReport, error) {
+	r, err := get(treeIndexKey(key))
+	if err != nil {
+		return nil, fmt.Errorf("fetching the index of the tree: %w", err)
+	}
+	var index TreeIndex
+	err = json.NewDecoder(r).Decode(&index)
+	r.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading the index of the tree: %w", err)
+	}
+
+	report := new(TreeReport)
+	var dirs, files []TreeEntry
+	for _, e := range index.Entries {
+		// the index may come from another node, its paths must stay in dir
+		if e.Path != "." && (!filepath.IsLocal(filepath.FromSlash(e.Path)) || strings.Contains(e.Path, `\`)) {
+			report.fail(e.Path, errors.New("path leaves the tree"))
+			continue
+		}
+		if e.Path == "." && !e.Dir {
+			report.fail(e.Path, errors.New("the root of the tree is not a file"))
+			continue
+		}
+		e.Mode = treeMode(e.Mode)
+		if e.Dir {
+			dirs = append(dirs, e)
+		} else {
+			files = append(files, e)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	// directories that exist already may not let us in, they get their
+	// own modes once their files are written
+	for _, e := range dirs {
+		path := filepath.Join(dir, filepath.FromSlash(e.Path))
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			return report, err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return report, err
+		}
+		if err := os.Chmod(path, fi.Mode().Perm()|0o700); err != nil {
+			return report, err
+		}
+	}
+
+	var mu sync.Mutex
+	restored := runTree(files, parallel, func(e *TreeEntry) error {
+		path := filepath.Join(dir, filepath.FromSlash(e.Path))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		r, err := get(key + "/" + e.Path)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return writeTreeFile(path, r, *e)
+	}, func(e TreeEntry, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		report.fail(e.Path, err)
+	})
+	for _, e := range restored {
+		report.Files++
+		report.Bytes += e.Size
+	}
+
+	// the deepest first and the root last, so that setting the times of a
+	// directory does not change those of its parent, and its mode does not
+	// lock us out of its subdirectories
+	depth := func(e TreeEntry) int {
+		if e.Path == "." {
+			return -1
+		}
+		return strings.Count(e.Path, "/")
+	}
+	slices.SortFunc(dirs, func(a, b TreeEntry) int {
+		return depth(b) - depth(a)
+	})
+	for _, e := range dirs {
+		path := filepath.Join(dir, filepath.FromSlash(e.Path))
+		if err := os.Chmod(path, e.Mode); err != nil {
+			report.fail(e.Path, err)
+			continue
+		}
+		if err := os.Chtimes(path, e.ModTime, e.ModTime); err != nil {
+			report.fail(e.Path, err)
+		}
+	}
+	return report, nil
+}
+
+func writeTreeFile(path string, r io.Reader, e TreeEntry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".p2p-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, r)
+	if err == nil && n != e.Size {
+		err = fmt.Errorf("got %d bytes, the index records %d", n, e.Size)
+	}
+	if err == nil {
+		err = tmp.Chmod(e.Mode)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), e.ModTime, e.ModTime); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// runTree runs fn on entries, parallel at a time, and returns the entries
+// it succeeded on, in their order. fn may update the entry it is given.
+func runTree(entries []TreeEntry, parallel int, fn func(e *TreeEntry) error, failed func(e TreeEntry, err error)) []TreeEntry {
+	ok := make([]bool, len(entries))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for range max(parallel, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if err := fn(&entries[i]); err != nil {
+					failed(entries[i], err)
+					continue
+				}
+				ok[i] = true
+			}
+		}()
+	}
+	for i := range entries {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var done []TreeEntry
+	for i, e := range entries {
+		if ok[i] {
+			done = append(done, e)
+		}
+	}
+	return done
+}
+
+// printTreeReport prints the failures of a report and a summary of it.
+func printTreeReport(verb string, r *TreeReport) error {
+	slices.SortFunc(r.Failures, func(a, b TreeFailure) int { return strings.Compare(a.Path, b.Path) })
+	for _, f := range r.Failures {
+		fmt.Printf("%s: failed: %v\n", f.Path, f.Err)
+	}
+	fmt.Printf("%s %d file(s), %d bytes; %d failed\n", verb, r.Files, r.Bytes, len(r.Failures))
+	if len(r.Failures) > 0 {
+		return fmt.Errorf("%d file(s) failed", len(r.Failures))
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// treeFuncs returns the functions StoreTree and GetTree use, on s.
+func treeFuncs(s *FileServer) (func(string, io.Reader, int64) error, func(string) (io.ReadCloser, error)) {
+	store := func(key string, r io.Reader, size int64) error {
+		_, err := s.Store(key, r)
+		return err
+	}
+	get := func(key string) (io.ReadCloser, error) {
+		_, r, err := s.Get(context.Background(), key)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(r), nil
+	}
+	return store, get
+}
+
+func TestStoreTree(t *testing.T) {
+	s := newTestServer(t, FileServerOpts{DB: newTestDB(t)})
+	store, get := treeFuncs(s)
+	src := t.TempDir()
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]struct {
+		data []byte
+		mode fs.FileMode
+	}{
+		"readme.txt":        {[]byte("hello"), 0o644},
+		"bin/run.sh":        {[]byte("#!/bin/sh\n"), 0o755},
+		"data/deep/big.bin": {randomData(5, 300*1024), 0o600},
+	}
+	for name, f := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		assert.Nil(t, os.WriteFile(p, f.data, f.mode))
+		assert.Nil(t, os.Chmod(p, f.mode))
+		assert.Nil(t, os.Chtimes(p, mtime, mtime))
+	}
+	assert.Nil(t, os.Mkdir(filepath.Join(src, "empty"), 0o750))
+	assert.Nil(t, os.Chtimes(filepath.Join(src, "bin"), mtime, mtime))
+	assert.Nil(t, os.Symlink("readme.txt", filepath.Join(src, "link")))
+
+	report, err := StoreTree(src, "backup", 2, store)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Files)
+	assert.Equal(t, int64(5+10+300*1024), report.Bytes)
+	assert.Len(t, report.Failures, 1)
+	assert.Equal(t, "link", report.Failures[0].Path)
+	assert.True(t, s.store.Has("backup/data/deep/big.bin"))
+
+	dst := filepath.Join(t.TempDir(), "restored")
+	report, err = GetTree("backup", dst, 2, get)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Files)
+	assert.Empty(t, report.Failures)
+	for name, f := range files {
+		p := filepath.Join(dst, filepath.FromSlash(name))
+		data, err := os.ReadFile(p)
+		assert.Nil(t, err)
+		assert.Equal(t, f.data, data, name)
+		fi, err := os.Stat(p)
+		assert.Nil(t, err)
+		assert.Equal(t, f.mode, fi.Mode().Perm(), name)
+		assert.True(t, mtime.Equal(fi.ModTime()), name)
+	}
+	fi, err := os.Stat(filepath.Join(dst, "empty"))
+	assert.Nil(t, err)
+	assert.True(t, fi.IsDir())
+	assert.Equal(t, fs.FileMode(0o750), fi.Mode().Perm())
+	fi, err = os.Stat(filepath.Join(dst, "bin"))
+	assert.Nil(t, err)
+	assert.True(t, mtime.Equal(fi.ModTime()))
+	_, err = os.Lstat(filepath.Join(dst, "link"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// a file that cannot be fetched fails alone and leaves nothing behind
+	assert.Nil(t, s.Delete("backup/readme.txt"))
+	dst = t.TempDir()
+	report, err = GetTree("backup", dst, 2, get)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Files)
+	assert.Len(t, report.Failures, 1)
+	assert.Equal(t, "readme.txt", report.Failures[0].Path)
+	entries, err := os.ReadDir(dst)
+	assert.Nil(t, err)
+	for _, e := range entries {
+		assert.False(t, strings.HasPrefix(e.Name(), ".p2p-"), e.Name())
+	}
+	_, err = os.Stat(filepath.Join(dst, "readme.txt"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = GetTree("never-stored", t.TempDir(), 2, get)
+	assert.ErrorContains(t, err, "index of the tree")
+}
+
+func TestGetTreeStaysInDir(t *testing.T) {
+	s := newTestServer(t, FileServerOpts{DB: newTestDB(t)})
+	store, get := treeFuncs(s)
+	index := `{"entries":[{"path":"../evil","size":1,"mode":420},{"path":"ok","size":1,"mode":420}]}`
+	assert.Nil(t, store(treeIndexKey("shared"), strings.NewReader(index), int64(len(index))))
+	assert.Nil(t, store("shared/../evil", strings.NewReader("x"), 1))
+	assert.Nil(t, store("shared/ok", strings.NewReader("y"), 1))
+
+	parent := t.TempDir()
+	report, err := GetTree("shared", filepath.Join(parent, "out"), 1, get)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Files)
+	assert.Len(t, report.Failures, 1)
+	assert.Equal(t, "../evil", report.Failures[0].Path)
+	_, err = os.Stat(filepath.Join(parent, "evil"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestGetTreeRestoresSafeModes(t *testing.T) {
+	s := newTestServer(t, FileServerOpts{DB: newTestDB(t)})
+	store, get := treeFuncs(s)
+	index := `{"entries":[` +
+		`{"path":".","size":1,"mode":420},` +
+		`{"path":".","dir":true,"mode":493},` +
+		`{"path":"locked","dir":true,"mode":0},` +
+		`{"path":"locked/file","size":1,"mode":420},` +
+		`{"path":"suid","size":1,"mode":` + strconv.Itoa(int(fs.ModeSetuid|fs.ModeSetgid|0o755)) + `}]}`
+	assert.Nil(t, store(treeIndexKey("hostile"), strings.NewReader(index), int64(len(index))))
+	assert.Nil(t, store("hostile/.", strings.NewReader("x"), 1))
+	assert.Nil(t, store("hostile/locked/file", strings.NewReader("y"), 1))
+	assert.Nil(t, store("hostile/suid", strings.NewReader("z"), 1))
+
+	dst := filepath.Join(t.TempDir(), "out")
+	t.Cleanup(func() { os.Chmod(filepath.Join(dst, "locked"), 0o755) })
+	report, err := GetTree("hostile", dst, 1, get)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Files)
+	assert.Len(t, report.Failures, 1)
+	assert.Equal(t, ".", report.Failures[0].Path)
+
+	fi, err := os.Stat(filepath.Join(dst, "suid"))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0o755), fi.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid))
+	fi, err = os.Stat(filepath.Join(dst, "locked"))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0), fi.Mode().Perm())
+	assert.Nil(t, os.Chmod(filepath.Join(dst, "locked"), 0o755))
+	data, err := os.ReadFile(filepath.Join(dst, "locked", "file"))
+	assert.Nil(t, err)
+	assert.Equal(t, "y", string(data))
+}
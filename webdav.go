@@ -0,0 +1,912 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The WebDAV gateway lets desktop clients mount the files of a node as a
+// drive. The path of a file is its key; directories are the prefixes of
+// keys up to a slash, and MKCOL records empty ones until files are put in
+// them. Supported are the methods of WebDAV classes 1 and 2: a locked file
+// or directory can only be written, deleted or moved by requests that
+// submit the lock token. Properties cannot be set.
+
+const davAllow = "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, COPY, MOVE, LOCK, UNLOCK"
+
+// WebDAVHandler returns the handler of the WebDAV gateway. It needs a
+// database, which knows the files of the node and its directories.
+func (s *FileServer) WebDAVHandler() http.Handler {
+	locks := newDavLocks()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.DB == nil {
+			http.Error(w, "node has no database", http.StatusNotImplemented)
+			return
+		}
+		key := davKey(r.URL.Path)
+		if err := davCheckLocks(r, key, locks); err != nil {
+			davError(w, err)
+			return
+		}
+		var err error
+		switch r.Method {
+		case http.MethodOptions:
+			w.Header().Set("Allow", davAllow)
+			w.Header().Set("DAV", "1, 2")
+			w.Header().Set("MS-Author-Via", "DAV")
+		case http.MethodGet, http.MethodHead:
+			err = s.davGet(w, r, key)
+		case http.MethodPut:
+			err = s.davPut(w, r, key)
+		case http.MethodDelete:
+			err = s.davDelete(r.Context(), key)
+			if err == nil {
+				locks.release(key)
+				w.WriteHeader(http.StatusNoContent)
+			}
+		case "MKCOL":
+			err = s.davMkcol(w, r, key)
+		case "COPY", "MOVE":
+			err = s.davCopy(w, r, key, r.Method == "MOVE", locks)
+		case "PROPFIND":
+			err = s.davPropfind(w, r, key, locks)
+		case "PROPPATCH":
+			err = s.davProppatch(w, r, key)
+		case "LOCK":
+			err = s.davLock(w, r, key, locks)
+		case "UNLOCK":
+			token := strings.Trim(r.Header.Get("Lock-Token"), "<>")
+			err = locks.unlock(key, token)
+			if err == nil {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			w.Header().Set("Allow", davAllow)
+			err = davStatus(http.StatusMethodNotAllowed)
+		}
+		if err != nil {
+			davError(w, err)
+		}
+	})
+}
+
+// davCheckLocks fails with 423 Locked if r would change what a lock it does
+// not submit the token of is on.
+func davCheckLocks(r *http.Request, key string, locks *davLocks) error {
+	switch r.Method {
+	case http.MethodPut, "MKCOL":
+		return locks.check(r, key, false)
+	case http.MethodDelete:
+		return locks.check(r, key, true)
+	case "COPY", "MOVE":
+		if r.Method == "MOVE" {
+			if err := locks.check(r, key, true); err != nil {
+				return err
+			}
+		}
+		destKey, err := davDestination(r)
+		if err != nil {
+			return err
+		}
+		return locks.check(r, destKey, true)
+	}
+	return nil
+}
+
+// davStatus is an error answered with its status code.
+type davStatus int
+
+func (e davStatus) Error() string { return http.StatusText(int(e)) }
+
+func davError(w http.ResponseWriter, err error) {
+	var status davStatus
+	if errors.As(err, &status) {
+		http.Error(w, status.Error(), int(status))
+		return
+	}
+	httpError(w, err)
+}
+
+// davKey returns the key a request path names, "" for the root directory.
+func davKey(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+func davHref(key string, dir bool) string {
+	href := (&url.URL{Path: "/" + key}).EscapedPath()
+	if dir && key != "" {
+		href += "/"
+	}
+	return href
+}
+
+// davEntry is a file or directory.
+type davEntry struct {
+	Key     string
+	Dir     bool
+	Size    int64
+	Digest  string
+	ModTime time.Time
+}
+
+// davStat returns the file or directory key names, fs.ErrNotExist if there
+// is neither.
+func (s *FileServer) davStat(ctx context.Context, key string) (*davEntry, error) {
+	if key == "" {
+		return &davEntry{Dir: true}, nil
+	}
+	f, err := s.DB.GetFile(ctx, s.hashKey(key))
+	if err == nil {
+		return &davEntry{Key: key, Size: f.Size, Digest: f.Digest, ModTime: f.CreatedAt}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if size, digest, err := s.localStat(key); err == nil {
+		return &davEntry{Key: key, Size: size, Digest: digest}, nil
+	}
+
+	dir, err := s.DB.GetDirectory(ctx, key)
+	if err == nil {
+		return &davEntry{Key: key, Dir: true, ModTime: dir.CreatedAt}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	files, err := s.DB.ListFilesByPrefix(ctx, key+"/", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := s.DB.ListDirectoriesByPrefix(ctx, key+"/")
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 || len(dirs) > 0 {
+		return &davEntry{Key: key, Dir: true}, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+// davChildren returns the files and directories under dir, down to depth
+// levels, in key order.
+func (s *FileServer) davChildren(ctx context.Context, dir string, depth int) ([]davEntry, error) {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	files, err := s.DB.ListFilesByPrefix(ctx, prefix, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := s.DB.ListDirectoriesByPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]davEntry)
+	// add adds the entry named rest under dir and the directories leading
+	// to it, as far down as depth goes
+	add := func(rest string, e davEntry) {
+		segments := strings.Split(rest, "/")
+		for i := 1; i < len(segments) && i <= depth; i++ {
+			key := prefix + strings.Join(segments[:i], "/")
+			if _, ok := entries[key]; !ok {
+				entries[key] = davEntry{Key: key, Dir: true}
+			}
+		}
+		if len(segments) <= depth {
+			entries[e.Key] = e
+		}
+	}
+	for _, d := range dirs {
+		add(d.Name[len(prefix):], davEntry{Key: d.Name, Dir: true, ModTime: d.CreatedAt})
+	}
+	for _, f := range files {
+		add(f.Name[len(prefix):], davEntry{Key: f.Name, Size: f.Size, Digest: f.Digest, ModTime: f.CreatedAt})
+	}
+
+	out := make([]davEntry, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, e)
+	}
+	slices.SortFunc(out, func(a, b davEntry) int { return strings.Compare(a.Key, b.Key) })
+	return out, nil
+}
+
+// davParent fails with 409 Conflict unless the directory key would be put
+// in exists, as WebDAV does not create directories on the way.
+func (s *FileServer) davParent(ctx context.Context, key string) error {
+	parent, _ := path.Split(key)
+	e, err := s.davStat(ctx, strings.TrimSuffix(parent, "/"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return davStatus(http.StatusConflict)
+	}
+	if err != nil {
+		return err
+	}
+	if !e.Dir {
+		return davStatus(http.StatusConflict)
+	}
+	return nil
+}
+
+func (s *FileServer) davGet(w http.ResponseWriter, r *http.Request, key string) error {
+	e, err := s.davStat(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	if e.Dir {
+		return davStatus(http.StatusMethodNotAllowed)
+	}
+	setDigest(w, e.Digest)
+	if !e.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", e.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method == http.MethodHead {
+		// the size is known without fetching the file
+		w.Header().Set("Content-Type", davContentType(key))
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.FormatInt(e.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	_, fr, err := s.Get(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	if c, ok := fr.(io.Closer); ok {
+		defer c.Close()
+	}
+	if rs, ok := fr.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(key), e.ModTime, rs)
+		return nil
+	}
+	w.Header().Set("Content-Type", davContentType(key))
+	io.Copy(w, fr)
+	return nil
+}
+
+func davContentType(key string) string {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func (s *FileServer) davPut(w http.ResponseWriter, r *http.Request, key string) error {
+	e, err := s.davStat(r.Context(), key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if e != nil && e.Dir {
+		return davStatus(http.StatusMethodNotAllowed)
+	}
+	if err := s.davParent(r.Context(), key); err != nil {
+		return err
+	}
+	if _, err := s.Store(key, requestBody{r.Body}); err != nil {
+		return err
+	}
+	if e != nil {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return nil
+}
+
+// davDelete deletes a file, or a directory and everything under it.
+func (s *FileServer) davDelete(ctx context.Context, key string) error {
+	e, err := s.davStat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !e.Dir {
+		return s.Delete(key)
+	}
+	if key == "" {
+		return davStatus(http.StatusForbidden)
+	}
+
+	files, err := s.DB.ListFilesByPrefix(ctx, key+"/", "", 0)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := s.Delete(f.Name); err != nil {
+			return err
+		}
+	}
+	return s.DB.DeleteDirectory(ctx, key)
+}
+
+func (s *FileServer) davMkcol(w http.ResponseWriter, r *http.Request, key string) error {
+	if r.ContentLength > 0 {
+		return davStatus(http.StatusUnsupportedMediaType)
+	}
+	if _, err := s.davStat(r.Context(), key); err == nil {
+		return davStatus(http.StatusMethodNotAllowed)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := s.davParent(r.Context(), key); err != nil {
+		return err
+	}
+	if err := s.DB.CreateDirectory(r.Context(), key); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// davCopy copies or moves a file or a directory to the Destination of the
+// request. Files are copied through the store under their new key, which
+// gives them new identifiers and new replicas.
+func (s *FileServer) davCopy(w http.ResponseWriter, r *http.Request, key string, move bool, locks *davLocks) error {
+	ctx := r.Context()
+	destKey, err := davDestination(r)
+	if err != nil {
+		return err
+	}
+	if key == "" || destKey == "" || destKey == key || strings.HasPrefix(destKey, key+"/") {
+		return davStatus(http.StatusForbidden)
+	}
+
+	src, err := s.davStat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := s.davParent(ctx, destKey); err != nil {
+		return err
+	}
+	_, err = s.davStat(ctx, destKey)
+	existed := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if existed {
+		if r.Header.Get("Overwrite") == "F" {
+			return davStatus(http.StatusPreconditionFailed)
+		}
+		if err := s.davDelete(ctx, destKey); err != nil {
+			return err
+		}
+		locks.release(destKey)
+	}
+
+	if !src.Dir {
+		err = s.davCopyFile(ctx, key, destKey)
+	} else {
+		// without Depth: 0, the directory is copied with its content
+		err = s.davCopyDir(ctx, key, destKey, move || r.Header.Get("Depth") != "0")
+	}
+	if err != nil {
+		return err
+	}
+	if move {
+		if err := s.davDelete(ctx, key); err != nil {
+			return err
+		}
+		locks.release(key)
+	}
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return nil
+}
+
+// davDestination returns the key the Destination of a COPY or MOVE names.
+func davDestination(r *http.Request) (string, error) {
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" {
+		return "", davStatus(http.StatusBadRequest)
+	}
+	if dest.Host != "" && dest.Host != r.Host {
+		return "", davStatus(http.StatusBadGateway)
+	}
+	return davKey(dest.Path), nil
+}
+
+func (s *FileServer) davCopyFile(ctx context.Context, from, to string) error {
+	_, r, err := s.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	_, err = s.Store(to, r)
+	return err
+}
+
+func (s *FileServer) davCopyDir(ctx context.Context, from, to string, content bool) error {
+	if err := s.DB.CreateDirectory(ctx, to); err != nil {
+		return err
+	}
+	if !content {
+		return nil
+	}
+	dirs, err := s.DB.ListDirectoriesByPrefix(ctx, from+"/")
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if err := s.DB.CreateDirectory(ctx, to+strings.TrimPrefix(d.Name, from)); err != nil {
+			return err
+		}
+	}
+	files, err := s.DB.ListFilesByPrefix(ctx, from+"/", "", 0)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := s.davCopyFile(ctx, f.Name, to+strings.TrimPrefix(f.Name, from)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// davPropfind asks for properties, of all the known properties
+// (allprop, an empty body), of their names only (propname) or of the
+// listed ones (prop).
+type davPropfind struct {
+	Allprop  *struct{} `xml:"DAV: allprop"`
+	Propname *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Xmlns     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"D:href"`
+	Propstats []davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davPropSet `xml:"D:prop"`
+	Status string     `xml:"D:status"`
+}
+
+type davPropSet struct {
+	Props []davProp
+}
+
+// davProp is a property with its value as XML.
+type davProp struct {
+	XMLName xml.Name
+	Value   string `xml:",innerxml"`
+}
+
+// davPropNames are the properties of files and directories, in the order
+// they are listed.
+var davPropNames = []string{
+	"displayname", "resourcetype", "getcontentlength", "getcontenttype",
+	"getetag", "getlastmodified", "creationdate", "supportedlock", "lockdiscovery",
+}
+
+func davStatusLine(status int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", status, http.StatusText(status))
+}
+
+func davText(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// davProps returns the properties e has, by name.
+func davProps(e davEntry) map[string]string {
+	props := map[string]string{
+		"displayname":   davText(path.Base("/" + e.Key)),
+		"resourcetype":  "",
+		"supportedlock": "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>",
+	}
+	if e.Dir {
+		props["resourcetype"] = "<D:collection/>"
+	} else {
+		props["getcontentlength"] = strconv.FormatInt(e.Size, 10)
+		props["getcontenttype"] = davText(davContentType(e.Key))
+		if e.Digest != "" {
+			props["getetag"] = davText(`"` + e.Digest + `"`)
+		}
+	}
+	if !e.ModTime.IsZero() {
+		props["getlastmodified"] = e.ModTime.UTC().Format(http.TimeFormat)
+		props["creationdate"] = e.ModTime.UTC().Format(time.RFC3339)
+	}
+	return props
+}
+
+func davName(name xml.Name) xml.Name {
+	if name.Space == "DAV:" {
+		return xml.Name{Local: "D:" + name.Local}
+	}
+	return name
+}
+
+func (s *FileServer) davPropfind(w http.ResponseWriter, r *http.Request, key string, locks *davLocks) error {
+	var req davPropfind
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil && err != io.EOF {
+		return davStatus(http.StatusBadRequest)
+	}
+	depth := 1
+	switch r.Header.Get("Depth") {
+	case "0":
+		depth = 0
+	case "", "infinity":
+		depth = math.MaxInt
+	}
+
+	e, err := s.davStat(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	entries := []davEntry{*e}
+	if e.Dir && depth > 0 {
+		children, err := s.davChildren(r.Context(), key, depth)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, children...)
+	}
+
+	ms := davMultistatus{Xmlns: "DAV:"}
+	for _, e := range entries {
+		props := davProps(e)
+		props["lockdiscovery"] = locks.discovery(e.Key)
+		var found, missing davPropSet
+		switch {
+		case req.Prop != nil:
+			for _, n := range req.Prop.Names {
+				if v, ok := props[n.XMLName.Local]; ok && n.XMLName.Space == "DAV:" {
+					found.Props = append(found.Props, davProp{XMLName: davName(n.XMLName), Value: v})
+				} else {
+					missing.Props = append(missing.Props, davProp{XMLName: davName(n.XMLName)})
+				}
+			}
+		default:
+			for _, name := range davPropNames {
+				if v, ok := props[name]; ok {
+					if req.Propname != nil {
+						v = ""
+					}
+					found.Props = append(found.Props, davProp{XMLName: xml.Name{Local: "D:" + name}, Value: v})
+				}
+			}
+		}
+
+		resp := davResponse{Href: davHref(e.Key, e.Dir)}
+		if len(found.Props) > 0 {
+			resp.Propstats = append(resp.Propstats, davPropstat{Prop: found, Status: davStatusLine(http.StatusOK)})
+		}
+		if len(missing.Props) > 0 {
+			resp.Propstats = append(resp.Propstats, davPropstat{Prop: missing, Status: davStatusLine(http.StatusNotFound)})
+		}
+		ms.Responses = append(ms.Responses, resp)
+	}
+	writeDAV(w, http.StatusMultiStatus, ms)
+	return nil
+}
+
+// davProppatch refuses to set or remove properties, which the node has
+// nowhere to keep.
+func (s *FileServer) davProppatch(w http.ResponseWriter, r *http.Request, key string) error {
+	names, err := davProppatchNames(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return davStatus(http.StatusBadRequest)
+	}
+	e, err := s.davStat(r.Context(), key)
+	if err != nil {
+		return err
+	}
+
+	var refused davPropSet
+	for _, n := range names {
+		refused.Props = append(refused.Props, davProp{XMLName: davName(n)})
+	}
+	resp := davResponse{Href: davHref(e.Key, e.Dir)}
+	if len(refused.Props) > 0 {
+		resp.Propstats = []davPropstat{{Prop: refused, Status: davStatusLine(http.StatusForbidden)}}
+	}
+	writeDAV(w, http.StatusMultiStatus, davMultistatus{Xmlns: "DAV:", Responses: []davResponse{resp}})
+	return nil
+}
+
+// davProppatchNames returns the names of the properties a PROPPATCH body
+// sets or removes: the elements in its DAV: prop elements.
+func davProppatchNames(r io.Reader) ([]xml.Name, error) {
+	var (
+		names  []xml.Name
+		inProp bool
+		depth  int
+	)
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if inProp && depth == 4 {
+				names = append(names, t.Name)
+			}
+			if t.Name == (xml.Name{Space: "DAV:", Local: "prop"}) && depth == 3 {
+				inProp = true
+			}
+		case xml.EndElement:
+			if depth == 3 {
+				inProp = false
+			}
+			depth--
+		}
+	}
+}
+
+// davMaxLockTimeout is how long a lock lasts at most without being
+// refreshed, and how long it lasts when the client does not ask.
+const davMaxLockTimeout = time.Hour
+
+// davLock is an exclusive write lock. A deep lock on a directory covers
+// everything under it.
+type davLock struct {
+	Token   string
+	Key     string
+	Deep    bool
+	Expires time.Time
+}
+
+// activelock returns the lock as the XML of an activelock element.
+func (l *davLock) activelock() string {
+	depth := "0"
+	if l.Deep {
+		depth = "infinity"
+	}
+	return fmt.Sprintf(`<D:activelock>`+
+		`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>`+
+		`<D:depth>%s</D:depth><D:timeout>Second-%d</D:timeout>`+
+		`<D:locktoken><D:href>%s</D:href></D:locktoken>`+
+		`<D:lockroot><D:href>%s</D:href></D:lockroot>`+
+		`</D:activelock>`,
+		depth, int(time.Until(l.Expires).Seconds()), l.Token, davText(davHref(l.Key, l.Deep)))
+}
+
+// davLocks are the locks of a WebDAV gateway, kept in memory: they go when
+// the node stops, as they would when they time out.
+type davLocks struct {
+	mu    sync.Mutex
+	locks map[string]*davLock
+}
+
+func newDavLocks() *davLocks {
+	return &davLocks{locks: make(map[string]*davLock)}
+}
+
+// davUnder reports whether key is under the directory dir.
+func davUnder(key, dir string) bool {
+	if dir == "" {
+		return key != ""
+	}
+	return strings.HasPrefix(key, dir+"/")
+}
+
+// covering returns the locks on key and, with tree, the locks on what is
+// under it. It must be called with mu held.
+func (ls *davLocks) covering(key string, tree bool) []*davLock {
+	now := time.Now()
+	var out []*davLock
+	for token, l := range ls.locks {
+		if now.After(l.Expires) {
+			delete(ls.locks, token)
+			continue
+		}
+		if l.Key == key || l.Deep && davUnder(key, l.Key) || tree && davUnder(l.Key, key) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// check fails with 423 Locked unless the If header of r submits the token
+// of every lock on key, and with tree of every lock under it.
+func (ls *davLocks) check(r *http.Request, key string, tree bool) error {
+	tokens := davIfTokens(r.Header.Get("If"))
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, l := range ls.covering(key, tree) {
+		if !slices.Contains(tokens, l.Token) {
+			return davStatus(http.StatusLocked)
+		}
+	}
+	return nil
+}
+
+// lock locks key, and with deep what is under it, unless any of it is
+// locked already.
+func (ls *davLocks) lock(key string, deep bool, timeout time.Duration) (*davLock, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if len(ls.covering(key, deep)) > 0 {
+		return nil, davStatus(http.StatusLocked)
+	}
+	l := &davLock{
+		Token:   "opaquelocktoken:" + newKeyID(),
+		Key:     key,
+		Deep:    deep,
+		Expires: time.Now().Add(timeout),
+	}
+	ls.locks[l.Token] = l
+	return l, nil
+}
+
+// refresh extends the lock on key whose token the If header of r submits.
+func (ls *davLocks) refresh(r *http.Request, key string, timeout time.Duration) (*davLock, error) {
+	tokens := davIfTokens(r.Header.Get("If"))
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, l := range ls.covering(key, false) {
+		if slices.Contains(tokens, l.Token) {
+			l.Expires = time.Now().Add(timeout)
+			return l, nil
+		}
+	}
+	return nil, davStatus(http.StatusPreconditionFailed)
+}
+
+// unlock removes the lock with token, which has to be on key.
+func (ls *davLocks) unlock(key, token string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, l := range ls.covering(key, false) {
+		if l.Token == token {
+			delete(ls.locks, token)
+			return nil
+		}
+	}
+	return davStatus(http.StatusConflict)
+}
+
+// release removes the locks on key and under it, once it is gone.
+func (ls *davLocks) release(key string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, l := range ls.covering(key, true) {
+		if l.Key == key || davUnder(l.Key, key) {
+			delete(ls.locks, l.Token)
+		}
+	}
+}
+
+// discovery returns the lockdiscovery property of key.
+func (ls *davLocks) discovery(key string) string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	var b strings.Builder
+	for _, l := range ls.covering(key, false) {
+		b.WriteString(l.activelock())
+	}
+	return b.String()
+}
+
+// davIfTokens returns the lock tokens an If header submits. Which resource
+// a tagged list is about and the conditions on entity tags are not looked
+// at: a token is only valid for the resources its lock covers anyway.
+func davIfTokens(h string) []string {
+	var tokens []string
+	for {
+		i := strings.Index(h, "<opaquelocktoken:")
+		if i < 0 {
+			return tokens
+		}
+		h = h[i+1:]
+		j := strings.IndexByte(h, '>')
+		if j < 0 {
+			return tokens
+		}
+		tokens = append(tokens, h[:j])
+		h = h[j+1:]
+	}
+}
+
+// davTimeout returns how long a lock is asked for by the Timeout header of
+// r, at most davMaxLockTimeout.
+func davTimeout(r *http.Request) time.Duration {
+	first, _, _ := strings.Cut(r.Header.Get("Timeout"), ",")
+	if n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(first), "Second-")); err == nil && n > 0 {
+		return min(time.Duration(n)*time.Second, davMaxLockTimeout)
+	}
+	return davMaxLockTimeout
+}
+
+// davLock locks a file, or a directory and by default what is under it.
+// A LOCK without a body refreshes the lock whose token it submits. Locking
+// a missing file creates it empty, as clients lock a file before they
+// write it. Every lock is exclusive.
+func (s *FileServer) davLock(w http.ResponseWriter, r *http.Request, key string, locks *davLocks) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return davStatus(http.StatusBadRequest)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		l, err := locks.refresh(r, key, davTimeout(r))
+		if err != nil {
+			return err
+		}
+		writeLock(w, http.StatusOK, l)
+		return nil
+	}
+
+	e, err := s.davStat(r.Context(), key)
+	status := http.StatusOK
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := s.davParent(r.Context(), key); err != nil {
+			return err
+		}
+		e, status = &davEntry{Key: key}, http.StatusCreated
+	} else if err != nil {
+		return err
+	}
+
+	l, err := locks.lock(key, e.Dir && r.Header.Get("Depth") != "0", davTimeout(r))
+	if err != nil {
+		return err
+	}
+	if status == http.StatusCreated {
+		if _, err := s.Store(key, strings.NewReader("")); err != nil {
+			locks.unlock(key, l.Token)
+			return err
+		}
+	}
+	w.Header().Set("Lock-Token", "<"+l.Token+">")
+	writeLock(w, status, l)
+	return nil
+}
+
+func writeLock(w http.ResponseWriter, status int, l *davLock) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `%s<D:prop xmlns:D="DAV:"><D:lockdiscovery>%s</D:lockdiscovery></D:prop>`,
+		xml.Header, l.activelock())
+}
+
+func writeDAV(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Writing WebDAV response: %v\n", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Prop struct {
+				Props []struct {
+					XMLName xml.Name
+					Value   string `xml:",innerxml"`
+				} `xml:",any"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+func (ms testMultistatus) hrefs() []string {
+	var out []string
+	for _, r := range ms.Responses {
+		out = append(out, r.Href)
+	}
+	return out
+}
+
+func TestWebDAV(t *testing.T) {
+	s := newTestServer(t, FileServerOpts{DB: newTestDB(t)})
+	srv := httptest.NewServer(s.WebDAVHandler())
+	defer srv.Close()
+	propfind := func(path, depth, body string) testMultistatus {
+		resp, b := httpDo(t, "PROPFIND", srv.URL+path, strings.NewReader(body), "Depth", depth)
+		assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+		var ms testMultistatus
+		assert.Nil(t, xml.Unmarshal(b, &ms))
+		return ms
+	}
+
+	resp, _ := httpDo(t, http.MethodOptions, srv.URL+"/", nil)
+	assert.Equal(t, "1, 2", resp.Header.Get("DAV"))
+	assert.Equal(t, []string{"/"}, propfind("/", "1", "").hrefs())
+
+	resp, _ = httpDo(t, "MKCOL", srv.URL+"/docs", nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = httpDo(t, "MKCOL", srv.URL+"/docs", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp, _ = httpDo(t, "MKCOL", srv.URL+"/missing/dir", nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp, _ = httpDo(t, http.MethodPut, srv.URL+"/docs/notes.txt", strings.NewReader("first"))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = httpDo(t, http.MethodPut, srv.URL+"/docs/notes.txt", strings.NewReader("second"))
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = httpDo(t, http.MethodPut, srv.URL+"/missing/notes.txt", strings.NewReader("x"))
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	// directories are key prefixes, files stored otherwise are in them too
+	_, err := s.Store("docs/2024/report one.pdf", strings.NewReader("report"))
+	assert.Nil(t, err)
+
+	resp, body := httpDo(t, http.MethodGet, srv.URL+"/docs/notes.txt", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "second", string(body))
+	resp, _ = httpDo(t, http.MethodHead, srv.URL+"/docs/2024/report%20one.pdf", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "6", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "application/pdf", resp.Header.Get("Content-Type"))
+
+	assert.Equal(t, []string{"/docs/", "/docs/2024/", "/docs/notes.txt"}, propfind("/docs", "1", "").hrefs())
+	assert.Equal(t, []string{"/docs/"}, propfind("/docs/", "0", "").hrefs())
+	assert.Equal(t, []string{"/", "/docs/", "/docs/2024/", "/docs/2024/report%20one.pdf", "/docs/notes.txt"},
+		propfind("/", "infinity", "").hrefs())
+
+	ms := propfind("/docs/notes.txt", "0", `<?xml version="1.0"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:resourcetype/><Z:color xmlns:Z="urn:example"/></D:prop></D:propfind>`)
+	assert.Len(t, ms.Responses, 1)
+	stats := ms.Responses[0].Propstats
+	assert.Len(t, stats, 2)
+	assert.Equal(t, "HTTP/1.1 200 OK", stats[0].Status)
+	assert.Len(t, stats[0].Prop.Props, 2)
+	assert.Equal(t, "getcontentlength", stats[0].Prop.Props[0].XMLName.Local)
+	assert.Equal(t, "6", stats[0].Prop.Props[0].Value)
+	assert.Equal(t, "HTTP/1.1 404 Not Found", stats[1].Status)
+	assert.Equal(t, xml.Name{Space: "urn:example", Local: "color"}, stats[1].Prop.Props[0].XMLName)
+	ms = propfind("/docs", "0", "")
+	assert.Contains(t, ms.Responses[0].Propstats[0].Prop.Props[1].Value, "collection")
+
+	resp, _ = httpDo(t, "PROPPATCH", srv.URL+"/docs/notes.txt", strings.NewReader(`<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:"><D:set><D:prop><D:displayname>x</D:displayname></D:prop></D:set></D:propertyupdate>`))
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+
+	// moving a directory moves the files under it
+	resp, _ = httpDo(t, "MOVE", srv.URL+"/docs", nil, "Destination", srv.URL+"/papers")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, body = httpDo(t, http.MethodGet, srv.URL+"/papers/2024/report%20one.pdf", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "report", string(body))
+	resp, _ = httpDo(t, "PROPFIND", srv.URL+"/docs", nil, "Depth", "0")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.False(t, s.store.Has("docs/notes.txt"))
+
+	resp, _ = httpDo(t, "COPY", srv.URL+"/papers/notes.txt", nil, "Destination", "/papers/copy.txt")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = httpDo(t, "COPY", srv.URL+"/papers/notes.txt", nil, "Destination", "/papers/copy.txt", "Overwrite", "F")
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp, _ = httpDo(t, "MOVE", srv.URL+"/papers", nil, "Destination", "/papers/inside")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, body = httpDo(t, http.MethodGet, srv.URL+"/papers/copy.txt", nil)
+	assert.Equal(t, "second", string(body))
+
+	// clients lock a file before they write it
+	resp, _ = httpDo(t, "LOCK", srv.URL+"/papers/new.txt", strings.NewReader(`<?xml version="1.0"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	token := resp.Header.Get("Lock-Token")
+	assert.True(t, strings.HasPrefix(token, "<opaquelocktoken:"))
+	ms = propfind("/papers/new.txt", "0", `<?xml version="1.0"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:lockdiscovery/></D:prop></D:propfind>`)
+	assert.Contains(t, ms.Responses[0].Propstats[0].Prop.Props[0].Value, strings.Trim(token, "<>"))
+
+	// only requests submitting the token change a locked file
+	resp, _ = httpDo(t, "LOCK", srv.URL+"/papers", strings.NewReader(`<?xml version="1.0"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`))
+	assert.Equal(t, http.StatusLocked, resp.StatusCode)
+	resp, _ = httpDo(t, http.MethodPut, srv.URL+"/papers/new.txt", strings.NewReader("new"))
+	assert.Equal(t, http.StatusLocked, resp.StatusCode)
+	resp, _ = httpDo(t, http.MethodDelete, srv.URL+"/papers", nil)
+	assert.Equal(t, http.StatusLocked, resp.StatusCode)
+	resp, _ = httpDo(t, "MOVE", srv.URL+"/papers/notes.txt", nil, "Destination", "/papers/new.txt")
+	assert.Equal(t, http.StatusLocked, resp.StatusCode)
+	resp, _ = httpDo(t, http.MethodPut, srv.URL+"/papers/new.txt", strings.NewReader("new"), "If", "("+token+")")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, _ = httpDo(t, "LOCK", srv.URL+"/papers/new.txt", nil, "If", "("+token+")", "Timeout", "Second-60")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = httpDo(t, "UNLOCK", srv.URL+"/papers/new.txt", nil, "Lock-Token", "<opaquelocktoken:other>")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, _ = httpDo(t, "UNLOCK", srv.URL+"/papers/new.txt", nil, "Lock-Token", token)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = httpDo(t, http.MethodPut, srv.URL+"/papers/new.txt", strings.NewReader("newer"))
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, _ = httpDo(t, http.MethodDelete, srv.URL+"/papers/", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, []string{"/"}, propfind("/", "infinity", "").hrefs())
+	assert.False(t, s.store.Has("papers/copy.txt"))
+	resp, _ = httpDo(t, http.MethodDelete, srv.URL+"/papers", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}